@@ -9,6 +9,7 @@ import (
 	"gateway/pkg/metric"
 	"gateway/pkg/utils"
 	"log"
+	"os"
 	"os/signal"
 	"syscall"
 	"time"
@@ -25,6 +26,12 @@ func main() {
 	flag.Uint64Var(&configs.Entry.NodeInfo.PublicTcpPort, "node_info_public_tcp_port", 18001, "TCP port for client-facing services")
 	flag.Uint64Var(&configs.Entry.NodeInfo.PrivateHttpPort, "node_info_private_http_port", 18081, "HTTP port for service-facing RPC")
 	flag.StringVar(&configs.Entry.NodeInfo.ServiceAPIURL, "node_info_service_api_url", "http://127.0.0.1:80", "API service Address")
+	flag.Int64Var(&configs.Entry.Admission.MaxConnections, "admission_max_connections", 0, "Max concurrent connections (0 means unlimited)")
+	flag.Int64Var(&configs.Entry.Admission.MaxConnectionsPerIP, "admission_max_connections_per_ip", 0, "Max concurrent connections of one IP (0 means unlimited)")
+	flag.Float64Var(&configs.Entry.Admission.AcceptRate, "admission_accept_rate", 0, "Accepted connections per second (0 means unlimited)")
+	flag.IntVar(&configs.Entry.Admission.AcceptBurst, "admission_accept_burst", 100, "Accept rate burst")
+	flag.StringVar(&configs.Entry.Admission.RejectMode, "admission_reject_mode", "close", "Behavior on rejection (close|frame)")
+	flag.StringVar(&configs.Entry.ConfigFile, "config_file", "", "JSON config file (listeners etc.)")
 	flag.Parse()
 
 	// init config
@@ -53,5 +60,21 @@ func main() {
 	}
 	log.Println("discovery register success")
 
-	<-ctx.Done()
+	// Reload the msgID policies on SIGHUP
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	for {
+		select {
+		case <-reload:
+			if err := gateway.ReloadPolicies(); err != nil {
+				utils.AlertAuto("policy reload fail: " + err.Error())
+				continue
+			}
+			log.Println("policy reload success")
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"encoding/binary"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"gateway/pkg/codec"
 	"gateway/pkg/encoding"
+	"gateway/pkg/secure"
 	"io"
 	"log"
 	"net"
@@ -17,6 +22,15 @@ import (
 
 var StressType string
 var TargetTCPPort, TargetHTTPPort uint
+var SecureMsgID uint
+var SecurePublicKey string
+var Codec string
+var AuthMsgID uint
+var AuthToken string
+var CRC bool
+var Replay bool
+
+var errLoginRejected = errors.New("login rejected")
 
 const (
 	StressTypeGatewayTCP  = "gateway_tcp"  // 网关tcp性能
@@ -33,6 +47,13 @@ func main() {
 	flag.StringVar(&StressType, "stress_type", StressTypeProxy, "测试类型(gateway_tcp|gateway_http|proxy|publish)")
 	flag.UintVar(&TargetTCPPort, "target_tcp_port", 18001, "要测试的tcp服务端口")
 	flag.UintVar(&TargetHTTPPort, "target_http_port", 18081, "要测试的http服务端口")
+	flag.UintVar(&SecureMsgID, "secure_msg_id", 0, "加密握手协议号(0表示不加密)")
+	flag.StringVar(&SecurePublicKey, "secure_public_key", "", "网关公钥(hex)")
+	flag.StringVar(&Codec, "codec", codec.NameClassic, "帧格式(classic|v2)")
+	flag.UintVar(&AuthMsgID, "auth_msg_id", 0, "登录协议号(0表示不登录)")
+	flag.StringVar(&AuthToken, "auth_token", "", "登录令牌")
+	flag.BoolVar(&CRC, "crc", false, "帧尾携带消息crc")
+	flag.BoolVar(&Replay, "replay", false, "帧尾携带消息序号, 用于防重放")
 
 	flag.Parse()
 
@@ -75,7 +96,7 @@ func stressGatewayTCP(connectionNums int) {
 
 	// 建立连接并发
 	for i := 0; i < connectionNums; i++ {
-		conn, err := net.Dial("tcp", fmt.Sprintf("43.138.221.243:%d", TargetTCPPort))
+		conn, err := dial(fmt.Sprintf("43.138.221.243:%d", TargetTCPPort))
 		if err != nil {
 			log.Println(err)
 			errorNum.Add(1)
@@ -95,7 +116,6 @@ func stressGatewayTCP(connectionNums int) {
 			defer conn.Close()
 
 			echoReq := EchoRequest{Message: "你好:" + time.Now().String()}
-			msgHeader := make([]byte, 10)
 			for {
 				time.Sleep(2500 * time.Millisecond)
 				data, err := encoding.Marshal(echoReq)
@@ -105,15 +125,7 @@ func stressGatewayTCP(connectionNums int) {
 					return
 				}
 
-				dataLen := len(data)
-				sendBuf := make([]byte, dataLen+10)
-				copy(sendBuf[10:], data)
-
-				binary.LittleEndian.PutUint16(sendBuf[:2], 1001)
-				binary.LittleEndian.PutUint32(sendBuf[2:6], uint32(dataLen+10))
-				binary.LittleEndian.PutUint32(sendBuf[6:10], 0)
-
-				if _, err := conn.Write(sendBuf); err != nil {
+				if err := writeFrame(conn, 1001, data); err != nil {
 					log.Println("write:", err)
 					errorNum.Add(1)
 					return
@@ -121,36 +133,14 @@ func stressGatewayTCP(connectionNums int) {
 
 				sendNum.Add(1)
 				conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-				n, err := io.ReadFull(conn, msgHeader)
+				id, err := readFrame(conn)
 				if err != nil {
-					log.Println("read head:", err)
+					log.Println("read:", err)
 					// 发生错误
 					errorNum.Add(1)
 					return
 				}
 
-				if n != 10 {
-					errorNum.Add(1)
-					return
-				}
-
-				id := binary.LittleEndian.Uint16(msgHeader[:2])
-				size := binary.LittleEndian.Uint32(msgHeader[2:6])
-				bodySize := size - 10
-
-				msgBody := make([]byte, bodySize)
-				n, err = io.ReadFull(conn, msgBody)
-				if err != nil {
-					log.Println("read body:", err)
-					errorNum.Add(1)
-					return
-				}
-
-				if bodySize != uint32(n) {
-					errorNum.Add(1)
-					return
-				}
-
 				if id == 1001 {
 					succNum.Add(1)
 					succNumTmp.Add(1)
@@ -195,7 +185,7 @@ func stressProxy(connectionNums int) {
 
 	// 建立连接并发
 	for i := 0; i < connectionNums; i++ {
-		conn, err := net.Dial("tcp", fmt.Sprintf("43.138.221.243:%d", TargetTCPPort))
+		conn, err := dial(fmt.Sprintf("43.138.221.243:%d", TargetTCPPort))
 		if err != nil {
 			log.Println(err)
 			errorNum.Add(1)
@@ -215,7 +205,6 @@ func stressProxy(connectionNums int) {
 			defer conn.Close()
 
 			req := SyncTimeRequest{}
-			msgHeader := make([]byte, 10)
 			for {
 				time.Sleep(2500 * time.Millisecond)
 				data, err := encoding.Marshal(req)
@@ -225,15 +214,7 @@ func stressProxy(connectionNums int) {
 					return
 				}
 
-				dataLen := len(data)
-				sendBuf := make([]byte, dataLen+10)
-				copy(sendBuf[10:], data)
-
-				binary.LittleEndian.PutUint16(sendBuf[:2], 6832)
-				binary.LittleEndian.PutUint32(sendBuf[2:6], uint32(dataLen+10))
-				binary.LittleEndian.PutUint32(sendBuf[6:10], 0)
-
-				if _, err := conn.Write(sendBuf); err != nil {
+				if err := writeFrame(conn, 6832, data); err != nil {
 					log.Println("write:", err)
 					errorNum.Add(1)
 					return
@@ -241,36 +222,14 @@ func stressProxy(connectionNums int) {
 
 				sendNum.Add(1)
 				conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-				n, err := io.ReadFull(conn, msgHeader)
+				id, err := readFrame(conn)
 				if err != nil {
-					log.Println("read head:", err)
+					log.Println("read:", err)
 					// 发生错误
 					errorNum.Add(1)
 					return
 				}
 
-				if n != 10 {
-					errorNum.Add(1)
-					return
-				}
-
-				id := binary.LittleEndian.Uint16(msgHeader[:2])
-				size := binary.LittleEndian.Uint32(msgHeader[2:6])
-				bodySize := size - 10
-
-				msgBody := make([]byte, bodySize)
-				n, err = io.ReadFull(conn, msgBody)
-				if err != nil {
-					log.Println("read body:", err)
-					errorNum.Add(1)
-					return
-				}
-
-				if bodySize != uint32(n) {
-					errorNum.Add(1)
-					return
-				}
-
 				if id == 7832 {
 					succNum.Add(1)
 					succNumTmp.Add(1)
@@ -288,3 +247,135 @@ func stressProxy(connectionNums int) {
 func stressPublish() {
 
 }
+
+// 压测连接, 按网关的帧格式收发
+type stressConn struct {
+	net.Conn
+	codec  codec.FrameCodec
+	br     *bufio.Reader
+	client *secure.Client // 加密连接
+	index  uint32         // 下一条消息的序号, 用于crc
+	seq    uint32         // 已发送的数据消息数, 用于防重放
+}
+
+// 建立连接, 指定了网关公钥时先完成加密握手, 指定了登录协议号时再登录
+func dial(address string) (*stressConn, error) {
+	sc, err := handshake(address)
+	if err != nil || AuthMsgID == 0 {
+		return sc, err
+	}
+
+	if err := login(sc); err != nil {
+		sc.Close()
+		return nil, err
+	}
+
+	return sc, nil
+}
+
+// 登录, 网关回复 1 字节结果, 0 表示成功
+func login(conn *stressConn) error {
+	if err := writeFrame(conn, uint32(AuthMsgID), []byte(AuthToken)); err != nil {
+		return err
+	}
+
+	var msgID uint32
+	var body []byte
+	if conn.client != nil {
+		var err error
+		if msgID, body, _, err = conn.client.ReadFrame(); err != nil {
+			return err
+		}
+	} else {
+		header, _, err := codec.ReadHeader(conn.br, conn.codec, nil)
+		if err != nil {
+			return err
+		}
+
+		body = make([]byte, header.Size)
+		if _, err := io.ReadFull(conn.br, body); err != nil {
+			return err
+		}
+		msgID = header.MsgID
+	}
+
+	if msgID != uint32(AuthMsgID) || len(body) != 1 || body[0] != 0 {
+		return errLoginRejected
+	}
+
+	return nil
+}
+
+func handshake(address string) (*stressConn, error) {
+	fc, err := codec.Get(Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := &stressConn{Conn: conn, codec: fc, br: bufio.NewReader(conn)}
+	if SecureMsgID == 0 {
+		return sc, nil
+	}
+
+	serverKey, err := hex.DecodeString(SecurePublicKey)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	sc.client, err = secure.NewClient(conn, fc, uint32(SecureMsgID), ed25519.PublicKey(serverKey))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sc.index = 1 // 握手消息
+
+	return sc, nil
+}
+
+func writeFrame(conn *stressConn, msgID uint32, data []byte) error {
+	var tail uint32
+	if CRC {
+		tail = encoding.CRC(data, conn.index)
+	} else if Replay {
+		conn.seq++
+		tail = conn.seq
+	}
+	conn.index++
+
+	if conn.client != nil {
+		return conn.client.WriteFrame(msgID, data, tail)
+	}
+
+	sendBuf, err := conn.codec.Append(make([]byte, 0, conn.codec.MaxHeaderLen()+len(data)), codec.Header{MsgID: msgID, Size: uint32(len(data)), Tail: tail})
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(append(sendBuf, data...))
+	return err
+}
+
+// 读取一帧, 返回协议号
+func readFrame(conn *stressConn) (uint32, error) {
+	if conn.client != nil {
+		id, _, _, err := conn.client.ReadFrame()
+		return id, err
+	}
+
+	header, _, err := codec.ReadHeader(conn.br, conn.codec, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := conn.br.Discard(int(header.Size)); err != nil {
+		return 0, err
+	}
+
+	return header.MsgID, nil
+}
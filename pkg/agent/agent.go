@@ -1,62 +1,131 @@
 package agent
 
 import (
+	"bufio"
 	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"gateway/pkg/bufpool"
+	"gateway/pkg/codec"
 	"gateway/pkg/configs"
 	"gateway/pkg/hot/hooks"
 	"gateway/pkg/hot/plugins"
 	"gateway/pkg/interfaces"
+	"gateway/pkg/limiter"
 	"gateway/pkg/metric"
+	"gateway/pkg/secure"
 	"gateway/pkg/utils"
 	"gateway/pkg/writer"
 	"io"
 	"net"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
 
 const (
-	msgHeaderLen = 10
+	maxHeartbeatSize = 64
+	readBufferSize   = 4096
 )
 
 var (
 	ErrWriteToSendQueueTimeout = errors.New("write to send queue timeout")
 	ErrBadNetworkProtocol      = errors.New("bad network protocol")
 	ErrIsClosed                = errors.New("is already closed")
+	ErrBadHeartbeat            = errors.New("bad heartbeat")
+
+	readerPool = sync.Pool{
+		New: func() any {
+			return bufio.NewReaderSize(nil, readBufferSize)
+		},
+	}
 )
 
 type Agent struct {
-	gateway interfaces.Gateway
-	conn    net.Conn
-	ctx     context.Context
-	cancel  context.CancelFunc
-	cid     string
-	storage sync.Map
-	address string
-	disable bool
-	w       *writer.Writer
-	wd      chan struct{}
-}
-
-func New(gateway interfaces.Gateway, conn net.Conn, uid string) *Agent {
+	gateway  interfaces.Gateway
+	listener interfaces.Listener
+	conn     net.Conn
+	ctx      context.Context
+	cancel   context.CancelFunc
+	cid      string
+	storage  sync.Map
+	address  string
+	codec    codec.FrameCodec
+	w        *writer.Writer
+	wd       chan struct{}
+
+	state       atomic.Int32 // interfaces.State and flags, see state.go
+	acceptedAt  time.Time
+	established atomic.Bool  // A valid frame was received
+	pingAt      atomic.Int64 // Unix nano of the last server ping
+	rtt         atomic.Int64 // Last measured round trip time
+
+	event   *eventState             // Set in event-loop mode
+	session atomic.Pointer[session] // Set when resume is enabled, replaced when a session is resumed
+	secure  *secureState            // Set on secure listeners
+	streams *streams                // Set when the listener has streams
+	traffic traffic
+	shaper  atomic.Pointer[limiter.Bucket] // Outbound rate limit, nil when not shaped
+
+	identity     atomic.Pointer[interfaces.Identity] // Set by the login
+	loginPending atomic.Bool                         // A login was received
+	loginQueue   loginQueue                          // Messages received while the service checks the login
+
+	compressed bool        // Compression negotiated, only used by the read path
+	reassembly *reassembly // Message being reassembled, only used by the read path
+	msgIndex   uint32      // Index of the inbound message being handled, only used by the read path
+	nextIndex  uint32
+	replay     *replayWindow // Set when replay protection is enabled, only used by the read path
+}
+
+func New(gateway interfaces.Gateway, listener interfaces.Listener, conn net.Conn, uid string) *Agent {
 	agent := new(Agent)
+	agent.listener = listener
 	agent.conn = conn
 	agent.ctx, agent.cancel = context.WithCancel(context.TODO())
 	agent.cid = uid
+	agent.acceptedAt = time.Now()
 	agent.gateway = gateway
-	agent.w = writer.New(conn)
+	agent.codec = listener.GetCodec()
+	agent.w = writer.New(conn, agent.codec)
+	agent.w.SetFragmentSize(listener.GetConfig().Fragment.Size)
+	agent.w.SetCRC(listener.GetConfig().CRC)
 	agent.address = conn.RemoteAddr().String()
 	agent.wd = make(chan struct{}, 5)
 
+	// Set before the agent is registered, pushes may arrive before RunEvent
+	if listener.GetConfig().Mode == configs.ModeEvent {
+		agent.event = new(eventState)
+	}
+
+	config := listener.GetConfig()
+	if config.Resume.MsgID != 0 || config.Sequence.Enabled {
+		agent.session.Store(newSession(uid, agent))
+	}
+
+	if config.Secure.MsgID != 0 {
+		agent.secure = new(secureState)
+	}
+
+	if len(config.Streams.List) > 0 {
+		agent.streams = newStreams(config.Streams)
+	}
+
+	agent.shaper.Store(newShaper(config.Bandwidth.Rate, config.Bandwidth.Burst))
+
+	if config.Replay.Enabled {
+		agent.replay = new(replayWindow)
+	}
+
 	return agent
 }
 
 func (agent *Agent) Run() {
+	agent.start()
+
 	go func() {
 		<-agent.ctx.Done()
 
@@ -66,37 +135,42 @@ func (agent *Agent) Run() {
 	go func() {
 		defer agent.cancel()
 
-		// FIXME Only alert critical errors
 		if err := agent.loopRead(); err != nil {
-			if err == io.EOF || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
-				return
-			}
-
-			var netError net.Error
-			if errors.As(err, &netError) && netError.Timeout() {
-				return
-			}
-
-			utils.AlertLowFrequency(err.Error(), fmt.Sprintf("agent: %s id: %s loop read exit: %v", agent.Address(), agent.GetCID(), err))
-			return
+			agent.closeWithError("loop read", err)
 		}
 	}()
 
 	go func() {
 		defer agent.cancel()
 
-		// FIXME Only alert critical errors
 		if err := agent.loopWrite(); err != nil {
-			if err == io.EOF || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
-				return
-			}
-
-			utils.AlertLowFrequency(err.Error(), fmt.Sprintf("agent: %s id: %s loop write exit: %v", agent.Address(), agent.GetCID(), err))
-			return
+			agent.closeWithError("loop write", err)
 		}
 	}()
 }
 
+// Close the agent, alert errors other than disconnects, timeouts and client login mistakes
+func (agent *Agent) closeWithError(where string, err error) {
+	defer agent.cancel()
+
+	// FIXME Only alert critical errors
+	if err == io.EOF || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
+		return
+	}
+
+	// Counted in count login
+	if errors.Is(err, ErrNotAuthenticated) || errors.Is(err, ErrLoginQueueFull) {
+		return
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return
+	}
+
+	utils.AlertLowFrequency(err.Error(), fmt.Sprintf("agent: %s id: %s %s exit: %v", agent.Address(), agent.GetCID(), where, err))
+}
+
 func (agent *Agent) Close() {
 	if agent == nil {
 		return
@@ -105,20 +179,31 @@ func (agent *Agent) Close() {
 	agent.cancel()
 }
 
+// Closed once the connection is closed
+func (agent *Agent) Done() <-chan struct{} {
+	return agent.ctx.Done()
+}
+
+// Stop forwarding messages, the connection stays open
 func (agent *Agent) Disable() {
 	if agent == nil {
 		return
 	}
 
-	agent.disable = true
+	agent.setState(interfaces.StateDisabled)
 }
 
+// Forward messages again after Disable
 func (agent *Agent) Enable() {
 	if agent == nil {
 		return
 	}
 
-	agent.disable = false
+	if agent.established.Load() {
+		agent.swapState(interfaces.StateDisabled, interfaces.StateAuthenticated)
+	} else {
+		agent.swapState(interfaces.StateDisabled, interfaces.StateHandshaking)
+	}
 }
 
 func (agent *Agent) GetDiscoveryConfig() configs.DiscoveryConfig {
@@ -129,6 +214,10 @@ func (agent *Agent) GetNodeInfoConfig() configs.NodeInfoConfig {
 	return configs.GetNodeInfo()
 }
 
+func (agent *Agent) GetListenerConfig() *configs.ListenerConfig {
+	return agent.listener.GetConfig()
+}
+
 func (agent *Agent) GetSID() string {
 	config := configs.GetNodeInfo()
 	return config.ID
@@ -139,9 +228,31 @@ func (agent *Agent) GetCID() string {
 		return ""
 	}
 
+	// The connection ID belongs to the session, a resumed connection takes it over
+	if s := agent.session.Load(); s != nil {
+		return s.cid
+	}
+
 	return agent.cid
 }
 
+func (agent *Agent) GetMsgIndex() uint32 {
+	if agent == nil {
+		return 0
+	}
+
+	return agent.msgIndex
+}
+
+// Round trip time measured by the last answered server ping
+func (agent *Agent) GetRTT() time.Duration {
+	if agent == nil {
+		return 0
+	}
+
+	return time.Duration(agent.rtt.Load())
+}
+
 // Destruct
 func (agent *Agent) finalizer() {
 	defer func() {
@@ -150,19 +261,34 @@ func (agent *Agent) finalizer() {
 		}
 	}()
 
+	agent.setState(interfaces.StateClosing)
+	defer func() {
+		agent.setState(interfaces.StateClosed)
+		hooks.Close(agent)
+	}()
+
 	// Cleanup
 	metric.CountConnection.Add(-1)
-	agent.gateway.RemoveAgent(agent.cid)
+	agent.stopEvent()
 	agent.conn.Close()
 
-	// Already expired, skip notification
-	if agent.disable {
+	// The session waits for a resume
+	if agent.detach() {
+		return
+	}
+
+	agent.gateway.RemoveAgent(agent.GetCID())
+	agent.notifyDisconnect()
+}
+
+func (agent *Agent) notifyDisconnect() {
+	// Kicked, the service already knows, or never logged in
+	if agent.isDisabled() || agent.loginRequired() {
 		return
 	}
 
-	agent.disable = true
 	// Connection disconnected notification
-	plugins.ForwadHttp(agent, interfaces.Msg{ID: 5006})
+	plugins.ForwadHttp(agent, interfaces.Msg{ID: agent.GetListenerConfig().DisconnectMsgID})
 }
 
 // Read coroutine logic
@@ -173,49 +299,228 @@ func (agent *Agent) loopRead() error {
 		}
 	}()
 
-	msgHeader := make([]byte, msgHeaderLen)
+	config := agent.GetListenerConfig()
+	rawHeader := make([]byte, 0, agent.codec.MaxHeaderLen())
+
+	// Buffered reads, the reader goes back to the pool when the connection ends
+	br := readerPool.Get().(*bufio.Reader)
+	br.Reset(agent.conn)
+	defer func() {
+		br.Reset(nil)
+		readerPool.Put(br)
+	}()
+
 	for {
-		// Read message timeout: 60 seconds
-		agent.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
-		n, err := io.ReadFull(agent.conn, msgHeader)
+		// Read message timeout depends on the connection state, the handshake timeout counts from accept
+		if agent.established.Load() {
+			agent.conn.SetReadDeadline(time.Now().Add(time.Duration(config.Timeout.IdleSec) * time.Second))
+		} else {
+			agent.conn.SetReadDeadline(agent.acceptedAt.Add(time.Duration(config.Timeout.HandshakeSec) * time.Second))
+		}
+		header, raw, err := codec.ReadHeader(br, agent.codec, rawHeader)
+		if err != nil {
+			return err
+		}
+
+		bodySize, err := agent.checkHeader(header)
 		if err != nil {
 			return err
 		}
 
-		if n != msgHeaderLen {
-			return io.EOF
+		// Bodies handed to the pipeline may outlive this loop (concurrent middleware),
+		// only the frames consumed by the gateway itself and fragments use pooled buffers
+		var pooled *[]byte
+		var msgBody []byte
+		if agent.isTransient(header) {
+			pooled = bufpool.Get(int(bodySize))
+			msgBody = *pooled
+		} else {
+			msgBody = make([]byte, bodySize)
 		}
 
-		// Hook
-		if err = hooks.HookHeader(agent, msgHeader); err != nil {
-			return err
+		n, err := io.ReadFull(br, msgBody)
+		if err == nil && bodySize != uint32(n) {
+			err = io.EOF
+		}
+
+		if err == nil {
+			agent.received(header.Len + n)
+			err = agent.handleFrame(header, raw, msgBody)
+		}
+
+		if pooled != nil {
+			bufpool.Put(pooled)
 		}
 
-		id := binary.LittleEndian.Uint16(msgHeader[:2])
-		size := binary.LittleEndian.Uint32(msgHeader[2:6])
-		bodySize := size - msgHeaderLen
-		msgBody := make([]byte, bodySize)
-		n, err = io.ReadFull(agent.conn, msgBody)
 		if err != nil {
 			return err
 		}
+	}
+}
 
-		if bodySize != uint32(n) {
-			return io.EOF
+// Validate a frame header, returns the body size
+func (agent *Agent) checkHeader(header codec.Header) (uint32, error) {
+	// Control frames skip the hooks
+	var maxSize uint32
+	var errBad error
+	switch {
+	case agent.isHandshake(header):
+		if header.Size != secure.HelloSize {
+			return 0, secure.ErrBadHandshake
 		}
 
+		return header.Size, nil
+	case agent.isHeartbeat(header):
+		maxSize, errBad = maxHeartbeatSize, ErrBadHeartbeat
+	case agent.isResume(header):
+		maxSize, errBad = maxResumeSize, ErrBadResume
+	case agent.isAck(header):
+		maxSize, errBad = ackSize, ErrBadAck
+	case agent.isCompression(header):
+		maxSize, errBad = maxCompressionSize, ErrBadCompression
+	case agent.isWindowUpdate(header):
+		maxSize, errBad = windowUpdateSize, ErrBadWindowUpdate
+	default:
 		// Hook
-		if err = hooks.HookBody(agent, msgHeader, msgBody); err != nil {
+		if err := hooks.HookHeader(agent, header); err != nil {
+			return 0, err
+		}
+
+		return header.Size, nil
+	}
+
+	if header.Size > maxSize+agent.overhead() {
+		return 0, errBad
+	}
+
+	return header.Size, nil
+}
+
+func (agent *Agent) isHeartbeat(header codec.Header) bool {
+	heartbeatID := agent.GetListenerConfig().Heartbeat.MsgID
+	return heartbeatID != 0 && header.MsgID == heartbeatID
+}
+
+// Frames consumed by the gateway itself
+func (agent *Agent) isControl(header codec.Header) bool {
+	return agent.isHandshake(header) || agent.isHeartbeat(header) || agent.isResume(header) || agent.isAck(header) || agent.isCompression(header) || agent.isWindowUpdate(header)
+}
+
+// Handle a complete frame, raw is the header as received
+func (agent *Agent) handleFrame(header codec.Header, raw []byte, msgBody []byte) error {
+	// Messages are numbered in the order their last frame arrives, control frames included
+	if !header.More {
+		agent.msgIndex = agent.nextIndex
+		agent.nextIndex++
+	}
+
+	// Bodies of a secure connection are sealed after the handshake
+	if agent.secure != nil {
+		if agent.isHandshake(header) {
+			return agent.handshake(msgBody)
+		}
+
+		var err error
+		if msgBody, err = agent.open(raw, msgBody); err != nil {
 			return err
 		}
+	}
 
-		// If kicked, stop forwarding
-		if !agent.disable {
-			if err := plugins.PluginsMain(agent, interfaces.Msg{ID: id, Body: msgBody}); err != nil {
+	// Data frames may be fragments of a longer message
+	if header.More || agent.reassembly != nil {
+		if agent.isControl(header) {
+			if header.More {
+				return ErrBadFragment
+			}
+		} else {
+			var err error
+			var done bool
+			if header, msgBody, done, err = agent.reassemble(header, msgBody); err != nil || !done {
 				return err
 			}
 		}
 	}
+
+	// Only data frames are compressed
+	if header.Compressed {
+		var err error
+		if msgBody, err = agent.inflate(header, msgBody); err != nil {
+			return err
+		}
+	}
+
+	// Heartbeat is answered by the gateway and never forwarded
+	if agent.isHeartbeat(header) {
+		return agent.heartbeat(msgBody)
+	}
+
+	if agent.isResume(header) {
+		return agent.resume(msgBody)
+	}
+
+	if agent.isAck(header) {
+		return agent.ack(msgBody)
+	}
+
+	if agent.isCompression(header) {
+		return agent.negotiate(msgBody)
+	}
+
+	if agent.isWindowUpdate(header) {
+		return agent.windowUpdate(msgBody)
+	}
+
+	// Hook
+	if err := hooks.HookBody(agent, header, msgBody); err != nil {
+		// Rate limited messages were answered with an error reply, the connection stays open
+		if errors.Is(err, hooks.ErrRateLimited) {
+			return nil
+		}
+
+		return err
+	}
+
+	// Replayed messages
+	if agent.replay != nil {
+		if ok, err := agent.checkReplay(header.Tail); !ok {
+			return err
+		}
+	}
+
+	// Nothing is forwarded before the login
+	if agent.loginRequired() {
+		return agent.login(header, msgBody)
+	}
+	agent.established.Store(true)
+	agent.swapState(interfaces.StateHandshaking, interfaces.StateAuthenticated)
+
+	return agent.forward(agent.newMsg(header, msgBody))
+}
+
+func (agent *Agent) newMsg(header codec.Header, body []byte) interfaces.Msg {
+	msg := interfaces.Msg{ID: header.MsgID, Body: body}
+	if agent.GetListenerConfig().Correlation {
+		msg.RequestID = header.Tail
+	}
+
+	return msg
+}
+
+// Hand a data message to its stream or to the pipeline
+func (agent *Agent) forward(msg interfaces.Msg) error {
+	agent.countMsg(&agent.traffic.msgsIn, "msgs_in")
+
+	// If kicked or closing, stop forwarding
+	if agent.GetState() != interfaces.StateAuthenticated {
+		agent.Drop()
+		return nil
+	}
+
+	if agent.streams != nil {
+		return agent.dispatchStream(msg)
+	}
+
+	return agent.listener.GetPipeline()(agent, msg)
 }
 
 // Write coroutine logic
@@ -226,23 +531,34 @@ func (agent *Agent) loopWrite() error {
 		}
 	}()
 
+	// Server-initiated pings
+	var ping <-chan time.Time
+	if interval := agent.GetListenerConfig().Heartbeat.PingIntervalSec; interval > 0 {
+		tk := time.NewTicker(time.Duration(interval) * time.Second)
+		defer tk.Stop()
+		ping = tk.C
+	}
+
 	for {
 		select {
 		case _, ok := <-agent.wd:
 			if ok {
-				b, err := agent.w.Pop()
-				if err != nil {
+				if err := agent.flush(); err != nil {
 					return err
 				}
 
-				if len(b) == 0 {
-					continue
+				// The batch was full, streams have frames left
+				if agent.streams.ready() {
+					agent.notify()
 				}
+			}
+		case <-ping:
+			if err := agent.ping(); err != nil {
+				return err
+			}
 
-				agent.conn.SetWriteDeadline(time.Now().Add(60 * time.Second))
-				if err := agent.w.Flush(b); err != nil {
-					return err
-				}
+			if err := agent.flush(); err != nil {
+				return err
 			}
 		case <-agent.ctx.Done():
 			return nil
@@ -251,13 +567,107 @@ func (agent *Agent) loopWrite() error {
 
 }
 
-func (agent *Agent) Write(msgID uint16, msg []byte) error {
+// Send everything queued in the writer
+func (agent *Agent) flush() error {
+	if err := agent.pump(); err != nil {
+		return err
+	}
+
+	b, err := agent.w.Pop()
+	if err != nil {
+		return err
+	}
+
+	n := b.Len()
+	if n == 0 {
+		return nil
+	}
+
+	if !agent.shape(n) {
+		return net.ErrClosed
+	}
+
+	timeout := agent.GetListenerConfig().Timeout.WriteSec
+	agent.conn.SetWriteDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+
+	if err := agent.w.Flush(b); err != nil {
+		return err
+	}
+
+	agent.sent(n)
+	return nil
+}
+
+// Queue a ping carrying the send time, the client echoes it back unchanged
+func (agent *Agent) ping() error {
+	now := time.Now().UnixNano()
+	agent.pingAt.Store(now)
+
+	body := binary.LittleEndian.AppendUint64(nil, uint64(now))
+	return agent.enqueue(agent.GetListenerConfig().Heartbeat.MsgID, body, 0)
+}
+
+// Answer a client heartbeat, or record the RTT if it echoes our last ping
+func (agent *Agent) heartbeat(body []byte) error {
+	if len(body) == 8 {
+		sentAt := int64(binary.LittleEndian.Uint64(body))
+		if sentAt != 0 && sentAt == agent.pingAt.Load() {
+			rtt := time.Now().UnixNano() - sentAt
+			agent.rtt.Store(rtt)
+			metric.P99HeartbeatRTT.In(agent.GetListenerConfig().Name, time.Duration(rtt).Milliseconds())
+			return nil
+		}
+	}
+
+	return agent.send(agent.GetListenerConfig().Heartbeat.MsgID, body, 0)
+}
+
+// Data frames are counted by the session for replay
+func (agent *Agent) Write(msgID uint32, msg []byte) error {
+	return agent.WriteReply(msgID, msg, 0)
+}
+
+// Response to a request, the header carries the request ID in correlation mode
+func (agent *Agent) WriteReply(msgID uint32, msg []byte, requestID uint32) error {
+	if err := agent.writeReply(msgID, msg, requestID); err != nil {
+		agent.Drop()
+		return err
+	}
+
+	agent.countMsg(&agent.traffic.msgsOut, "msgs_out")
+	return nil
+}
+
+func (agent *Agent) writeReply(msgID uint32, msg []byte, requestID uint32) error {
+	if s := agent.session.Load(); s != nil {
+		return s.write(msgID, msg, requestID)
+	}
+
+	if agent.streams != nil {
+		return agent.pushStream(msgID, msg, requestID)
+	}
+
+	return agent.send(msgID, msg, requestID)
+}
+
+// Queue a frame and wake up the writer
+func (agent *Agent) send(msgID uint32, msg []byte, seqID uint32) error {
 	// First write to cache, then notify to ensure delivery
-	err := agent.w.Write(msgID, msg, 0)
+	err := agent.enqueue(msgID, msg, seqID)
 	if err != nil {
 		return err
 	}
 
+	agent.notify()
+	return nil
+}
+
+func (agent *Agent) notify() {
+	if agent.event != nil {
+		agent.scheduleFlush()
+		return
+	}
+
 	// If notification times out, discard (queue is full)
 	tk := time.NewTicker(5 * time.Millisecond)
 	defer tk.Stop()
@@ -266,8 +676,6 @@ func (agent *Agent) Write(msgID uint16, msg []byte) error {
 	case <-tk.C:
 	case agent.wd <- struct{}{}:
 	}
-
-	return nil
 }
 
 func (agent *Agent) Get(key string) (any, bool) {
@@ -0,0 +1,474 @@
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testGateway struct {
+	agents sync.Map
+}
+
+func (g *testGateway) GenerateAgentUID() string {
+	return "test"
+}
+
+func (g *testGateway) RemoveAgent(id string) interfaces.Agent {
+	if v, ok := g.agents.LoadAndDelete(id); ok {
+		return v.(interfaces.Agent)
+	}
+
+	return nil
+}
+
+func (g *testGateway) GetAgent(id string) interfaces.Agent {
+	if v, ok := g.agents.Load(id); ok {
+		return v.(interfaces.Agent)
+	}
+
+	return nil
+}
+
+func (g *testGateway) ReplaceAgent(id string, old interfaces.Agent, agent interfaces.Agent) bool {
+	return g.agents.CompareAndSwap(id, old, agent)
+}
+
+type testListener struct {
+	config    configs.ListenerConfig
+	pipeline  interfaces.EndPoint
+	serverKey ed25519.PrivateKey
+}
+
+func (l *testListener) GetConfig() *configs.ListenerConfig {
+	return &l.config
+}
+
+func (l *testListener) GetPipeline() interfaces.EndPoint {
+	return l.pipeline
+}
+
+func (l *testListener) GetServerKey() ed25519.PrivateKey {
+	return l.serverKey
+}
+
+func (l *testListener) GetAuthKey() []byte {
+	return nil
+}
+
+func (l *testListener) GetCodec() codec.FrameCodec {
+	fc, _ := codec.Get(l.config.Codec)
+	return fc
+}
+
+// Messages handed to the pipeline, in order
+type testPipeline struct {
+	sync.Mutex
+	msgs []interfaces.Msg
+}
+
+func (p *testPipeline) endPoint(agent interfaces.Agent, msg interfaces.Msg) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.msgs = append(p.msgs, msg)
+	return nil
+}
+
+func (p *testPipeline) ids() []uint32 {
+	p.Lock()
+	defer p.Unlock()
+
+	ids := make([]uint32, 0, len(p.msgs))
+	for _, msg := range p.msgs {
+		ids = append(ids, msg.ID)
+	}
+
+	return ids
+}
+
+// Agent on one end of a pipe, not running: frames are handed to handleFrame by the test
+func newTestAgent(t *testing.T, config configs.ListenerConfig, pipeline interfaces.EndPoint) (*Agent, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	if pipeline == nil {
+		pipeline = func(interfaces.Agent, interfaces.Msg) error { return nil }
+	}
+
+	agent := New(new(testGateway), &testListener{config: config, pipeline: pipeline}, server, "test")
+	agent.start()
+	t.Cleanup(agent.Close)
+
+	return agent, client
+}
+
+type testFrame struct {
+	header codec.Header
+	body   []byte
+}
+
+// Flush the frames queued in the writer and read them on the client end
+func flushFrames(t *testing.T, agent *Agent, client net.Conn) []testFrame {
+	t.Helper()
+
+	batch, err := agent.w.Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The pipe blocks until the frames are read
+	n := batch.Len()
+	flushed := make(chan error, 1)
+	go func() { flushed <- agent.w.Flush(batch) }()
+
+	var frames []testFrame
+	br := bufio.NewReader(client)
+	for read := 0; read < n; {
+		header, _, err := codec.ReadHeader(br, agent.codec, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		body := make([]byte, header.Size)
+		if _, err := io.ReadFull(br, body); err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, testFrame{header: header, body: body})
+		read += header.Len + int(header.Size)
+	}
+
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+
+	return frames
+}
+
+// Wait until cond holds or fail after a second
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	const heartbeatMsgID = 5000
+
+	stale := binary.LittleEndian.AppendUint64(nil, 12345)
+	tests := []struct {
+		name   string
+		body   func(ping []byte) []byte // Heartbeat sent by the client after a server ping
+		echoed bool
+		rtt    bool
+	}{
+		{"client heartbeat", func([]byte) []byte { return []byte("abc") }, true, false},
+		{"empty", func([]byte) []byte { return nil }, true, false},
+		{"ping echo", func(ping []byte) []byte { return ping }, false, true},
+		{"stale ping", func([]byte) []byte { return stale }, true, false},
+		{"zero", func([]byte) []byte { return make([]byte, 8) }, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := configs.DefaultListenerConfig()
+			config.Heartbeat.MsgID = heartbeatMsgID
+			pipeline := new(testPipeline)
+			agent, client := newTestAgent(t, config, pipeline.endPoint)
+
+			if err := agent.ping(); err != nil {
+				t.Fatal(err)
+			}
+
+			frames := flushFrames(t, agent, client)
+			if len(frames) != 1 || frames[0].header.MsgID != heartbeatMsgID || len(frames[0].body) != 8 {
+				t.Fatalf("ping frames %+v", frames)
+			}
+			time.Sleep(2 * time.Millisecond)
+
+			body := tt.body(frames[0].body)
+			if err := agent.handleFrame(codec.Header{MsgID: heartbeatMsgID, Size: uint32(len(body))}, nil, body); err != nil {
+				t.Fatal(err)
+			}
+
+			frames = flushFrames(t, agent, client)
+			if tt.echoed != (len(frames) == 1) || tt.echoed && !bytes.Equal(frames[0].body, body) {
+				t.Fatalf("answer %+v, want echoed %v", frames, tt.echoed)
+			}
+
+			if rtt := agent.GetRTT(); tt.rtt != (rtt >= 2*time.Millisecond) || !tt.rtt && rtt != 0 {
+				t.Fatalf("rtt %v, measured %v", rtt, tt.rtt)
+			}
+
+			// Heartbeats are never forwarded
+			if ids := pipeline.ids(); len(ids) != 0 {
+				t.Fatalf("forwarded %v", ids)
+			}
+		})
+	}
+}
+
+func TestHeartbeatSize(t *testing.T) {
+	config := configs.DefaultListenerConfig()
+	config.Heartbeat.MsgID = 5000
+	agent, _ := newTestAgent(t, config, nil)
+
+	if _, err := agent.checkHeader(codec.Header{MsgID: 5000, Size: maxHeartbeatSize}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := agent.checkHeader(codec.Header{MsgID: 5000, Size: maxHeartbeatSize + 1}); !errors.Is(err, ErrBadHeartbeat) {
+		t.Fatalf("checkHeader() = %v, want %v", err, ErrBadHeartbeat)
+	}
+}
+
+func TestReadTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		frames  int           // Data frames sent before going quiet
+		minWait time.Duration // The read loop ends after at least this long
+	}{
+		{"handshake", 0, 0},
+		{"idle after a frame", 1, 500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := configs.DefaultListenerConfig()
+			config.Timeout.HandshakeSec = 1
+			config.Timeout.IdleSec = 1
+			agent, client := newTestAgent(t, config, nil)
+
+			// The handshake timeout counts from accept, it expires shortly
+			agent.acceptedAt = time.Now().Add(-900 * time.Millisecond)
+			start := time.Now()
+			readErr := make(chan error, 1)
+			go func() { readErr <- agent.loopRead() }()
+
+			for i := 0; i < tt.frames; i++ {
+				frame, _ := codec.Classic{}.Append(nil, codec.Header{MsgID: 2000, Size: 1})
+				if _, err := client.Write(append(frame, 1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var err error
+			select {
+			case err = <-readErr:
+			case <-time.After(3 * time.Second):
+				t.Fatal("read loop still running")
+			}
+
+			var netError net.Error
+			if !errors.As(err, &netError) || !netError.Timeout() {
+				t.Fatalf("read loop exit %v, want a timeout", err)
+			}
+
+			if elapsed := time.Since(start); elapsed < tt.minWait {
+				t.Fatalf("timed out after %v, want at least %v", elapsed, tt.minWait)
+			}
+		})
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	config := configs.DefaultListenerConfig()
+	config.Timeout.WriteSec = 1
+	agent, _ := newTestAgent(t, config, nil)
+
+	// Nobody reads the other end of the pipe
+	if err := agent.Write(2000, []byte("stuck")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	var netError net.Error
+	if err := agent.flush(); !errors.As(err, &netError) || !netError.Timeout() {
+		t.Fatalf("flush() = %v, want a timeout", err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("timed out after %v, want 1s", elapsed)
+	}
+}
+
+func TestCorrelation(t *testing.T) {
+	tests := []struct {
+		name        string
+		correlation bool
+		streams     bool
+		msgID       uint32
+		requestID   uint32 // Forwarded and echoed in the reply tail
+	}{
+		{"off", false, false, 2000, 0},
+		{"on", true, false, 2000, 42},
+		{"stream", true, true, 3000, 42},
+		{"default stream", true, true, 2000, 42},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := configs.DefaultListenerConfig()
+			if tt.streams {
+				config = newStreamConfig(0)
+			}
+			config.Correlation = tt.correlation
+
+			// The service answers every request, then pushes a message. Streams run it on their worker
+			forwarded := make(chan uint32, 1)
+			echo := func(agent interfaces.Agent, msg interfaces.Msg) error {
+				defer func() { forwarded <- msg.RequestID }()
+				if err := agent.WriteReply(msg.ID+1, msg.Body, msg.RequestID); err != nil {
+					return err
+				}
+				return agent.Write(msg.ID+2, nil)
+			}
+			agent, client := newTestAgent(t, config, echo)
+
+			if err := agent.handleFrame(codec.Header{MsgID: tt.msgID, Size: 1, Tail: 42}, nil, []byte{1}); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case requestID := <-forwarded:
+				if requestID != tt.requestID {
+					t.Fatalf("forwarded request ID %d, want %d", requestID, tt.requestID)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("request not forwarded")
+			}
+
+			if err := agent.pump(); err != nil {
+				t.Fatal(err)
+			}
+
+			frames := flushFrames(t, agent, client)
+			if len(frames) != 2 {
+				t.Fatalf("%d frames sent, want 2", len(frames))
+			}
+
+			if reply := frames[0].header; reply.MsgID != tt.msgID+1 || reply.Tail != tt.requestID {
+				t.Fatalf("reply %d tail %d, want %d tail %d", reply.MsgID, reply.Tail, tt.msgID+1, tt.requestID)
+			}
+
+			if push := frames[1].header; push.MsgID != tt.msgID+2 || push.Tail != 0 {
+				t.Fatalf("push %d tail %d, want %d tail 0", push.MsgID, push.Tail, tt.msgID+2)
+			}
+		})
+	}
+}
+
+// Connection replaying one frame until n frames were read
+type replayConn struct {
+	net.Conn
+	frame []byte
+	left  int // Bytes left to read
+	pos   int
+}
+
+func newReplayConn(frame []byte, n int) *replayConn {
+	return &replayConn{frame: frame, left: len(frame) * n}
+}
+
+func (conn *replayConn) Read(p []byte) (int, error) {
+	if conn.left == 0 {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && conn.left > 0 {
+		c := copy(p[n:min(len(p), n+conn.left)], conn.frame[conn.pos:])
+		n += c
+		conn.left -= c
+		conn.pos = (conn.pos + c) % len(conn.frame)
+	}
+
+	return n, nil
+}
+
+func (conn *replayConn) RemoteAddr() net.Addr              { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (conn *replayConn) SetReadDeadline(t time.Time) error { return nil }
+
+// Agent reading echoed pings: the frames are handled without writing anything
+func newBenchmarkAgent(b *testing.B) (*Agent, []byte) {
+	config := configs.DefaultListenerConfig()
+	config.Heartbeat.MsgID = 5000
+	agent := New(new(testGateway), &testListener{config: config}, newReplayConn(nil, 0), "bench")
+	agent.pingAt.Store(time.Now().UnixNano())
+
+	body := binary.LittleEndian.AppendUint64(nil, uint64(agent.pingAt.Load()))
+	frame, err := codec.Classic{}.Append(nil, codec.Header{MsgID: 5000, Size: uint32(len(body))})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return agent, append(frame, body...)
+}
+
+func BenchmarkLoopRead(b *testing.B) {
+	agent, frame := newBenchmarkAgent(b)
+	agent.conn = newReplayConn(frame, b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	if err := agent.loopRead(); err != io.EOF {
+		b.Fatal(err)
+	}
+}
+
+// The read path before pooling: unbuffered header reads and a body allocated per frame,
+// kept as the baseline of BenchmarkLoopRead
+func BenchmarkLegacyLoopRead(b *testing.B) {
+	agent, frame := newBenchmarkAgent(b)
+	conn := newReplayConn(frame, b.N)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	msgHeader := make([]byte, 10)
+	for i := 0; i < b.N; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Minute))
+		if _, err := io.ReadFull(conn, msgHeader); err != nil {
+			b.Fatal(err)
+		}
+
+		header, err := agent.codec.Decode(msgHeader)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		bodySize, err := agent.checkHeader(header)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		msgBody := make([]byte, bodySize)
+		if _, err := io.ReadFull(conn, msgBody); err != nil {
+			b.Fatal(err)
+		}
+
+		if err := agent.handleFrame(header, msgHeader, msgBody); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package agent
+
+import (
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/compress"
+)
+
+// Compression: the client lists the algorithms it supports in a negotiation frame, the
+// gateway answers with the one it picked (0 for none). Afterwards data frames may be
+// compressed in both directions, the frame codec flags them in the header
+
+const maxCompressionSize = 16
+
+var ErrBadCompression = errors.New("bad compression")
+
+func (agent *Agent) isCompression(header codec.Header) bool {
+	compressionID := agent.GetListenerConfig().Compression.MsgID
+	return compressionID != 0 && header.MsgID == compressionID
+}
+
+// Answer a negotiation request, outbound compression starts after the answer
+func (agent *Agent) negotiate(body []byte) error {
+	config := agent.GetListenerConfig().Compression
+	algorithm := compress.Negotiate(body)
+
+	if err := agent.send(config.MsgID, []byte{algorithm}, 0); err != nil {
+		return err
+	}
+
+	agent.compressed = algorithm == compress.AlgorithmDeflate
+	if agent.compressed {
+		agent.w.SetCompression(config.Threshold, config.Level)
+	} else {
+		agent.w.SetCompression(0, 0)
+	}
+
+	return nil
+}
+
+// Decompress a data frame, the body may not grow past the frame or reassembly size limit
+func (agent *Agent) inflate(header codec.Header, msgBody []byte) ([]byte, error) {
+	if !agent.compressed || agent.isControl(header) {
+		return nil, ErrBadCompression
+	}
+
+	config := agent.GetListenerConfig()
+	return compress.Inflate(msgBody, max(int(config.MaxMsgSize)-header.Len, config.Fragment.MaxReassembly))
+}
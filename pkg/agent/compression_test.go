@@ -0,0 +1,121 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/compress"
+	"gateway/pkg/configs"
+	"slices"
+	"testing"
+)
+
+const testCompressionMsgID = 5020
+
+func newCompressionConfig() configs.ListenerConfig {
+	config := configs.DefaultListenerConfig()
+	config.Compression.MsgID = testCompressionMsgID
+	config.Compression.Threshold = 64
+	config.Compression.Level = compress.MaxLevel
+	config.MaxMsgSize = 1024
+	return config
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		name       string
+		offers     [][]byte
+		answers    []byte
+		compressed bool
+	}{
+		{"deflate", [][]byte{{compress.AlgorithmDeflate}}, []byte{compress.AlgorithmDeflate}, true},
+		{"unknown", [][]byte{{7}}, []byte{compress.AlgorithmNone}, false},
+		{"empty", [][]byte{nil}, []byte{compress.AlgorithmNone}, false},
+		{"turned off", [][]byte{{compress.AlgorithmDeflate}, {compress.AlgorithmNone}}, []byte{compress.AlgorithmDeflate, compress.AlgorithmNone}, false},
+		{"turned on", [][]byte{{compress.AlgorithmNone}, {7, compress.AlgorithmDeflate}}, []byte{compress.AlgorithmNone, compress.AlgorithmDeflate}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline := new(testPipeline)
+			agent, client := newTestAgent(t, newCompressionConfig(), pipeline.endPoint)
+
+			var answers []byte
+			for _, offer := range tt.offers {
+				if err := agent.handleFrame(codec.Header{MsgID: testCompressionMsgID, Size: uint32(len(offer))}, nil, offer); err != nil {
+					t.Fatal(err)
+				}
+
+				for _, f := range flushFrames(t, agent, client) {
+					if f.header.MsgID != testCompressionMsgID || len(f.body) != 1 || f.header.Compressed {
+						t.Fatalf("answer %+v %v", f.header, f.body)
+					}
+					answers = append(answers, f.body[0])
+				}
+			}
+
+			if !slices.Equal(answers, tt.answers) {
+				t.Fatalf("answers %v, want %v", answers, tt.answers)
+			}
+
+			// Outbound bodies over the threshold follow the last answer
+			msg := bytes.Repeat([]byte("a"), 128)
+			if err := agent.Write(2000, msg); err != nil {
+				t.Fatal(err)
+			}
+
+			frames := flushFrames(t, agent, client)
+			if len(frames) != 1 || frames[0].header.Compressed != tt.compressed {
+				t.Fatalf("frames %+v, want one compressed %v", frames, tt.compressed)
+			}
+
+			// Inbound compressed frames are refused when compression is off
+			body, _ := compress.Deflate(make([]byte, 0, len(msg)), msg, compress.MinLevel)
+			err := agent.handleFrame(codec.Header{MsgID: 2000, Size: uint32(len(body)), Compressed: true}, nil, body)
+			if tt.compressed && err != nil || !tt.compressed && !errors.Is(err, ErrBadCompression) {
+				t.Fatalf("compressed frame: %v", err)
+			}
+
+			if tt.compressed && (len(pipeline.msgs) != 1 || !bytes.Equal(pipeline.msgs[0].Body, msg)) {
+				t.Fatalf("forwarded %d messages", len(pipeline.msgs))
+			}
+		})
+	}
+}
+
+func TestInflateLimit(t *testing.T) {
+	deflate := func(size int) []byte {
+		body, _ := compress.Deflate(make([]byte, 0, size), bytes.Repeat([]byte("a"), size), compress.MaxLevel)
+		return body
+	}
+
+	tests := []struct {
+		name string
+		msg  uint32
+		body []byte
+		err  error
+	}{
+		{"under the limit", 2000, deflate(1000), nil},
+		{"at the limit", 2000, deflate(1024 - 10), nil}, // max_msg_size counts the classic header
+		{"over the limit", 2000, deflate(1024 - 9), compress.ErrTooLarge},
+		{"bomb", 2000, deflate(1 << 20), compress.ErrTooLarge},
+		{"bad data", 2000, []byte{0xff, 0xff}, compress.ErrBadData},
+		{"control frame", testCompressionMsgID, deflate(100), ErrBadCompression},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, client := newTestAgent(t, newCompressionConfig(), nil)
+			offer := []byte{compress.AlgorithmDeflate}
+			if err := agent.handleFrame(codec.Header{MsgID: testCompressionMsgID, Size: 1}, nil, offer); err != nil {
+				t.Fatal(err)
+			}
+			flushFrames(t, agent, client)
+
+			header := codec.Header{MsgID: tt.msg, Size: uint32(len(tt.body)), Compressed: true, Len: 10}
+			if err := agent.handleFrame(header, nil, tt.body); !errors.Is(err, tt.err) {
+				t.Fatalf("handleFrame() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
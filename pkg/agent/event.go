@@ -0,0 +1,247 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/pkg/codec"
+	"gateway/pkg/netpoll"
+	"gateway/pkg/utils"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Event-loop mode: an idle connection holds no goroutine, frames are decoded and dispatched
+// on the poller workers and queued frames are sent by a short-lived flush goroutine
+
+const (
+	eventReadSize    = 4096
+	maxIdleReadBuf   = 64 * 1024
+	eventCloseReason = "event loop"
+)
+
+var ErrNoRawConn = errors.New("connection has no raw file descriptor")
+
+type eventState struct {
+	sync.Mutex // Guards the setup and teardown of the handle and timers
+
+	poller    *netpoll.Poller
+	handle    *netpoll.Handle
+	inbuf     []byte
+	header    codec.Header // Validated header at the front of inbuf
+	hasHeader bool
+	readTimer *time.Timer
+	pingTimer *time.Timer
+	flushing  atomic.Bool
+}
+
+// Serve the agent on the poller, an agent that fails before it starts is left to the caller
+func (agent *Agent) RunEvent(poller *netpoll.Poller) error {
+	sc, ok := agent.conn.(syscall.Conn)
+	if !ok {
+		return ErrNoRawConn
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	config := agent.GetListenerConfig()
+	context.AfterFunc(agent.ctx, agent.finalizer)
+	agent.start()
+
+	ev := agent.event
+	ev.Lock()
+	defer ev.Unlock()
+
+	ev.poller = poller
+
+	// Read timeout, the handshake timeout counts from accept
+	ev.readTimer = time.AfterFunc(time.Until(agent.acceptedAt.Add(time.Duration(config.Timeout.HandshakeSec)*time.Second)), agent.Close)
+
+	// Server-initiated pings
+	if interval := config.Heartbeat.PingIntervalSec; interval > 0 {
+		ev.pingTimer = time.AfterFunc(time.Duration(interval)*time.Second, agent.eventPing)
+	}
+
+	ev.handle, err = poller.Register(raw, agent.onReadable)
+	if err != nil {
+		agent.cancel()
+		return err
+	}
+
+	return nil
+}
+
+// Runs on a poller worker, never concurrently for the same agent
+func (agent *Agent) onReadable(h *netpoll.Handle) {
+	defer func() {
+		if err := recover(); err != nil {
+			utils.AlertAuto(fmt.Sprintf("agent painc, id: %s ip: %s err: %v stack: %s", agent.GetCID(), agent.Address(), err, string(debug.Stack())))
+			agent.Close()
+		}
+	}()
+
+	ev := agent.event
+
+	// Keep room for a whole frame once its header is known
+	need := eventReadSize
+	if ev.hasHeader && ev.header.Len+int(ev.header.Size)-len(ev.inbuf) > need {
+		need = ev.header.Len + int(ev.header.Size) - len(ev.inbuf)
+	}
+	if cap(ev.inbuf)-len(ev.inbuf) < need {
+		buf := make([]byte, len(ev.inbuf), len(ev.inbuf)+need)
+		copy(buf, ev.inbuf)
+		ev.inbuf = buf
+	}
+
+	// One read per wakeup, the poller wakes us again while data is left
+	n, err := h.Read(ev.inbuf[len(ev.inbuf):cap(ev.inbuf)])
+	if err != nil && !netpoll.IsAgain(err) {
+		agent.closeWithError(eventCloseReason, err)
+		return
+	}
+
+	if err == nil && n == 0 {
+		agent.Close()
+		return
+	}
+	ev.inbuf = ev.inbuf[:len(ev.inbuf)+n]
+
+	progressed := false
+	buf := ev.inbuf
+	for {
+		if !ev.hasHeader {
+			header, err := agent.codec.Decode(buf)
+			if err == codec.ErrShortHeader {
+				break
+			}
+
+			if err == nil {
+				_, err = agent.checkHeader(header)
+			}
+
+			if err != nil {
+				agent.closeWithError(eventCloseReason, err)
+				return
+			}
+			ev.header, ev.hasHeader = header, true
+		}
+
+		frameLen := ev.header.Len + int(ev.header.Size)
+		if len(buf) < frameLen {
+			break
+		}
+
+		// The body is handed to the pipeline, it must not share the read buffer,
+		// frames consumed by the gateway itself and fragments are read in place
+		msgBody := buf[ev.header.Len:frameLen]
+		if !agent.isTransient(ev.header) {
+			msgBody = make([]byte, ev.header.Size)
+			copy(msgBody, buf[ev.header.Len:])
+		}
+		agent.received(frameLen)
+		if err := agent.handleFrame(ev.header, buf[:ev.header.Len], msgBody); err != nil {
+			agent.closeWithError(eventCloseReason, err)
+			return
+		}
+
+		buf = buf[frameLen:]
+		ev.hasHeader = false
+		progressed = true
+	}
+
+	// Keep the partial frame, release the buffer of idle connections
+	left := copy(ev.inbuf, buf)
+	ev.inbuf = ev.inbuf[:left]
+	if left == 0 && cap(ev.inbuf) > maxIdleReadBuf {
+		ev.inbuf = nil
+	}
+
+	if progressed && agent.established.Load() {
+		ev.readTimer.Reset(time.Duration(agent.GetListenerConfig().Timeout.IdleSec) * time.Second)
+	}
+
+	if err := h.Rearm(); err != nil {
+		agent.Close()
+	}
+}
+
+// Send queued frames on a goroutine that exits once the writer is empty
+func (agent *Agent) scheduleFlush() {
+	ev := agent.event
+	if !ev.flushing.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				utils.AlertAuto(fmt.Sprintf("agent painc, id: %s ip: %s err: %v stack: %s", agent.GetCID(), agent.Address(), err, string(debug.Stack())))
+				agent.Close()
+			}
+		}()
+
+		for {
+			if err := agent.flush(); err != nil {
+				ev.flushing.Store(false)
+				agent.closeWithError(eventCloseReason, err)
+				return
+			}
+			ev.flushing.Store(false)
+
+			// A frame queued after Pop found the flag still set, or streams have frames left
+			if agent.w.Len() == 0 && !agent.streams.ready() || !ev.flushing.CompareAndSwap(false, true) {
+				return
+			}
+		}
+	}()
+}
+
+func (agent *Agent) eventPing() {
+	if agent.ctx.Err() != nil {
+		return
+	}
+
+	if err := agent.ping(); err != nil {
+		agent.closeWithError(eventCloseReason, err)
+		return
+	}
+
+	agent.scheduleFlush()
+
+	ev := agent.event
+	ev.Lock()
+	defer ev.Unlock()
+
+	if agent.ctx.Err() == nil {
+		ev.pingTimer.Reset(time.Duration(agent.GetListenerConfig().Heartbeat.PingIntervalSec) * time.Second)
+	}
+}
+
+// Release the event loop resources, the connection is closed afterwards
+func (agent *Agent) stopEvent() {
+	ev := agent.event
+	if ev == nil {
+		return
+	}
+
+	ev.Lock()
+	defer ev.Unlock()
+
+	if ev.readTimer != nil {
+		ev.readTimer.Stop()
+	}
+
+	if ev.pingTimer != nil {
+		ev.pingTimer.Stop()
+	}
+
+	if ev.handle != nil {
+		ev.handle.Close()
+	}
+}
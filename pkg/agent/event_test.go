@@ -0,0 +1,274 @@
+//go:build linux
+
+package agent
+
+import (
+	"bufio"
+	"bytes"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/netpoll"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Agent served by a poller on the server end of a TCP connection
+func newEventAgent(t *testing.T, pipeline interfaces.EndPoint) (*Agent, net.Conn, *netpoll.Poller) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poller, err := netpoll.New(2, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(poller.Close)
+
+	if pipeline == nil {
+		pipeline = func(interfaces.Agent, interfaces.Msg) error { return nil }
+	}
+
+	config := configs.DefaultListenerConfig()
+	config.Mode = configs.ModeEvent
+	agent := New(new(testGateway), &testListener{config: config, pipeline: pipeline}, server, "test")
+	if err := agent.RunEvent(poller); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		agent.Close()
+		waitFor(t, "close", func() bool { return agent.GetState() == interfaces.StateClosed })
+	})
+
+	return agent, client, poller
+}
+
+func appendFrame(t *testing.T, dst []byte, msgID uint32, body []byte) []byte {
+	t.Helper()
+
+	dst, err := codec.Classic{}.Append(dst, codec.Header{MsgID: msgID, Size: uint32(len(body))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return append(dst, body...)
+}
+
+// Bodies handed to the pipeline, in order
+type bodyPipeline struct {
+	sync.Mutex
+	bodies []string
+}
+
+func (p *bodyPipeline) endPoint(agent interfaces.Agent, msg interfaces.Msg) error {
+	p.Lock()
+	defer p.Unlock()
+
+	p.bodies = append(p.bodies, string(msg.Body))
+	return nil
+}
+
+func (p *bodyPipeline) wait(t *testing.T, n int) []string {
+	t.Helper()
+
+	waitFor(t, "messages", func() bool {
+		p.Lock()
+		defer p.Unlock()
+
+		return len(p.bodies) >= n
+	})
+
+	p.Lock()
+	defer p.Unlock()
+
+	return slices.Clone(p.bodies)
+}
+
+func TestEventSplitFrames(t *testing.T) {
+	large := string(bytes.Repeat([]byte("x"), 3*eventReadSize))
+	tests := []struct {
+		name   string
+		bodies []string
+		cuts   []int // Offsets where the stream is split into separate writes
+	}{
+		{"whole", []string{"hello", "world!"}, nil},
+		{"header", []string{"hello", "world!"}, []int{3}},
+		{"body", []string{"hello", "world!"}, []int{12}},
+		{"next header", []string{"hello", "world!"}, []int{17}},
+		{"every byte", []string{"hello", "world!"}, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}},
+		{"larger than a read", []string{large, "tail"}, []int{5, eventReadSize, 2 * eventReadSize}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pipeline := new(bodyPipeline)
+			_, client, _ := newEventAgent(t, pipeline.endPoint)
+
+			var stream []byte
+			for _, body := range tt.bodies {
+				stream = appendFrame(t, stream, 2000, []byte(body))
+			}
+
+			// Each part arrives on its own wakeup
+			last := 0
+			for _, cut := range append(tt.cuts, len(stream)) {
+				if _, err := client.Write(stream[last:cut]); err != nil {
+					t.Fatal(err)
+				}
+				last = cut
+				time.Sleep(2 * time.Millisecond)
+			}
+
+			if got := pipeline.wait(t, len(tt.bodies)); !slices.Equal(got, tt.bodies) {
+				t.Fatalf("received %d messages, want %d", len(got), len(tt.bodies))
+			}
+		})
+	}
+}
+
+// A burst larger than a read is drained one read per wakeup, the handle is rearmed each time
+func TestEventBurst(t *testing.T) {
+	pipeline := new(bodyPipeline)
+	_, client, _ := newEventAgent(t, pipeline.endPoint)
+
+	var stream []byte
+	var want []string
+	for i := 0; i < 500; i++ {
+		body := string(bytes.Repeat([]byte{byte('a' + i%26)}, 1+i%200))
+		stream = appendFrame(t, stream, 2000, []byte(body))
+		want = append(want, body)
+	}
+
+	if _, err := client.Write(stream); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := pipeline.wait(t, len(want)); !slices.Equal(got, want) {
+		t.Fatalf("received %d messages, want %d", len(got), len(want))
+	}
+}
+
+func TestEventRearmAfterAgain(t *testing.T) {
+	pipeline := new(bodyPipeline)
+	agent, client, poller := newEventAgent(t, pipeline.endPoint)
+
+	// A wakeup with nothing to read keeps the connection and rearms the handle
+	agent.onReadable(agent.event.handle)
+	if agent.ctx.Err() != nil {
+		t.Fatal("connection closed on EAGAIN")
+	}
+
+	// The poller lock orders the call above before the next event for the race detector
+	poller.Lock()
+	poller.Unlock()
+
+	if _, err := client.Write(appendFrame(t, nil, 2000, []byte("after"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := pipeline.wait(t, 1); !slices.Equal(got, []string{"after"}) {
+		t.Fatalf("received %q", got)
+	}
+}
+
+func TestEventFlush(t *testing.T) {
+	agent, client, _ := newEventAgent(t, nil)
+
+	// Writers racing with the flush goroutine, every frame is sent once
+	const writers, frames = 8, 100
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < frames; j++ {
+				if err := agent.Write(uint32(2000+i), []byte("push")); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(client)
+	counts := make(map[uint32]int)
+	for n := 0; n < writers*frames; n++ {
+		header, _, err := codec.ReadHeader(br, codec.Classic{}, nil)
+		if err != nil {
+			t.Fatalf("frame %d: %v", n, err)
+		}
+
+		if _, err := br.Discard(int(header.Size)); err != nil {
+			t.Fatal(err)
+		}
+		counts[header.MsgID]++
+	}
+	wg.Wait()
+
+	for i := 0; i < writers; i++ {
+		if counts[uint32(2000+i)] != frames {
+			t.Fatalf("msgID %d sent %d times, want %d", 2000+i, counts[uint32(2000+i)], frames)
+		}
+	}
+
+	// The flush goroutine exits once the writer is empty
+	waitFor(t, "flush", func() bool { return !agent.event.flushing.Load() })
+	if agent.w.Len() != 0 {
+		t.Fatalf("%d frames left in the writer", agent.w.Len())
+	}
+}
+
+func TestEventCloseDuringFlush(t *testing.T) {
+	agent, client, _ := newEventAgent(t, nil)
+
+	// The client does not read, the flush blocks once the socket buffers are full
+	body := make([]byte, 256*1024)
+	for i := 0; i < 64; i++ {
+		if err := agent.Write(2000, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if !agent.event.flushing.Load() {
+		t.Fatal("flush not pending")
+	}
+
+	agent.Close()
+	waitFor(t, "close", func() bool { return agent.GetState() == interfaces.StateClosed })
+	waitFor(t, "flush exit", func() bool { return !agent.event.flushing.Load() })
+
+	// The failed flush sticks, later writes are refused
+	if err := agent.Write(2000, []byte("late")); err == nil {
+		t.Fatal("write after close accepted")
+	}
+	if agent.event.flushing.Load() {
+		t.Fatal("flush scheduled after close")
+	}
+
+	// The client gets what was sent, then the end of the connection
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, client); err != nil {
+		t.Fatalf("read after close: %v", err)
+	}
+}
@@ -0,0 +1,64 @@
+package agent
+
+import (
+	"errors"
+	"gateway/pkg/codec"
+)
+
+// Fragmentation: a long message is sent as data frames with the same msgID and tail, every
+// frame but the last one has the continuation flag. Control frames may come between the
+// fragments, other data frames may not. Inbound messages are reassembled up to
+// fragment.max_reassembly bytes per connection
+
+var (
+	ErrBadFragment        = errors.New("bad fragment")
+	ErrReassemblyTooLarge = errors.New("reassembled message too large")
+)
+
+type reassembly struct {
+	header codec.Header // Header of the first fragment
+	body   []byte
+}
+
+// Bodies that do not outlive handleFrame: control frames and fragments copied to the reassembly buffer
+func (agent *Agent) isTransient(header codec.Header) bool {
+	return agent.isControl(header) || header.More || agent.reassembly != nil
+}
+
+// Collect a fragment, returns the whole message once its last fragment arrived
+func (agent *Agent) reassemble(header codec.Header, msgBody []byte) (codec.Header, []byte, bool, error) {
+	limit := agent.GetListenerConfig().Fragment.MaxReassembly
+	if limit == 0 {
+		return header, nil, false, ErrBadFragment
+	}
+
+	r := agent.reassembly
+	if r == nil {
+		r = &reassembly{header: header}
+		agent.reassembly = r
+	} else if header.MsgID != r.header.MsgID || header.Tail != r.header.Tail || header.Compressed != r.header.Compressed {
+		return header, nil, false, ErrBadFragment
+	}
+
+	if len(r.body)+len(msgBody) > limit {
+		return header, nil, false, ErrReassemblyTooLarge
+	}
+
+	// Never grow the buffer past the limit
+	if cap(r.body)-len(r.body) < len(msgBody) {
+		body := make([]byte, len(r.body), min(max(2*cap(r.body), len(r.body)+len(msgBody)), limit))
+		copy(body, r.body)
+		r.body = body
+	}
+	r.body = append(r.body, msgBody...)
+
+	if header.More {
+		return header, nil, false, nil
+	}
+
+	agent.reassembly = nil
+	r.header.More = false
+	r.header.Size = uint32(len(r.body))
+
+	return r.header, r.body, true, nil
+}
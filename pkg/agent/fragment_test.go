@@ -0,0 +1,134 @@
+package agent
+
+import (
+	"bytes"
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"testing"
+)
+
+func TestReassemble(t *testing.T) {
+	type fragment struct {
+		header codec.Header
+		body   string
+	}
+
+	tests := []struct {
+		name      string
+		limit     int
+		fragments []fragment
+		want      string
+		err       error
+	}{
+		{
+			name:  "complete",
+			limit: 64,
+			fragments: []fragment{
+				{codec.Header{MsgID: 1000, Tail: 1, More: true}, "hello "},
+				{codec.Header{MsgID: 1000, Tail: 1}, "world"},
+			},
+			want: "hello world",
+		},
+		{
+			name:  "over limit",
+			limit: 16,
+			fragments: []fragment{
+				{codec.Header{MsgID: 1000, Tail: 1, More: true}, "hello "},
+				{codec.Header{MsgID: 1000, Tail: 1, More: true}, "fragmented "},
+				{codec.Header{MsgID: 1000, Tail: 1}, "x"},
+			},
+			err: ErrReassemblyTooLarge,
+		},
+		{
+			name:  "at limit",
+			limit: 17,
+			fragments: []fragment{
+				{codec.Header{MsgID: 1000, Tail: 1, More: true}, "hello "},
+				{codec.Header{MsgID: 1000, Tail: 1, More: true}, "fragmented "},
+				{codec.Header{MsgID: 1000, Tail: 1}, ""},
+			},
+			want: "hello fragmented ",
+		},
+		{
+			name:  "disabled",
+			limit: 0,
+			fragments: []fragment{
+				{codec.Header{MsgID: 1000, More: true}, "hello"},
+			},
+			err: ErrBadFragment,
+		},
+		{
+			name:  "other msg id",
+			limit: 64,
+			fragments: []fragment{
+				{codec.Header{MsgID: 1000, More: true}, "hello"},
+				{codec.Header{MsgID: 1001}, "world"},
+			},
+			err: ErrBadFragment,
+		},
+		{
+			name:  "other tail",
+			limit: 64,
+			fragments: []fragment{
+				{codec.Header{MsgID: 1000, Tail: 1, More: true}, "hello"},
+				{codec.Header{MsgID: 1000, Tail: 2}, "world"},
+			},
+			err: ErrBadFragment,
+		},
+		{
+			name:  "compression changed",
+			limit: 64,
+			fragments: []fragment{
+				{codec.Header{MsgID: 1000, More: true}, "hello"},
+				{codec.Header{MsgID: 1000, Compressed: true}, "world"},
+			},
+			err: ErrBadFragment,
+		},
+		{
+			name:  "one fragment over the limit",
+			limit: 4,
+			fragments: []fragment{
+				{codec.Header{MsgID: 1000, More: true}, "hello"},
+			},
+			err: ErrReassemblyTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := configs.DefaultListenerConfig()
+			config.Fragment.MaxReassembly = tt.limit
+			agent, _ := newTestAgent(t, config, nil)
+
+			var header codec.Header
+			var body []byte
+			var done bool
+			var err error
+			for i, f := range tt.fragments {
+				if header, body, done, err = agent.reassemble(f.header, []byte(f.body)); err != nil {
+					break
+				}
+
+				if done != (i == len(tt.fragments)-1) {
+					t.Fatalf("fragment %d done %v", i, done)
+				}
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("reassemble() = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+
+			if !bytes.Equal(body, []byte(tt.want)) || header.More || header.Size != uint32(len(tt.want)) || cap(body) > tt.limit {
+				t.Fatalf("reassembled %+v %q (cap %d), want %q", header, body, cap(body), tt.want)
+			}
+
+			if agent.reassembly != nil {
+				t.Fatal("reassembly kept after the last fragment")
+			}
+		})
+	}
+}
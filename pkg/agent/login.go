@@ -0,0 +1,199 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gateway/pkg/auth"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/hot/plugins"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/metric"
+	"gateway/pkg/utils"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Login: with auth.msg_id the first data message must be a login, nothing is forwarded
+// before it succeeds. The gateway answers with auth.msg_id and a 1 byte status: 0 once the
+// connection is authenticated, 1 shortly before it closes the connection. Messages sent
+// behind the login wait for its result, the connection is closed when the identity expires
+
+const (
+	loginAccepted   = 0
+	loginRejected   = 1
+	loginCloseDelay = 1 * time.Second // Lets the rejection reach the client
+
+	LoginAccepted = "accepted"
+	LoginRejected = "rejected"
+	LoginFailed   = "failed"   // The service could not be reached
+	LoginExpired  = "expired"  // Closed when the identity expired
+	LoginMissing  = "missing"  // The first data message was not a login
+	LoginOverflow = "overflow" // Too many messages sent behind the login
+)
+
+var (
+	ErrNotAuthenticated = errors.New("not authenticated")
+	ErrLoginQueueFull   = errors.New("too many messages before the login")
+)
+
+// Messages received while a login is checked, forwarded in order once it succeeded
+type loginQueue struct {
+	sync.Mutex
+	msgs     []interfaces.Msg
+	rejected bool
+}
+
+// The login phase is not over
+func (agent *Agent) loginRequired() bool {
+	return agent.GetListenerConfig().Auth.MsgID != 0 && !agent.established.Load()
+}
+
+func (agent *Agent) GetIdentity() *interfaces.Identity {
+	if agent == nil {
+		return nil
+	}
+
+	return agent.identity.Load()
+}
+
+// Check the first data message, only one login is attempted per connection
+func (agent *Agent) login(header codec.Header, body []byte) error {
+	config := agent.GetListenerConfig().Auth
+	msg := agent.newMsg(header, body)
+	if agent.loginPending.Load() {
+		return agent.queueLogin(msg)
+	}
+
+	if header.MsgID != config.MsgID || !agent.loginPending.CompareAndSwap(false, true) {
+		metric.CountLogin.Add(LoginMissing, 1)
+		return ErrNotAuthenticated
+	}
+
+	if config.Mode == configs.AuthModeJWT {
+		identity, err := auth.VerifyJWT(string(body), agent.listener.GetAuthKey(), time.Now(), time.Duration(config.LeewaySec)*time.Second)
+		return agent.finishLogin(msg, identity, err)
+	}
+
+	// The service may be slow, messages read meanwhile are queued
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				utils.AlertAuto(fmt.Sprintf("agent painc, id: %s ip: %s err: %v stack: %s", agent.GetCID(), agent.Address(), err, string(debug.Stack())))
+				agent.Close()
+			}
+		}()
+
+		identity, err := plugins.Login(agent, msg)
+		if err := agent.finishLogin(msg, identity, err); err != nil {
+			agent.closeWithError("login", err)
+		}
+	}()
+
+	return nil
+}
+
+// Store the identity and answer the client, a failed login closes the connection
+func (agent *Agent) finishLogin(msg interfaces.Msg, identity interfaces.Identity, err error) error {
+	msgID := agent.GetListenerConfig().Auth.MsgID
+	if err != nil {
+		result := LoginRejected
+		if agent.GetListenerConfig().Auth.Mode == configs.AuthModeBackend && !errors.Is(err, plugins.ErrLoginRejected) {
+			result = LoginFailed
+		}
+		metric.CountLogin.Add(result, 1)
+
+		agent.rejectLogin()
+		time.AfterFunc(loginCloseDelay, agent.Close)
+		return agent.send(msgID, []byte{loginRejected}, msg.RequestID)
+	}
+
+	metric.CountLogin.Add(LoginAccepted, 1)
+	agent.setIdentity(&identity)
+	agent.swapState(interfaces.StateHandshaking, interfaces.StateAuthenticated)
+	if err := agent.send(msgID, []byte{loginAccepted}, msg.RequestID); err != nil {
+		return err
+	}
+
+	return agent.drainLogin()
+}
+
+// Queue a message behind a pending login, the read path forwards it once the queue was drained
+func (agent *Agent) queueLogin(msg interfaces.Msg) error {
+	q := &agent.loginQueue
+	q.Lock()
+	if agent.established.Load() {
+		q.Unlock()
+		return agent.forward(msg)
+	}
+
+	if q.rejected {
+		q.Unlock()
+		agent.Drop()
+		return nil
+	}
+
+	if len(q.msgs) >= agent.GetListenerConfig().Auth.MaxQueued {
+		q.Unlock()
+		metric.CountLogin.Add(LoginOverflow, 1)
+		return ErrLoginQueueFull
+	}
+
+	q.msgs = append(q.msgs, msg)
+	q.Unlock()
+
+	return nil
+}
+
+// Forward the queued messages in order, the login phase ends once the queue is empty
+func (agent *Agent) drainLogin() error {
+	q := &agent.loginQueue
+	for {
+		q.Lock()
+		if len(q.msgs) == 0 {
+			q.msgs = nil
+			agent.established.Store(true)
+			q.Unlock()
+
+			return nil
+		}
+
+		msg := q.msgs[0]
+		q.msgs[0] = interfaces.Msg{}
+		q.msgs = q.msgs[1:]
+		q.Unlock()
+
+		if err := agent.forward(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// Drop the queued messages of a failed login
+func (agent *Agent) rejectLogin() {
+	q := &agent.loginQueue
+	q.Lock()
+	defer q.Unlock()
+
+	for range q.msgs {
+		agent.Drop()
+	}
+	q.msgs = nil
+	q.rejected = true
+}
+
+// Store the identity of the connection, it is closed when the identity expires
+func (agent *Agent) setIdentity(identity *interfaces.Identity) {
+	agent.identity.Store(identity)
+	if identity == nil || identity.ExpiresAt == 0 {
+		return
+	}
+
+	timer := time.AfterFunc(time.Until(time.Unix(identity.ExpiresAt, 0)), func() {
+		metric.CountLogin.Add(LoginExpired, 1)
+		agent.Close()
+	})
+	context.AfterFunc(agent.ctx, func() { timer.Stop() })
+}
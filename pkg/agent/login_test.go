@@ -0,0 +1,149 @@
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/metric"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testLoginMsgID = 1000
+
+// Login service answering with code once release is closed
+func newLoginService(t *testing.T, code int, release chan struct{}) string {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		fmt.Fprintf(w, `{"code": %d, "userID": "u1"}`, code)
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+func newBackendLoginConfig(url string) configs.ListenerConfig {
+	config := configs.DefaultListenerConfig()
+	config.Auth.MsgID = testLoginMsgID
+	config.Auth.Mode = configs.AuthModeBackend
+	config.Auth.ServiceAPIURL = url
+	config.Auth.MaxQueued = 2
+	return config
+}
+
+func TestLoginQueue(t *testing.T) {
+	tests := []struct {
+		name    string
+		code    int
+		queued  []uint32
+		want    []uint32
+		wantErr error
+		dropped int64
+	}{
+		{name: "accepted", code: 0, queued: []uint32{2000, 2001}, want: []uint32{2000, 2001, 2002}},
+		{name: "rejected", code: 1, queued: []uint32{2000, 2001}, dropped: 3},
+		{name: "full", code: 0, queued: []uint32{2000, 2001, 2002}, wantErr: ErrLoginQueueFull},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			pipeline := new(testPipeline)
+			agent, _ := newTestAgent(t, newBackendLoginConfig(newLoginService(t, tt.code, release)), pipeline.endPoint)
+
+			if err := agent.handleFrame(codec.Header{MsgID: testLoginMsgID}, nil, []byte("token")); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			for _, id := range tt.queued {
+				if err = agent.handleFrame(codec.Header{MsgID: id}, nil, []byte{1}); err != nil {
+					break
+				}
+			}
+			close(release)
+
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("queue error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if tt.code == 0 {
+				waitFor(t, "login", agent.established.Load)
+			} else {
+				waitFor(t, "rejection", func() bool { return agent.GetTraffic().Dropped == int64(len(tt.queued)) })
+			}
+
+			// Later messages follow the queued ones
+			if err := agent.handleFrame(codec.Header{MsgID: 2002}, nil, []byte{1}); err != nil {
+				t.Fatal(err)
+			}
+
+			if ids := pipeline.ids(); !slices.Equal(ids, tt.want) {
+				t.Fatalf("forwarded %v, want %v", ids, tt.want)
+			}
+
+			if dropped := agent.GetTraffic().Dropped; dropped != tt.dropped {
+				t.Fatalf("dropped %d, want %d", dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+// Client mistakes close the connection and are counted instead of alerted
+func TestLoginMistakes(t *testing.T) {
+	tests := []struct {
+		name   string
+		frames []uint32
+		err    error
+		result string
+	}{
+		{name: "missing", frames: []uint32{2000}, err: ErrNotAuthenticated, result: LoginMissing},
+		{name: "second login", frames: []uint32{testLoginMsgID, testLoginMsgID, testLoginMsgID, testLoginMsgID}, err: ErrLoginQueueFull, result: LoginOverflow},
+		{name: "overflow", frames: []uint32{testLoginMsgID, 2000, 2001, 2002}, err: ErrLoginQueueFull, result: LoginOverflow},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			defer close(release)
+			agent, _ := newTestAgent(t, newBackendLoginConfig(newLoginService(t, 0, release)), nil)
+			before := metric.CountLogin.Out()[tt.result]
+
+			var err error
+			for _, id := range tt.frames {
+				if err = agent.handleFrame(codec.Header{MsgID: id}, nil, []byte("token")); err != nil {
+					break
+				}
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("handleFrame() = %v, want %v", err, tt.err)
+			}
+
+			if got := metric.CountLogin.Out()[tt.result] - before; got != 1 {
+				t.Fatalf("count login %s +%d, want +1", tt.result, got)
+			}
+		})
+	}
+}
+
+func TestIdentityExpiry(t *testing.T) {
+	agent, _ := newTestAgent(t, configs.DefaultListenerConfig(), nil)
+	agent.setIdentity(&interfaces.Identity{UserID: "u1", ExpiresAt: time.Now().Unix() + 1})
+
+	select {
+	case <-agent.ctx.Done():
+	case <-time.After(3 * time.Second):
+		t.Fatal("connection not closed at expiry")
+	}
+}
@@ -0,0 +1,72 @@
+package agent
+
+import (
+	"errors"
+	"gateway/pkg/configs"
+	"gateway/pkg/metric"
+)
+
+// Replay protection: inbound data messages carry a client sequence number in the tail, counted
+// from 1. A sliding window accepts numbers up to window behind the highest one seen, once each
+
+const (
+	ReplayDuplicate = "duplicate"
+	ReplayTooOld    = "too_old"
+	ReplayZero      = "zero"
+)
+
+var ErrReplay = errors.New("replayed message")
+
+type replayWindow struct {
+	highest uint32
+	seen    uint64 // Bit i is set once highest-i was accepted
+	rejects int
+}
+
+// Record seq, returns the reason when it must be rejected
+func (w *replayWindow) check(seq uint32, window int) string {
+	if seq == 0 {
+		return ReplayZero
+	}
+
+	if seq > w.highest {
+		if shift := seq - w.highest; shift < 64 {
+			w.seen = w.seen<<shift | 1
+		} else {
+			w.seen = 1
+		}
+		w.highest = seq
+
+		return ""
+	}
+
+	diff := w.highest - seq
+	if diff >= uint32(window) {
+		return ReplayTooOld
+	}
+
+	if w.seen&(1<<diff) != 0 {
+		return ReplayDuplicate
+	}
+	w.seen |= 1 << diff
+
+	return ""
+}
+
+// Check the sequence number of a data message, false if the message must be dropped
+func (agent *Agent) checkReplay(tail uint32) (bool, error) {
+	config := agent.GetListenerConfig().Replay
+	reason := agent.replay.check(tail, config.Window)
+	if reason == "" {
+		return true, nil
+	}
+
+	metric.CountReplay.Add(reason, 1)
+	agent.replay.rejects++
+	if config.Action == configs.ReplayActionClose || (config.MaxRejects > 0 && agent.replay.rejects >= config.MaxRejects) {
+		return false, ErrReplay
+	}
+
+	agent.Drop()
+	return false, nil
+}
@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"errors"
+	"gateway/pkg/configs"
+	"testing"
+)
+
+func TestReplayWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  int
+		seqs    []uint32
+		reasons []string
+	}{
+		{"in order", 32, []uint32{1, 2, 3, 4}, []string{"", "", "", ""}},
+		{"in window", 32, []uint32{5, 3, 4, 1, 2}, []string{"", "", "", "", ""}},
+		{"zero", 32, []uint32{0, 1}, []string{ReplayZero, ""}},
+		{"duplicate", 32, []uint32{1, 2, 2, 1}, []string{"", "", ReplayDuplicate, ReplayDuplicate}},
+		{"duplicate behind", 32, []uint32{10, 7, 7}, []string{"", "", ReplayDuplicate}},
+		{"window edge", 4, []uint32{10, 7, 6}, []string{"", "", ReplayTooOld}},
+		{"too old", 32, []uint32{40, 8, 9}, []string{"", ReplayTooOld, ""}},
+		{"full window", 64, []uint32{100, 37, 36}, []string{"", "", ReplayTooOld}},
+		{"jump", 32, []uint32{1, 2, 100, 99, 2, 100}, []string{"", "", "", "", ReplayTooOld, ReplayDuplicate}},
+		{"jump past 64", 64, []uint32{1, 70, 6, 7, 69}, []string{"", "", ReplayTooOld, "", ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var w replayWindow
+			for i, seq := range tt.seqs {
+				if reason := w.check(seq, tt.window); reason != tt.reasons[i] {
+					t.Fatalf("check(%d) #%d = %q, want %q", seq, i, reason, tt.reasons[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCheckReplay(t *testing.T) {
+	tests := []struct {
+		name       string
+		action     string
+		maxRejects int
+		seqs       []uint32
+		err        error
+		dropped    int64
+	}{
+		{name: "close", action: configs.ReplayActionClose, seqs: []uint32{1, 1}, err: ErrReplay},
+		{name: "drop", action: configs.ReplayActionDrop, seqs: []uint32{1, 1, 1, 2}, dropped: 2},
+		{name: "drop until max rejects", action: configs.ReplayActionDrop, maxRejects: 2, seqs: []uint32{1, 1, 1}, err: ErrReplay, dropped: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := configs.DefaultListenerConfig()
+			config.Replay = configs.ReplayConfig{Enabled: true, Window: 32, Action: tt.action, MaxRejects: tt.maxRejects}
+			agent, _ := newTestAgent(t, config, nil)
+
+			var err error
+			for _, seq := range tt.seqs {
+				if _, err = agent.checkReplay(seq); err != nil {
+					break
+				}
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("checkReplay() = %v, want %v", err, tt.err)
+			}
+
+			if dropped := agent.GetTraffic().Dropped; dropped != tt.dropped {
+				t.Fatalf("dropped %d, want %d", dropped, tt.dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/secure"
+	"sync"
+	"sync/atomic"
+)
+
+// Secure listeners: the first frame of a connection is the handshake, every body after
+// the handshake reply is sealed in both directions, control frames included
+
+var ErrNotSecured = errors.New("frame before the secure handshake")
+
+type secureState struct {
+	sync.Mutex // Orders sealing with the writer queue, nonces follow the frame order
+
+	rx    *secure.Cipher // Only used by the read path
+	tx    *secure.Cipher
+	ready atomic.Bool
+}
+
+func (agent *Agent) isHandshake(header codec.Header) bool {
+	secureID := agent.GetListenerConfig().Secure.MsgID
+	return secureID != 0 && header.MsgID == secureID
+}
+
+// Bytes added to the bodies of a secure connection
+func (agent *Agent) overhead() uint32 {
+	if agent.secure == nil {
+		return 0
+	}
+
+	return secure.Overhead
+}
+
+// Answer the client hello and switch the connection to sealed bodies
+func (agent *Agent) handshake(body []byte) error {
+	ss := agent.secure
+	if ss.ready.Load() {
+		return secure.ErrBadHandshake
+	}
+
+	reply, rx, tx, err := secure.Accept(agent.listener.GetServerKey(), body)
+	if err != nil {
+		return err
+	}
+
+	// The reply is the last plain frame
+	ss.Lock()
+	err = agent.w.Write(agent.GetListenerConfig().Secure.MsgID, reply, 0)
+	ss.rx, ss.tx = rx, tx
+	ss.ready.Store(true)
+	ss.Unlock()
+
+	if err != nil {
+		return err
+	}
+	agent.notify()
+
+	// The resume token is only sent on a secured connection
+	return agent.sendToken()
+}
+
+// Open a body in place, the raw header is authenticated
+func (agent *Agent) open(rawHeader []byte, msgBody []byte) ([]byte, error) {
+	ss := agent.secure
+	if !ss.ready.Load() {
+		return nil, ErrNotSecured
+	}
+
+	return ss.rx.Open(msgBody[:0], msgBody, rawHeader)
+}
+
+// Queue a frame, sealed once the handshake is done (after compression)
+func (agent *Agent) enqueue(msgID uint32, msg []byte, seqID uint32) error {
+	ss := agent.secure
+	if ss == nil {
+		return agent.w.Write(msgID, msg, seqID)
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	if ss.tx == nil {
+		return agent.w.Write(msgID, msg, seqID)
+	}
+
+	return agent.w.WriteSealed(msgID, msg, seqID, ss.tx)
+}
@@ -0,0 +1,246 @@
+package agent
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/secure"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+const testSecureMsgID = 900
+
+// Agent of a secure listener echoing every message with msgID+1, its read and write loops run
+// like Run and close the connection on error
+func newSecureAgent(t *testing.T) (*Agent, net.Conn, ed25519.PublicKey, <-chan error) {
+	t.Helper()
+
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := configs.DefaultListenerConfig()
+	config.Secure.MsgID = testSecureMsgID
+	echo := func(agent interfaces.Agent, msg interfaces.Msg) error {
+		return agent.Write(msg.ID+1, msg.Body)
+	}
+
+	agent, client := newTestAgent(t, config, echo)
+	agent.listener.(*testListener).serverKey = key
+
+	readErr := make(chan error, 1)
+	go func() {
+		defer agent.conn.Close()
+		defer agent.cancel()
+
+		readErr <- agent.loopRead()
+	}()
+	go agent.loopWrite()
+
+	return agent, client, public, readErr
+}
+
+func TestSecureRoundTrip(t *testing.T) {
+	_, conn, public, _ := newSecureAgent(t)
+	client, err := secure.NewClient(conn, codec.Classic{}, testSecureMsgID, public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{"first", "", "third"} {
+		if err := client.WriteFrame(2000, []byte(body), 0); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		msgID, got, _, err := client.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msgID != 2001 || string(got) != body {
+			t.Fatalf("echo %d %q, want 2001 %q", msgID, got, body)
+		}
+	}
+}
+
+func TestSecureReject(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake bool
+		send      func(t *testing.T, client *secureClient)
+		err       error
+	}{
+		{
+			name: "plain frame",
+			send: func(t *testing.T, client *secureClient) {
+				client.writeRaw(t, 2000, []byte("plain"))
+			},
+			err: ErrNotSecured,
+		},
+		{
+			name: "short hello",
+			send: func(t *testing.T, client *secureClient) {
+				client.writeRaw(t, testSecureMsgID, make([]byte, secure.HelloSize-1))
+			},
+			err: secure.ErrBadHandshake,
+		},
+		{
+			name:      "tampered frame",
+			handshake: true,
+			send: func(t *testing.T, client *secureClient) {
+				frame := client.seal(t, 2000, []byte("body"))
+				frame[len(frame)-1] ^= 1
+				client.write(t, frame)
+			},
+			err: secure.ErrBadFrame,
+		},
+		{
+			name:      "tampered header",
+			handshake: true,
+			send: func(t *testing.T, client *secureClient) {
+				frame := client.seal(t, 2000, []byte("body"))
+				frame[0] ^= 1 // msgID 2000 becomes 2001
+				client.write(t, frame)
+			},
+			err: secure.ErrBadFrame,
+		},
+		{
+			name:      "out of order",
+			handshake: true,
+			send: func(t *testing.T, client *secureClient) {
+				first := client.seal(t, 2000, []byte("first"))
+				second := client.seal(t, 2000, []byte("second"))
+				client.write(t, append(second, first...))
+			},
+			err: secure.ErrBadFrame,
+		},
+		{
+			name:      "replayed frame",
+			handshake: true,
+			send: func(t *testing.T, client *secureClient) {
+				frame := client.seal(t, 2000, []byte("first"))
+				client.write(t, append(frame, frame...))
+			},
+			err: secure.ErrBadFrame,
+		},
+		{
+			name:      "second handshake",
+			handshake: true,
+			send: func(t *testing.T, client *secureClient) {
+				_, hello, err := secure.Hello()
+				if err != nil {
+					t.Fatal(err)
+				}
+				client.writeRaw(t, testSecureMsgID, hello)
+			},
+			err: secure.ErrBadHandshake,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, conn, public, readErr := newSecureAgent(t)
+			client := &secureClient{conn: conn}
+			if tt.handshake {
+				client.handshake(t, public)
+			}
+
+			// Frames sent by the gateway are read until it closes the connection
+			closed := make(chan struct{})
+			go func() {
+				io.Copy(io.Discard, conn)
+				close(closed)
+			}()
+
+			tt.send(t, client)
+
+			select {
+			case err := <-readErr:
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("read loop exit %v, want %v", err, tt.err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("frame not rejected")
+			}
+
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				t.Fatal("connection not closed")
+			}
+		})
+	}
+}
+
+// Client writing its own frames, to send them tampered or out of order
+type secureClient struct {
+	conn net.Conn
+	tx   *secure.Cipher
+}
+
+func (client *secureClient) handshake(t *testing.T, public ed25519.PublicKey) {
+	t.Helper()
+
+	priv, hello, err := secure.Hello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.writeRaw(t, testSecureMsgID, hello)
+
+	// Nothing but the reply is sent before the handshake completes
+	client.conn.SetReadDeadline(time.Now().Add(time.Second))
+	br := bufio.NewReader(client.conn)
+	header, _, err := codec.ReadHeader(br, codec.Classic{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reply := make([]byte, header.Size)
+	if _, err := io.ReadFull(br, reply); err != nil {
+		t.Fatal(err)
+	}
+	client.conn.SetReadDeadline(time.Time{})
+
+	if _, client.tx, err = secure.Finish(priv, reply, public); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Sealed frame, the next nonce is used
+func (client *secureClient) seal(t *testing.T, msgID uint32, body []byte) []byte {
+	t.Helper()
+
+	frame, err := codec.Classic{}.Append(nil, codec.Header{MsgID: msgID, Size: uint32(len(body) + secure.Overhead)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client.tx.Seal(frame, body, frame)
+}
+
+func (client *secureClient) writeRaw(t *testing.T, msgID uint32, body []byte) {
+	t.Helper()
+
+	frame, err := codec.Classic{}.Append(nil, codec.Header{MsgID: msgID, Size: uint32(len(body))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.write(t, append(frame, body...))
+}
+
+func (client *secureClient) write(t *testing.T, frames []byte) {
+	t.Helper()
+
+	if _, err := client.conn.Write(frames); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,365 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/hot/plugins"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/metric"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Session resume: on connect the gateway sends a token frame, a client reconnecting within the
+// window sends a resume frame (last received data frame ordinal + token) as its first frame.
+// The new connection takes over the connID and attributes of the session and the data frames
+// the client missed are replayed. The reply is always a token frame, the client compares it
+// with the token it presented to know whether the session was resumed.
+//
+// With sequence numbers the ordinal of a data frame is carried in its header, clients may
+// acknowledge them and in reliable mode the frames are kept until they are acknowledged.
+
+const (
+	maxResumeSize  = 256
+	resumeSeqLen   = 4
+	ackSize        = 4
+	resumeTokenLen = 16 // Random bytes of a token
+
+	SessionDetached = "detached"
+	SessionResumed  = "resumed"
+	SessionRejected = "rejected"
+	SessionExpired  = "expired"
+	SessionBroken   = "broken"
+)
+
+var (
+	ErrBadResume      = errors.New("bad resume request")
+	ErrBadAck         = errors.New("bad ack")
+	ErrTooManyUnacked = errors.New("too many unacknowledged frames")
+)
+
+type replayFrame struct {
+	seq       uint32
+	requestID uint32
+	msgID     uint32
+	body      []byte
+}
+
+type session struct {
+	sync.Mutex
+
+	cid      string
+	token    string
+	owner    *Agent        // Agent attached to the session, nil once the session ended
+	seq      uint32        // Ordinal of the last data frame, control frames are not counted
+	acked    uint32        // Last acknowledged ordinal
+	frames   []replayFrame // Last data frames, or the unacknowledged ones in reliable mode, oldest first
+	detached bool          // Connection lost, waiting for a resume
+	broken   bool          // Unacknowledged frames were lost, the session can not be resumed
+	timer    *time.Timer
+}
+
+func newSession(cid string, owner *Agent) *session {
+	secret := make([]byte, resumeTokenLen)
+	rand.Read(secret)
+
+	return &session{
+		cid:   cid,
+		token: cid + "." + hex.EncodeToString(secret),
+		owner: owner,
+	}
+}
+
+// Count a data frame, keep it for replay and send it if a connection is attached
+func (s *session) write(msgID uint32, msg []byte, requestID uint32) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.owner == nil || s.broken {
+		return ErrIsClosed
+	}
+
+	config := s.owner.GetListenerConfig()
+	switch {
+	case config.Sequence.Reliable:
+		// Never drop an unacknowledged frame, the session ends instead
+		if len(s.frames) >= config.Sequence.MaxUnacked {
+			s.broken = true
+			if s.detached {
+				s.timer.Reset(0)
+			} else {
+				s.owner.Close()
+			}
+
+			return ErrTooManyUnacked
+		}
+		s.seq++
+		s.frames = append(s.frames, replayFrame{seq: s.seq, requestID: requestID, msgID: msgID, body: bytes.Clone(msg)})
+	case config.Resume.MsgID != 0 && config.Resume.MaxFrames > 0:
+		s.seq++
+		if len(s.frames) >= config.Resume.MaxFrames {
+			s.trim(s.frames[0].seq)
+		}
+		s.frames = append(s.frames, replayFrame{seq: s.seq, requestID: requestID, msgID: msgID, body: bytes.Clone(msg)})
+	default:
+		s.seq++
+	}
+
+	if s.detached {
+		return nil
+	}
+
+	return s.owner.sendData(msgID, msg, s.seq, requestID)
+}
+
+// Acknowledge every data frame up to seq
+func (s *session) ack(seq uint32, reliable bool) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if seq > s.seq {
+		return ErrBadAck
+	}
+
+	if seq <= s.acked {
+		return nil
+	}
+
+	s.acked = seq
+	if reliable {
+		s.trim(seq)
+	}
+
+	return nil
+}
+
+// Drop the kept frames up to seq
+func (s *session) trim(seq uint32) {
+	i := 0
+	for i < len(s.frames) && s.frames[i].seq <= seq {
+		s.frames[i] = replayFrame{}
+		i++
+	}
+
+	s.frames = s.frames[i:]
+}
+
+// Frames after lastSeq, false if some of them are no longer kept
+func (s *session) missed(lastSeq uint32) ([]replayFrame, bool) {
+	if lastSeq > s.seq {
+		return nil, false
+	}
+
+	n := int(s.seq - lastSeq)
+	if n > len(s.frames) {
+		return nil, false
+	}
+
+	return s.frames[len(s.frames)-n:], true
+}
+
+func (agent *Agent) isResume(header codec.Header) bool {
+	resumeID := agent.GetListenerConfig().Resume.MsgID
+	return resumeID != 0 && header.MsgID == resumeID
+}
+
+func (agent *Agent) isAck(header codec.Header) bool {
+	ackID := agent.GetListenerConfig().Sequence.AckMsgID
+	return ackID != 0 && header.MsgID == ackID
+}
+
+// Data frames carry their ordinal in the header when sequence numbers are enabled,
+// otherwise the request ID they answer (correlation mode)
+func (agent *Agent) sendData(msgID uint32, msg []byte, seq uint32, requestID uint32) error {
+	if agent.GetListenerConfig().Sequence.Enabled {
+		return agent.send(msgID, msg, seq)
+	}
+
+	return agent.send(msgID, msg, requestID)
+}
+
+// Handle a client acknowledgement, the body is the last received ordinal
+func (agent *Agent) ack(body []byte) error {
+	if len(body) != ackSize {
+		return ErrBadAck
+	}
+
+	s := agent.session.Load()
+	if s == nil {
+		return nil
+	}
+
+	return s.ack(binary.LittleEndian.Uint32(body), agent.GetListenerConfig().Sequence.Reliable)
+}
+
+// Send the token of the session attached to the connection
+func (agent *Agent) sendToken() error {
+	s := agent.session.Load()
+	resumeID := agent.GetListenerConfig().Resume.MsgID
+	if s == nil || resumeID == 0 {
+		return nil
+	}
+
+	// Sent after the handshake on a secure connection
+	if agent.secure != nil && !agent.secure.ready.Load() {
+		return nil
+	}
+
+	return agent.send(resumeID, []byte(s.token), 0)
+}
+
+// Keep the session after the connection is lost, returns false if it ends with the connection
+func (agent *Agent) detach() bool {
+	s := agent.session.Load()
+	if s == nil {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	// Taken over by a resumed connection
+	if s.owner != agent {
+		return true
+	}
+
+	// Resume disabled, kicked, never used or unacknowledged frames lost
+	if agent.GetListenerConfig().Resume.MsgID == 0 || agent.isDisabled() || !agent.established.Load() || s.broken {
+		s.owner = nil
+		return false
+	}
+
+	s.detached = true
+	s.timer = time.AfterFunc(time.Duration(agent.GetListenerConfig().Resume.WindowSec)*time.Second, agent.expire)
+	metric.CountSession.Add(SessionDetached, 1)
+
+	return true
+}
+
+// The resume window is over, end the session as a disconnect
+func (agent *Agent) expire() {
+	s := agent.session.Load()
+
+	s.Lock()
+	if s.owner != agent || !s.detached {
+		s.Unlock()
+		return
+	}
+	s.owner = nil
+	s.detached = false
+	s.frames = nil
+	s.Unlock()
+
+	if s.broken {
+		metric.CountSession.Add(SessionBroken, 1)
+	}
+
+	metric.CountSession.Add(SessionExpired, 1)
+	agent.gateway.RemoveAgent(s.cid)
+	agent.notifyDisconnect()
+}
+
+// Handle a resume request, only accepted as the first frame of a connection
+func (agent *Agent) resume(body []byte) error {
+	if len(body) <= resumeSeqLen {
+		return ErrBadResume
+	}
+
+	lastSeq := binary.LittleEndian.Uint32(body[:resumeSeqLen])
+	token := string(body[resumeSeqLen:])
+
+	if agent.established.Load() || !agent.takeOver(token, lastSeq) {
+		metric.CountSession.Add(SessionRejected, 1)
+		return agent.sendToken()
+	}
+
+	metric.CountSession.Add(SessionResumed, 1)
+	agent.established.Store(true)
+	agent.swapState(interfaces.StateHandshaking, interfaces.StateAuthenticated)
+
+	// Resume notification instead of a disconnect and a new connection
+	plugins.ForwadHttp(agent, interfaces.Msg{ID: agent.GetListenerConfig().Resume.NotifyMsgID})
+
+	return nil
+}
+
+// Attach the session of token to this connection and replay the frames after lastSeq
+func (agent *Agent) takeOver(token string, lastSeq uint32) bool {
+	i := strings.LastIndexByte(token, '.')
+	if i <= 0 {
+		return false
+	}
+
+	cid := token[:i]
+	old, ok := agent.gateway.GetAgent(cid).(*Agent)
+	if !ok || old == agent || old.GetListenerConfig().Name != agent.GetListenerConfig().Name {
+		return false
+	}
+
+	s := old.session.Load()
+	if s == nil {
+		return false
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.owner != old || s.broken || old.isDisabled() || subtle.ConstantTimeCompare([]byte(s.token), []byte(token)) != 1 {
+		return false
+	}
+
+	frames, ok := s.missed(lastSeq)
+	if !ok {
+		return false
+	}
+
+	// The client received everything up to lastSeq
+	if lastSeq > s.acked {
+		s.acked = lastSeq
+	}
+
+	if !agent.gateway.ReplaceAgent(cid, old, agent) {
+		return false
+	}
+
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	connected := !s.detached
+	s.detached = false
+	s.owner = agent
+
+	// The identity and the attributes set by the middlewares belong to the session
+	agent.setIdentity(old.identity.Load())
+	old.storage.Range(func(key, value any) bool {
+		agent.storage.Store(key, value)
+		return true
+	})
+
+	agent.gateway.RemoveAgent(agent.cid)
+	agent.session.Store(s)
+
+	// Token first, then the missed frames, later writes queue behind them under the session lock
+	agent.send(agent.GetListenerConfig().Resume.MsgID, []byte(s.token), 0)
+	for _, frame := range frames {
+		agent.sendData(frame.msgID, frame.body, frame.seq, frame.requestID)
+	}
+
+	if agent.GetListenerConfig().Sequence.Reliable {
+		s.trim(lastSeq)
+	}
+
+	// The old connection is still open (the client noticed the loss first), its finalizer
+	// sees the new owner and leaves the session alone
+	if connected {
+		old.Close()
+	}
+
+	return true
+}
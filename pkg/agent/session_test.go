@@ -0,0 +1,120 @@
+package agent
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+// Session that sent seq frames and kept the ones from first on
+func newTestSession(seq uint32, first uint32) *session {
+	s := &session{seq: seq}
+	for i := first; i <= seq; i++ {
+		s.frames = append(s.frames, replayFrame{seq: i, msgID: 1000})
+	}
+
+	return s
+}
+
+func seqs(frames []replayFrame) []uint32 {
+	seqs := make([]uint32, 0, len(frames))
+	for _, frame := range frames {
+		seqs = append(seqs, frame.seq)
+	}
+
+	return seqs
+}
+
+func TestSessionMissed(t *testing.T) {
+	tests := []struct {
+		name    string
+		seq     uint32
+		first   uint32
+		lastSeq uint32
+		want    []uint32
+		ok      bool
+	}{
+		{"up to date", 5, 1, 5, []uint32{}, true},
+		{"all kept", 5, 1, 0, []uint32{1, 2, 3, 4, 5}, true},
+		{"some", 5, 1, 3, []uint32{4, 5}, true},
+		{"oldest kept", 10, 6, 5, []uint32{6, 7, 8, 9, 10}, true},
+		{"lost", 10, 6, 4, nil, false},
+		{"ahead", 5, 1, 6, nil, false},
+		{"nothing sent", 0, 1, 0, []uint32{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, ok := newTestSession(tt.seq, tt.first).missed(tt.lastSeq)
+			if ok != tt.ok || (ok && !slices.Equal(seqs(frames), tt.want)) {
+				t.Fatalf("missed(%d) = %v, %v, want %v, %v", tt.lastSeq, seqs(frames), ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestSessionTrim(t *testing.T) {
+	tests := []struct {
+		name  string
+		first uint32
+		trim  uint32
+		want  []uint32
+	}{
+		{"nothing", 1, 0, []uint32{1, 2, 3, 4, 5}},
+		{"some", 1, 2, []uint32{3, 4, 5}},
+		{"all", 1, 5, []uint32{}},
+		{"before the oldest", 3, 2, []uint32{3, 4, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(5, tt.first)
+			kept := s.frames
+			s.trim(tt.trim)
+
+			if got := seqs(s.frames); !slices.Equal(got, tt.want) {
+				t.Fatalf("trim(%d) kept %v, want %v", tt.trim, got, tt.want)
+			}
+
+			// Trimmed bodies are released
+			for _, frame := range kept[:len(kept)-len(s.frames)] {
+				if frame.body != nil || frame.seq != 0 {
+					t.Fatalf("trimmed frame %d still referenced", frame.seq)
+				}
+			}
+		})
+	}
+}
+
+func TestSessionAck(t *testing.T) {
+	tests := []struct {
+		name     string
+		acks     []uint32
+		reliable bool
+		err      error
+		acked    uint32
+		kept     []uint32
+	}{
+		{name: "kept for replay", acks: []uint32{3}, acked: 3, kept: []uint32{1, 2, 3, 4, 5}},
+		{name: "reliable", acks: []uint32{3}, reliable: true, acked: 3, kept: []uint32{4, 5}},
+		{name: "older ack", acks: []uint32{4, 2}, reliable: true, acked: 4, kept: []uint32{5}},
+		{name: "ahead", acks: []uint32{6}, err: ErrBadAck, kept: []uint32{1, 2, 3, 4, 5}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestSession(5, 1)
+
+			var err error
+			for _, seq := range tt.acks {
+				if err = s.ack(seq, tt.reliable); err != nil {
+					break
+				}
+			}
+
+			if !errors.Is(err, tt.err) || s.acked != tt.acked || !slices.Equal(seqs(s.frames), tt.kept) {
+				t.Fatalf("acked %d kept %v err %v, want %d %v %v", s.acked, seqs(s.frames), err, tt.acked, tt.kept, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"gateway/pkg/limiter"
+	"time"
+)
+
+// Outbound shaping: every flush takes its size from a token bucket and waits for the debt
+// before writing, a batch larger than the burst goes out once the rate allows it
+
+func newShaper(rate int, burst int) *limiter.Bucket {
+	if rate <= 0 {
+		return nil
+	}
+
+	if burst <= 0 {
+		burst = rate
+	}
+
+	return limiter.NewBucket(float64(rate), burst)
+}
+
+// Override the outbound rate of the connection in bytes per second, 0 disables shaping
+func (agent *Agent) SetBandwidth(rate int, burst int) {
+	if agent == nil {
+		return
+	}
+
+	agent.shaper.Store(newShaper(rate, burst))
+}
+
+// Wait until n more bytes may be sent, false if the connection was closed meanwhile
+func (agent *Agent) shape(n int) bool {
+	wait := agent.shaper.Load().Take(n)
+	if wait <= 0 {
+		return true
+	}
+
+	t := time.NewTimer(wait)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-agent.ctx.Done():
+		return false
+	}
+}
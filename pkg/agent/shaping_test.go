@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"errors"
+	"gateway/pkg/configs"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestShaping(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    int
+		burst   int
+		flushes []int           // Bytes of the bodies flushed in a row, 10 byte headers added
+		delays  []time.Duration // Minimum time taken by each flush
+	}{
+		{"off", 0, 0, []int{990, 990}, []time.Duration{0, 0}},
+		{"within burst", 10000, 2000, []int{990, 990}, []time.Duration{0, 0}},
+		{"burst defaults to rate", 10000, 0, []int{4990, 4990, 990}, []time.Duration{0, 0, 100 * time.Millisecond}},
+		{"over burst", 10000, 1000, []int{990, 990}, []time.Duration{0, 100 * time.Millisecond}},
+		{"batch over burst", 10000, 1000, []int{2990}, []time.Duration{200 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, client := newTestAgent(t, configs.DefaultListenerConfig(), nil)
+			agent.SetBandwidth(tt.rate, tt.burst)
+			go io.Copy(io.Discard, client)
+
+			for i, size := range tt.flushes {
+				if err := agent.Write(2000, make([]byte, size)); err != nil {
+					t.Fatal(err)
+				}
+
+				start := time.Now()
+				if err := agent.flush(); err != nil {
+					t.Fatal(err)
+				}
+
+				// Other flushes are not delayed, allow a little for the pipe
+				elapsed := time.Since(start)
+				if elapsed < tt.delays[i]-5*time.Millisecond || tt.delays[i] == 0 && elapsed > 50*time.Millisecond {
+					t.Fatalf("flush %d took %v, want %v", i, elapsed, tt.delays[i])
+				}
+			}
+
+			var want int64
+			for _, size := range tt.flushes {
+				want += int64(size + 10)
+			}
+
+			if sent := agent.GetTraffic().BytesOut; sent != want {
+				t.Fatalf("sent %d bytes, want %d", sent, want)
+			}
+		})
+	}
+}
+
+// A close while a flush waits for the shaper ends the flush, nothing is written
+func TestShapingClose(t *testing.T) {
+	agent, client := newTestAgent(t, configs.DefaultListenerConfig(), nil)
+	agent.SetBandwidth(1000, 1000)
+	go io.Copy(io.Discard, client)
+
+	if err := agent.Write(2000, make([]byte, 2990)); err != nil {
+		t.Fatal(err)
+	}
+
+	time.AfterFunc(50*time.Millisecond, agent.Close)
+	start := time.Now()
+	if err := agent.flush(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("flush() = %v, want %v", err, net.ErrClosed)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("flush waited %v for a closed connection", elapsed)
+	}
+
+	if sent := agent.GetTraffic().BytesOut; sent != 0 {
+		t.Fatalf("sent %d bytes", sent)
+	}
+
+	// Turning shaping off lets the next flushes through
+	agent.SetBandwidth(0, 0)
+	if agent.shaper.Load() != nil {
+		t.Fatal("shaper kept")
+	}
+}
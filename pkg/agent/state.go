@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"gateway/pkg/hot/hooks"
+	"gateway/pkg/interfaces"
+)
+
+// State machine: accepted -> handshaking -> authenticated, disabled while kicked, then
+// closing -> closed. The state word also remembers that a closing connection was kicked
+
+const (
+	stateMask   = 0xff
+	stateKicked = 1 << 8 // Closed while disabled
+)
+
+// Allowed transitions, by current state
+var transitions = [...][]interfaces.State{
+	interfaces.StateAccepted:      {interfaces.StateHandshaking, interfaces.StateDisabled, interfaces.StateClosing},
+	interfaces.StateHandshaking:   {interfaces.StateAuthenticated, interfaces.StateDisabled, interfaces.StateClosing},
+	interfaces.StateAuthenticated: {interfaces.StateDisabled, interfaces.StateClosing},
+	interfaces.StateDisabled:      {interfaces.StateHandshaking, interfaces.StateAuthenticated, interfaces.StateClosing},
+	interfaces.StateClosing:       {interfaces.StateClosed},
+	interfaces.StateClosed:        nil,
+}
+
+func canTransition(from interfaces.State, to interfaces.State) bool {
+	for _, state := range transitions[from] {
+		if state == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (agent *Agent) GetState() interfaces.State {
+	if agent == nil {
+		return interfaces.StateClosed
+	}
+
+	return interfaces.State(agent.state.Load() & stateMask)
+}
+
+// Kicked, or closed while kicked
+func (agent *Agent) isDisabled() bool {
+	word := agent.state.Load()
+	return interfaces.State(word&stateMask) == interfaces.StateDisabled || word&stateKicked != 0
+}
+
+// Move to state to if the current state allows it
+func (agent *Agent) setState(to interfaces.State) bool {
+	for {
+		word := agent.state.Load()
+		if !canTransition(interfaces.State(word&stateMask), to) {
+			return false
+		}
+
+		// Retry from the new state if another goroutine moved first
+		if agent.transition(word, to) {
+			return true
+		}
+	}
+}
+
+// Move from state from to state to, false if the agent is in another state
+func (agent *Agent) swapState(from interfaces.State, to interfaces.State) bool {
+	word := agent.state.Load()
+	if interfaces.State(word&stateMask) != from {
+		return false
+	}
+
+	return agent.transition(word, to)
+}
+
+func (agent *Agent) transition(word int32, to interfaces.State) bool {
+	from := interfaces.State(word & stateMask)
+	if !canTransition(from, to) {
+		return false
+	}
+
+	next := int32(to) | word&stateKicked
+	if from == interfaces.StateDisabled && to == interfaces.StateClosing {
+		next |= stateKicked
+	}
+
+	if !agent.state.CompareAndSwap(word, next) {
+		return false
+	}
+
+	hooks.StateChange(agent, from, to)
+	return true
+}
+
+// The agent starts reading, a kicked agent stays disabled
+func (agent *Agent) start() {
+	agent.swapState(interfaces.StateAccepted, interfaces.StateHandshaking)
+	hooks.Connect(agent)
+	agent.sendToken()
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"gateway/pkg/interfaces"
+	"sync"
+	"testing"
+)
+
+func TestStateTransitions(t *testing.T) {
+	const (
+		accepted      = interfaces.StateAccepted
+		handshaking   = interfaces.StateHandshaking
+		authenticated = interfaces.StateAuthenticated
+		disabled      = interfaces.StateDisabled
+		closing       = interfaces.StateClosing
+		closed        = interfaces.StateClosed
+	)
+
+	type step struct {
+		from interfaces.State // State expected by swapState, setState is used unless swap is set
+		to   interfaces.State
+		swap bool
+		ok   bool
+	}
+
+	tests := []struct {
+		name     string
+		steps    []step
+		state    interfaces.State
+		disabled bool
+	}{
+		{"lifecycle", []step{{to: handshaking, ok: true}, {to: authenticated, ok: true}, {to: closing, ok: true}, {to: closed, ok: true}}, closed, false},
+		{"skip handshake", []step{{to: authenticated}}, accepted, false},
+		{"back to handshaking", []step{{to: handshaking, ok: true}, {to: authenticated, ok: true}, {to: handshaking}}, authenticated, false},
+		{"closed is final", []step{{to: closing, ok: true}, {to: closed, ok: true}, {to: handshaking}, {to: closing}}, closed, false},
+		{"closing only closes", []step{{to: closing, ok: true}, {to: disabled}, {to: authenticated}}, closing, false},
+		{"kicked", []step{{to: handshaking, ok: true}, {to: disabled, ok: true}}, disabled, true},
+		{"enabled", []step{{to: disabled, ok: true}, {from: disabled, to: handshaking, swap: true, ok: true}}, handshaking, false},
+		{"closed while kicked", []step{{to: disabled, ok: true}, {to: closing, ok: true}, {to: closed, ok: true}}, closed, true},
+		{"swap from another state", []step{{from: handshaking, to: authenticated, swap: true}}, accepted, false},
+		{"swap not allowed", []step{{from: accepted, to: authenticated, swap: true}}, accepted, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := new(Agent)
+			for i, s := range tt.steps {
+				var ok bool
+				if s.swap {
+					ok = agent.swapState(s.from, s.to)
+				} else {
+					ok = agent.setState(s.to)
+				}
+
+				if ok != s.ok {
+					t.Fatalf("step %d to %s = %v, want %v", i, s.to, ok, s.ok)
+				}
+			}
+
+			if state := agent.GetState(); state != tt.state || agent.isDisabled() != tt.disabled {
+				t.Fatalf("state %s disabled %v, want %s %v", state, agent.isDisabled(), tt.state, tt.disabled)
+			}
+		})
+	}
+}
+
+// One of the racing transitions wins, the others see the new state
+func TestStateRace(t *testing.T) {
+	agent := new(Agent)
+	agent.setState(interfaces.StateHandshaking)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if agent.swapState(interfaces.StateHandshaking, interfaces.StateAuthenticated) {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if won != 1 || agent.GetState() != interfaces.StateAuthenticated {
+		t.Fatalf("%d transitions won, state %s", won, agent.GetState())
+	}
+}
@@ -0,0 +1,222 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gateway/pkg/bufpool"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/utils"
+	"math"
+	"runtime/debug"
+	"slices"
+	"sync"
+)
+
+// Streams: msgID ranges split a connection into logical streams. Outbound data frames wait in
+// the queue of their stream and are moved to the writer round-robin when it flushes, a stream
+// with a window only sends while the client grants credit. Inbound messages of a stream are
+// handed to the pipeline in order by a worker of that stream
+
+const (
+	streamBatchSize  = 64 * 1024 // Writer backlog filled by one pump
+	windowUpdateSize = 6         // Stream ID uint16, increment uint32
+	maxStreamCredit  = math.MaxInt32
+)
+
+var (
+	ErrStreamFull      = errors.New("stream queue is full")
+	ErrBadWindowUpdate = errors.New("bad window update")
+)
+
+type streamFrame struct {
+	msgID uint32
+	tail  uint32
+	buf   *[]byte
+}
+
+type stream struct {
+	config configs.StreamConfig
+	queue  []streamFrame
+	queued int                 // Bytes waiting in queue
+	credit int                 // Bytes the stream may still send, only with a window
+	inbox  chan interfaces.Msg // Created with the worker of the stream
+}
+
+type streams struct {
+	sync.Mutex
+	list []*stream // Configured streams, the default stream last
+	next int       // Round-robin cursor
+}
+
+func newStreams(config configs.StreamsConfig) *streams {
+	ss := new(streams)
+	for _, sc := range append(slices.Clone(config.List), configs.DefaultStreamConfig()) {
+		ss.list = append(ss.list, &stream{config: sc, credit: sc.Window})
+	}
+
+	return ss
+}
+
+// Stream of a msgID, the default stream when it is out of every range
+func (ss *streams) get(msgID uint32) *stream {
+	last := len(ss.list) - 1
+	for _, s := range ss.list[:last] {
+		if msgID >= s.config.MinMsgID && msgID <= s.config.MaxMsgID {
+			return s
+		}
+	}
+
+	return ss.list[last]
+}
+
+func (s *stream) ready() bool {
+	return len(s.queue) > 0 && (s.config.Window == 0 || s.credit > 0)
+}
+
+// Frames left that the writer may take
+func (ss *streams) ready() bool {
+	if ss == nil {
+		return false
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	return slices.ContainsFunc(ss.list, (*stream).ready)
+}
+
+func (agent *Agent) isWindowUpdate(header codec.Header) bool {
+	windowID := agent.GetListenerConfig().Streams.WindowMsgID
+	return windowID != 0 && header.MsgID == windowID
+}
+
+// Queue a data frame in its stream and wake up the writer
+func (agent *Agent) pushStream(msgID uint32, msg []byte, tail uint32) error {
+	ss := agent.streams
+	ss.Lock()
+	s := ss.get(msgID)
+	if s.queued+len(msg) > s.config.MaxQueued {
+		ss.Unlock()
+		return ErrStreamFull
+	}
+
+	buf := bufpool.Get(len(msg))
+	copy(*buf, msg)
+	s.queue = append(s.queue, streamFrame{msgID: msgID, tail: tail, buf: buf})
+	s.queued += len(msg)
+	ss.Unlock()
+
+	agent.notify()
+	return nil
+}
+
+// Move ready frames to the writer, one frame per stream and round, until the writer holds a
+// batch. Frames are sealed here, in the order they are sent
+func (agent *Agent) pump() error {
+	ss := agent.streams
+	if ss == nil {
+		return nil
+	}
+
+	ss.Lock()
+	defer ss.Unlock()
+
+	for agent.w.Len() < streamBatchSize {
+		moved := false
+		for i := range ss.list {
+			s := ss.list[(ss.next+i)%len(ss.list)]
+			if !s.ready() {
+				continue
+			}
+
+			frame := s.queue[0]
+			s.queue = slices.Delete(s.queue, 0, 1)
+			s.queued -= len(*frame.buf)
+			s.credit -= len(*frame.buf)
+
+			err := agent.enqueue(frame.msgID, *frame.buf, frame.tail)
+			bufpool.Put(frame.buf)
+			if err != nil {
+				return err
+			}
+			moved = true
+		}
+		ss.next = (ss.next + 1) % len(ss.list)
+
+		if !moved {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Grant credit to a stream, the body is the stream ID (uint16) and the increment (uint32)
+func (agent *Agent) windowUpdate(body []byte) error {
+	ss := agent.streams
+	if len(body) != windowUpdateSize || ss == nil {
+		return ErrBadWindowUpdate
+	}
+
+	id := binary.LittleEndian.Uint16(body)
+	increment := int64(binary.LittleEndian.Uint32(body[2:]))
+
+	ss.Lock()
+	i := slices.IndexFunc(ss.list[:len(ss.list)-1], func(s *stream) bool { return s.config.ID == id })
+	if i < 0 {
+		ss.Unlock()
+		return ErrBadWindowUpdate
+	}
+
+	s := ss.list[i]
+	s.credit = int(min(int64(s.credit)+increment, maxStreamCredit))
+	ss.Unlock()
+
+	agent.notify()
+	return nil
+}
+
+// Hand a message to the worker of its stream, a worker that fell behind closes the connection
+func (agent *Agent) dispatchStream(msg interfaces.Msg) error {
+	ss := agent.streams
+	ss.Lock()
+	s := ss.get(msg.ID)
+	if s.inbox == nil {
+		s.inbox = make(chan interfaces.Msg, s.config.MaxPending)
+		go agent.loopStream(s.inbox)
+	}
+	inbox := s.inbox
+	ss.Unlock()
+
+	select {
+	case inbox <- msg:
+		return nil
+	default:
+		return ErrStreamFull
+	}
+}
+
+// Run the pipeline for the messages of one stream, in order
+func (agent *Agent) loopStream(inbox chan interfaces.Msg) {
+	defer func() {
+		if err := recover(); err != nil {
+			utils.AlertAuto(fmt.Sprintf("agent painc, id: %s ip: %s err: %v stack: %s", agent.GetCID(), agent.Address(), err, string(debug.Stack())))
+			agent.Close()
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-inbox:
+			if err := agent.listener.GetPipeline()(agent, msg); err != nil {
+				agent.closeWithError("stream", err)
+				return
+			}
+		case <-agent.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package agent
+
+import (
+	"encoding/binary"
+	"errors"
+	"gateway/pkg/configs"
+	"net"
+	"slices"
+	"testing"
+)
+
+func newStreamConfig(window int) configs.ListenerConfig {
+	config := configs.DefaultListenerConfig()
+	config.Streams.WindowMsgID = 5010
+	for i, name := range []string{"battle", "chat"} {
+		stream := configs.DefaultStreamConfig()
+		stream.ID = uint16(i + 1)
+		stream.Name = name
+		stream.MinMsgID = uint32(3000 + 1000*i)
+		stream.MaxMsgID = uint32(3999 + 1000*i)
+		stream.MaxQueued = 64
+		config.Streams.List = append(config.Streams.List, stream)
+	}
+	config.Streams.List[0].Window = window
+
+	return config
+}
+
+// Move the ready frames to the writer and read the msgIDs sent
+func pumpStreams(t *testing.T, agent *Agent, client net.Conn) []uint32 {
+	t.Helper()
+
+	if err := agent.pump(); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []uint32
+	for _, f := range flushFrames(t, agent, client) {
+		ids = append(ids, f.header.MsgID)
+	}
+
+	return ids
+}
+
+func windowUpdate(id uint16, increment uint32) []byte {
+	body := binary.LittleEndian.AppendUint16(nil, id)
+	return binary.LittleEndian.AppendUint32(body, increment)
+}
+
+func TestStreamRoundRobin(t *testing.T) {
+	tests := []struct {
+		name string
+		ids  []uint32
+		want []uint32
+	}{
+		{"one stream", []uint32{3000, 3001, 3002}, []uint32{3000, 3001, 3002}},
+		{"interleaved", []uint32{3000, 3001, 3002, 4000, 4001, 1000}, []uint32{3000, 4000, 1000, 4001, 3001, 3002}}, // Every round starts one stream later
+		{"default stream", []uint32{1000, 1001, 4000}, []uint32{4000, 1000, 1001}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, client := newTestAgent(t, newStreamConfig(0), nil)
+			for _, id := range tt.ids {
+				if err := agent.pushStream(id, []byte("body"), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if ids := pumpStreams(t, agent, client); !slices.Equal(ids, tt.want) {
+				t.Fatalf("sent %v, want %v", ids, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  int
+		updates [][]byte
+		first   []uint32 // Sent before the updates
+		then    []uint32 // Sent after the updates
+		err     error
+	}{
+		{name: "credit", window: 10, updates: [][]byte{windowUpdate(1, 8)}, first: []uint32{3000, 4000, 3001}, then: []uint32{3002}},
+		{name: "no credit left", window: 6, first: []uint32{3000, 4000}},
+		{name: "saturated", window: 6, updates: [][]byte{windowUpdate(1, 1<<31), windowUpdate(1, 1<<31)}, first: []uint32{3000, 4000}, then: []uint32{3001, 3002}},
+		{name: "unknown stream", window: 6, updates: [][]byte{windowUpdate(3, 8)}, first: []uint32{3000, 4000}, err: ErrBadWindowUpdate},
+		{name: "default stream", window: 6, updates: [][]byte{windowUpdate(0, 8)}, first: []uint32{3000, 4000}, err: ErrBadWindowUpdate},
+		{name: "short", window: 6, updates: [][]byte{{1, 0, 8}}, first: []uint32{3000, 4000}, err: ErrBadWindowUpdate},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent, client := newTestAgent(t, newStreamConfig(tt.window), nil)
+			for _, id := range []uint32{3000, 3001, 3002, 4000} {
+				if err := agent.pushStream(id, []byte("6bytes"), 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if ids := pumpStreams(t, agent, client); !slices.Equal(ids, tt.first) {
+				t.Fatalf("sent %v, want %v", ids, tt.first)
+			}
+
+			var err error
+			for _, update := range tt.updates {
+				if err = agent.windowUpdate(update); err != nil {
+					break
+				}
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("windowUpdate() = %v, want %v", err, tt.err)
+			}
+
+			if ids := pumpStreams(t, agent, client); !slices.Equal(ids, tt.then) {
+				t.Fatalf("sent %v after the updates, want %v", ids, tt.then)
+			}
+		})
+	}
+}
+
+func TestStreamFull(t *testing.T) {
+	agent, _ := newTestAgent(t, newStreamConfig(0), nil)
+	if err := agent.pushStream(3000, make([]byte, 64), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := agent.pushStream(3001, []byte{1}, 0); !errors.Is(err, ErrStreamFull) {
+		t.Fatalf("pushStream() = %v, want %v", err, ErrStreamFull)
+	}
+
+	// Other streams have their own queue
+	if err := agent.pushStream(4000, []byte{1}, 0); err != nil {
+		t.Fatal(err)
+	}
+}
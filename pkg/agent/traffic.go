@@ -0,0 +1,69 @@
+package agent
+
+import (
+	"gateway/pkg/interfaces"
+	"gateway/pkg/metric"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic accounting: every agent counts its bytes and messages, the node metrics add up
+// the counts of all agents
+
+type traffic struct {
+	bytesIn    atomic.Int64
+	bytesOut   atomic.Int64
+	msgsIn     atomic.Int64
+	msgsOut    atomic.Int64
+	dropped    atomic.Int64
+	lastActive atomic.Int64 // Unix nano
+}
+
+// Bytes of a frame read from the connection
+func (agent *Agent) received(n int) {
+	agent.traffic.bytesIn.Add(int64(n))
+	agent.traffic.lastActive.Store(time.Now().UnixNano())
+	metric.CountTraffic.Add("bytes_in", int64(n))
+}
+
+// Bytes written to the connection by one flush
+func (agent *Agent) sent(n int) {
+	agent.traffic.bytesOut.Add(int64(n))
+	agent.traffic.lastActive.Store(time.Now().UnixNano())
+	metric.CountTraffic.Add("bytes_out", int64(n))
+}
+
+func (agent *Agent) countMsg(counter *atomic.Int64, key string) {
+	counter.Add(1)
+	metric.CountTraffic.Add(key, 1)
+}
+
+// Count a message that was not handled or not sent
+func (agent *Agent) Drop() {
+	if agent == nil {
+		return
+	}
+
+	agent.countMsg(&agent.traffic.dropped, "dropped")
+}
+
+func (agent *Agent) GetTraffic() interfaces.Traffic {
+	if agent == nil {
+		return interfaces.Traffic{}
+	}
+
+	t := interfaces.Traffic{
+		BytesIn:     agent.traffic.bytesIn.Load(),
+		BytesOut:    agent.traffic.bytesOut.Load(),
+		MsgsIn:      agent.traffic.msgsIn.Load(),
+		MsgsOut:     agent.traffic.msgsOut.Load(),
+		Dropped:     agent.traffic.dropped.Load(),
+		ConnectedAt: agent.acceptedAt.UnixMilli(),
+	}
+
+	if lastActive := agent.traffic.lastActive.Load(); lastActive != 0 {
+		t.LastActive = time.Unix(0, lastActive).UnixMilli()
+	}
+
+	return t
+}
@@ -0,0 +1,84 @@
+package agent
+
+import (
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/metric"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestTraffic(t *testing.T) {
+	const heartbeatMsgID = 5000
+
+	tests := []struct {
+		name     string
+		frames   []uint32 // MsgIDs of the frames sent by the client, 4 byte bodies
+		writes   int      // Messages written by the service
+		disabled bool
+		want     interfaces.Traffic
+	}{
+		{"data", []uint32{2000, 2001, 2002}, 0, false, interfaces.Traffic{BytesIn: 3 * 14, MsgsIn: 3}},
+		{"heartbeat", []uint32{heartbeatMsgID}, 0, false, interfaces.Traffic{BytesIn: 14, BytesOut: 14}},
+		{"writes", nil, 2, false, interfaces.Traffic{BytesOut: 2 * 14, MsgsOut: 2}},
+		{"disabled", []uint32{2000}, 0, true, interfaces.Traffic{BytesIn: 14, MsgsIn: 1, Dropped: 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := configs.DefaultListenerConfig()
+			config.Heartbeat.MsgID = heartbeatMsgID
+			agent, client := newTestAgent(t, config, nil)
+			if tt.disabled {
+				agent.Disable()
+			}
+			before := metric.CountTraffic.Out()
+
+			go agent.loopRead()
+			for _, id := range tt.frames {
+				frame, _ := codec.Classic{}.Append(nil, codec.Header{MsgID: id, Size: 4})
+				if _, err := client.Write(append(frame, "body"...)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			waitFor(t, "frames", func() bool { return agent.GetTraffic().BytesIn == tt.want.BytesIn })
+
+			for i := 0; i < tt.writes; i++ {
+				if err := agent.Write(2000, []byte("body")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Bytes out are counted once flushed, the echo is queued after the heartbeat was counted
+			waitFor(t, "replies", func() bool { return agent.w.Len() == int(tt.want.BytesOut) })
+			flushed := make(chan error, 1)
+			go func() { flushed <- agent.flush() }()
+			if _, err := io.ReadFull(client, make([]byte, tt.want.BytesOut)); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-flushed; err != nil {
+				t.Fatal(err)
+			}
+
+			got := agent.GetTraffic()
+			if got.ConnectedAt != agent.acceptedAt.UnixMilli() || got.LastActive < got.ConnectedAt || got.LastActive > time.Now().UnixMilli() {
+				t.Fatalf("connected at %d, last active %d", got.ConnectedAt, got.LastActive)
+			}
+
+			got.ConnectedAt, got.LastActive = 0, 0
+			if got != tt.want {
+				t.Fatalf("traffic %+v, want %+v", got, tt.want)
+			}
+
+			// The node metrics add up the counts of every agent
+			after := metric.CountTraffic.Out()
+			for key, want := range map[string]int64{"bytes_in": tt.want.BytesIn, "bytes_out": tt.want.BytesOut, "msgs_in": tt.want.MsgsIn, "msgs_out": tt.want.MsgsOut, "dropped": tt.want.Dropped} {
+				if after[key]-before[key] != want {
+					t.Fatalf("count traffic %s +%d, want +%d", key, after[key]-before[key], want)
+				}
+			}
+		})
+	}
+}
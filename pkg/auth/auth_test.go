@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+// Token signed with HS256 unless the header names another alg
+func sign(t *testing.T, header string, claims string, key []byte) string {
+	t.Helper()
+
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyJWT(t *testing.T) {
+	const hs256 = `{"alg":"HS256","typ":"JWT"}`
+	now := time.Unix(1_700_000_000, 0)
+
+	// Claims of another user under the signature of u1
+	signed := strings.Split(sign(t, hs256, `{"sub":"u1","exp":1700000060}`, testKey), ".")
+	tampered := signed[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"u2","exp":1700000060}`)) + "." + signed[2]
+
+	tests := []struct {
+		name   string
+		token  string
+		leeway time.Duration
+		err    error
+	}{
+		{"valid", sign(t, hs256, `{"sub":"u1","exp":1700000060}`, testKey), 0, nil},
+		{"valid nbf", sign(t, hs256, `{"sub":"u1","exp":1700000060,"nbf":1699999990}`, testKey), 0, nil},
+		{"expired", sign(t, hs256, `{"sub":"u1","exp":1699999990}`, testKey), 0, ErrTokenExpired},
+		{"expired within leeway", sign(t, hs256, `{"sub":"u1","exp":1699999990}`, testKey), 30 * time.Second, nil},
+		{"not valid yet", sign(t, hs256, `{"sub":"u1","exp":1700000060,"nbf":1700000010}`, testKey), 0, ErrTokenNotValid},
+		{"nbf within leeway", sign(t, hs256, `{"sub":"u1","exp":1700000060,"nbf":1700000010}`, testKey), 30 * time.Second, nil},
+		{"bad signature", sign(t, hs256, `{"sub":"u1","exp":1700000060}`, []byte("another key of 32 bytes at least")), 0, ErrBadSignature},
+		{"tampered claims", tampered, 0, ErrBadSignature},
+		{"alg none", base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"u1","exp":1700000060}`)) + ".", 0, ErrBadToken},
+		{"alg hs512", sign(t, `{"alg":"HS512"}`, `{"sub":"u1","exp":1700000060}`, testKey), 0, ErrBadToken},
+		{"no sub", sign(t, hs256, `{"exp":1700000060}`, testKey), 0, ErrBadToken},
+		{"no exp", sign(t, hs256, `{"sub":"u1"}`, testKey), 0, ErrBadToken},
+		{"two parts", "a.b", 0, ErrBadToken},
+		{"bad base64", hs256 + ".e30.sig", 0, ErrBadToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := VerifyJWT(tt.token, testKey, now, tt.leeway)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("VerifyJWT() = %v, want %v", err, tt.err)
+			}
+
+			if err == nil && (identity.UserID != "u1" || identity.ExpiresAt != 1700000060 && identity.ExpiresAt != 1699999990) {
+				t.Fatalf("identity %+v", identity)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package bufpool
+
+import (
+	"math/bits"
+	"sync"
+)
+
+const (
+	minShift = 6  // 64 bytes
+	maxShift = 18 // 256 KB, larger buffers are not pooled
+)
+
+// One pool per power of 2 size class
+var pools [maxShift - minShift + 1]sync.Pool
+
+func class(size int) int {
+	if size <= 1<<minShift {
+		return 0
+	}
+
+	return bits.Len(uint(size-1)) - minShift
+}
+
+// Get a buffer of length size, give it back with Put once it is no longer referenced
+func Get(size int) *[]byte {
+	c := class(size)
+	if c >= len(pools) {
+		b := make([]byte, size)
+		return &b
+	}
+
+	if v := pools[c].Get(); v != nil {
+		b := v.(*[]byte)
+		*b = (*b)[:size]
+		return b
+	}
+
+	b := make([]byte, size, 1<<(c+minShift))
+	return &b
+}
+
+func Put(b *[]byte) {
+	if b == nil {
+		return
+	}
+
+	// Only buffers created by Get have a power of 2 capacity in range
+	c := class(cap(*b))
+	if c >= len(pools) || cap(*b) != 1<<(c+minShift) {
+		return
+	}
+
+	*b = (*b)[:0]
+	pools[c].Put(b)
+}
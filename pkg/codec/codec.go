@@ -0,0 +1,220 @@
+package codec
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Frame headers: a listener picks the layout of its frames by codec name, the rest of the
+// gateway only sees decoded headers and the raw header bytes (authenticated on secure connections)
+
+const (
+	NameClassic = "classic"
+	NameV2      = "v2"
+
+	classicHeaderLen  = 10
+	classicCompressed = 1 << 31 // High bits of the size
+	classicMore       = 1 << 30
+	classicFlags      = classicCompressed | classicMore
+
+	v2Version     = 2
+	v2MinLen      = 11 // Version, flags, msgID, tail and a 1 byte length
+	v2MaxLen      = 10 + binary.MaxVarintLen32
+	v2Compressed  = 1 << 0
+	v2More        = 1 << 1
+	v2KnownFlags  = v2Compressed | v2More
+	maxBodySize   = classicCompressed - 1 - v2MaxLen
+	maxClassicLen = classicMore - 1
+)
+
+var (
+	ErrShortHeader = errors.New("short frame header")
+	ErrBadHeader   = errors.New("bad frame header")
+	ErrBadVersion  = errors.New("bad frame version")
+	ErrBadMsgID    = errors.New("msg id does not fit the frame header")
+	ErrUnknown     = errors.New("unknown frame codec")
+
+	codecs = map[string]FrameCodec{
+		NameClassic: Classic{},
+		NameV2:      V2{},
+	}
+)
+
+// Decoded frame header
+type Header struct {
+	MsgID      uint32
+	Size       uint32 // Body size on the wire
+	Tail       uint32 // crc, sequence number or request ID
+	Compressed bool
+	More       bool // The message continues in the next data frame
+	Len        int  // Header size on the wire, set by Decode
+}
+
+type FrameCodec interface {
+	Name() string
+	MinHeaderLen() int
+	MaxHeaderLen() int
+	MaxMsgID() uint32
+	// Decode the header at the front of buf, ErrShortHeader if buf only holds a part of it
+	Decode(buf []byte) (Header, error)
+	// Append the header of a frame to dst
+	Append(dst []byte, h Header) ([]byte, error)
+}
+
+// Codec selected by a listener, an empty name is the classic layout
+func Get(name string) (FrameCodec, error) {
+	if name == "" {
+		return Classic{}, nil
+	}
+
+	fc, ok := codecs[name]
+	if !ok {
+		return nil, ErrUnknown
+	}
+
+	return fc, nil
+}
+
+// Read a header from br, the raw header is copied to dst[:0]
+func ReadHeader(br *bufio.Reader, fc FrameCodec, dst []byte) (Header, []byte, error) {
+	n := fc.MinHeaderLen()
+	for {
+		buf, err := br.Peek(n)
+		if err != nil {
+			return Header{}, nil, err
+		}
+
+		h, err := fc.Decode(buf)
+		if err == ErrShortHeader && n < fc.MaxHeaderLen() {
+			n++
+			continue
+		}
+
+		if err != nil {
+			return Header{}, nil, err
+		}
+
+		raw := append(dst[:0], buf[:h.Len]...)
+		br.Discard(h.Len)
+		return h, raw, nil
+	}
+}
+
+// Original layout, 10 bytes little-endian: msgID uint16, frame size uint32 (header
+// included, bit 31 set on compressed frames, bit 30 on continued ones), tail uint32
+type Classic struct{}
+
+func (Classic) Name() string      { return NameClassic }
+func (Classic) MinHeaderLen() int { return classicHeaderLen }
+func (Classic) MaxHeaderLen() int { return classicHeaderLen }
+func (Classic) MaxMsgID() uint32  { return math.MaxUint16 }
+
+func (Classic) Decode(buf []byte) (Header, error) {
+	if len(buf) < classicHeaderLen {
+		return Header{}, ErrShortHeader
+	}
+
+	size := binary.LittleEndian.Uint32(buf[2:6])
+	h := Header{
+		MsgID:      uint32(binary.LittleEndian.Uint16(buf[:2])),
+		Tail:       binary.LittleEndian.Uint32(buf[6:10]),
+		Compressed: size&classicCompressed != 0,
+		More:       size&classicMore != 0,
+		Len:        classicHeaderLen,
+	}
+
+	size &^= classicFlags
+	if size < classicHeaderLen {
+		return Header{}, ErrBadHeader
+	}
+	h.Size = size - classicHeaderLen
+
+	return h, nil
+}
+
+func (Classic) Append(dst []byte, h Header) ([]byte, error) {
+	if h.MsgID > math.MaxUint16 {
+		return dst, ErrBadMsgID
+	}
+
+	if h.Size > maxClassicLen-classicHeaderLen {
+		return dst, ErrBadHeader
+	}
+
+	size := h.Size + classicHeaderLen
+	if h.Compressed {
+		size |= classicCompressed
+	}
+
+	if h.More {
+		size |= classicMore
+	}
+
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(h.MsgID))
+	dst = binary.LittleEndian.AppendUint32(dst, size)
+	return binary.LittleEndian.AppendUint32(dst, h.Tail), nil
+}
+
+// Versioned layout: version byte (2), flags byte (bit 0 compressed, bit 1 continued), msgID uint32,
+// tail uint32 little-endian, then the body size as an unsigned varint
+type V2 struct{}
+
+func (V2) Name() string      { return NameV2 }
+func (V2) MinHeaderLen() int { return v2MinLen }
+func (V2) MaxHeaderLen() int { return v2MaxLen }
+func (V2) MaxMsgID() uint32  { return math.MaxUint32 }
+
+func (V2) Decode(buf []byte) (Header, error) {
+	if len(buf) < v2MinLen {
+		return Header{}, ErrShortHeader
+	}
+
+	if buf[0] != v2Version {
+		return Header{}, ErrBadVersion
+	}
+
+	if buf[1]&^v2KnownFlags != 0 {
+		return Header{}, ErrBadHeader
+	}
+
+	// A 32 bit size takes 5 bytes at most, longer varints are never complete
+	size, n := binary.Uvarint(buf[10:])
+	if n == 0 && len(buf) < v2MaxLen {
+		return Header{}, ErrShortHeader
+	}
+
+	if n <= 0 || n > binary.MaxVarintLen32 || size > maxBodySize {
+		return Header{}, ErrBadHeader
+	}
+
+	return Header{
+		MsgID:      binary.LittleEndian.Uint32(buf[2:6]),
+		Size:       uint32(size),
+		Tail:       binary.LittleEndian.Uint32(buf[6:10]),
+		Compressed: buf[1]&v2Compressed != 0,
+		More:       buf[1]&v2More != 0,
+		Len:        10 + n,
+	}, nil
+}
+
+func (V2) Append(dst []byte, h Header) ([]byte, error) {
+	if h.Size > maxBodySize {
+		return dst, ErrBadHeader
+	}
+
+	var flags byte
+	if h.Compressed {
+		flags |= v2Compressed
+	}
+
+	if h.More {
+		flags |= v2More
+	}
+
+	dst = append(dst, v2Version, flags)
+	dst = binary.LittleEndian.AppendUint32(dst, h.MsgID)
+	dst = binary.LittleEndian.AppendUint32(dst, h.Tail)
+	return binary.AppendUvarint(dst, uint64(h.Size)), nil
+}
@@ -0,0 +1,129 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		fc     FrameCodec
+		header Header
+	}{
+		{"classic", Classic{}, Header{MsgID: 1000, Size: 12, Tail: 7}},
+		{"classic flags", Classic{}, Header{MsgID: math.MaxUint16, Size: 1 << 20, Tail: math.MaxUint32, Compressed: true, More: true}},
+		{"classic empty", Classic{}, Header{MsgID: 1}},
+		{"classic largest", Classic{}, Header{MsgID: 1, Size: maxClassicLen - classicHeaderLen}},
+		{"v2", V2{}, Header{MsgID: 70000, Size: 12, Tail: 7}},
+		{"v2 flags", V2{}, Header{MsgID: math.MaxUint32, Size: 1 << 20, Tail: math.MaxUint32, Compressed: true, More: true}},
+		{"v2 empty", V2{}, Header{MsgID: 1}},
+		{"v2 largest", V2{}, Header{MsgID: 1, Size: maxBodySize}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := tt.fc.Append([]byte{0xff}, tt.header)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := tt.header
+			want.Len = len(buf) - 1
+			if want.Len < tt.fc.MinHeaderLen() || want.Len > tt.fc.MaxHeaderLen() {
+				t.Fatalf("header of %d bytes", want.Len)
+			}
+
+			got, err := tt.fc.Decode(buf[1:])
+			if err != nil || got != want {
+				t.Fatalf("Decode() = %+v, %v, want %+v", got, err, want)
+			}
+
+			// Read byte by byte until the header is complete
+			body := []byte("body")
+			br := bufio.NewReader(bytes.NewReader(append(buf[1:], body...)))
+			got, raw, err := ReadHeader(br, tt.fc, nil)
+			if err != nil || got != want || !bytes.Equal(raw, buf[1:]) {
+				t.Fatalf("ReadHeader() = %+v, %x, %v", got, raw, err)
+			}
+
+			if rest, _ := br.Peek(len(body)); !bytes.Equal(rest, body) {
+				t.Fatalf("body %q left, want %q", rest, body)
+			}
+		})
+	}
+}
+
+func TestAppendErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		fc     FrameCodec
+		header Header
+		err    error
+	}{
+		{"classic msg id", Classic{}, Header{MsgID: math.MaxUint16 + 1}, ErrBadMsgID},
+		{"classic size", Classic{}, Header{MsgID: 1, Size: maxClassicLen - classicHeaderLen + 1}, ErrBadHeader},
+		{"v2 size", V2{}, Header{MsgID: 1, Size: maxBodySize + 1}, ErrBadHeader},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.fc.Append(nil, tt.header); !errors.Is(err, tt.err) {
+				t.Fatalf("Append() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		fc   FrameCodec
+		buf  []byte
+		err  error
+	}{
+		{"classic short", Classic{}, make([]byte, classicHeaderLen-1), ErrShortHeader},
+		{"classic size below header", Classic{}, []byte{1, 0, 9, 0, 0, 0, 0, 0, 0, 0}, ErrBadHeader},
+		{"classic flags only", Classic{}, []byte{1, 0, 0, 0, 0, 0xc0, 0, 0, 0, 0}, ErrBadHeader},
+		{"v2 short", V2{}, make([]byte, v2MinLen-1), ErrShortHeader},
+		{"v2 version", V2{}, []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, ErrBadVersion},
+		{"v2 unknown flag", V2{}, []byte{v2Version, 4, 0, 0, 0, 0, 0, 0, 0, 0, 0}, ErrBadHeader},
+		{"v2 varint continues", V2{}, []byte{v2Version, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80}, ErrShortHeader},
+		{"v2 varint overflow", V2{}, append([]byte{v2Version, 0, 0, 0, 0, 0, 0, 0, 0, 0}, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01), ErrBadHeader},
+		{"v2 oversized", V2{}, []byte{v2Version, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0x0f}, ErrBadHeader},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.fc.Decode(tt.buf); !errors.Is(err, tt.err) {
+				t.Fatalf("Decode(%x) = %v, want %v", tt.buf, err, tt.err)
+			}
+		})
+	}
+}
+
+// A varint longer than the largest header is refused, not waited for
+func TestReadHeaderOversized(t *testing.T) {
+	tests := []struct {
+		name string
+		buf  []byte
+	}{
+		{"unterminated", []byte{v2Version, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01}},
+		{"padded", []byte{v2Version, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x80, 0x80, 0x80, 0x80, 0x80, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := ReadHeader(bufio.NewReader(bytes.NewReader(tt.buf)), V2{}, nil); !errors.Is(err, ErrBadHeader) {
+				t.Fatalf("ReadHeader() = %v, want %v", err, ErrBadHeader)
+			}
+
+			if _, err := (V2{}).Decode(tt.buf); !errors.Is(err, ErrBadHeader) {
+				t.Fatalf("Decode() = %v, want %v", err, ErrBadHeader)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"gateway/pkg/metric"
+	"io"
+	"sync"
+)
+
+// Per-frame compression: a compressed body is a raw deflate stream, the frame codec
+// flags it in the header
+
+const (
+	AlgorithmNone    = 0
+	AlgorithmDeflate = 1
+
+	MinLevel = flate.BestSpeed
+	MaxLevel = flate.BestCompression
+
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+var (
+	ErrBadLevel = errors.New("bad compression level")
+	ErrTooLarge = errors.New("decompressed body too large")
+	ErrBadData  = errors.New("bad compressed body")
+
+	errNoRoom = errors.New("compressed body does not fit")
+
+	// One pool per level, a writer keeps its level across Reset
+	writers [MaxLevel + 1]sync.Pool
+	readers sync.Pool
+)
+
+// Appends to a slice without growing it past its capacity
+type boundedWriter struct {
+	buf []byte
+}
+
+func (w *boundedWriter) Write(p []byte) (int, error) {
+	if len(p) > cap(w.buf)-len(w.buf) {
+		return 0, errNoRoom
+	}
+
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// Append the compressed msg to dst, false if it does not fit in the capacity of dst
+func Deflate(dst []byte, msg []byte, level int) ([]byte, bool) {
+	if level < MinLevel || level > MaxLevel {
+		return dst, false
+	}
+
+	out := &boundedWriter{buf: dst}
+	fw, _ := writers[level].Get().(*flate.Writer)
+	if fw == nil {
+		fw, _ = flate.NewWriter(out, level)
+	} else {
+		fw.Reset(out)
+	}
+	defer writers[level].Put(fw)
+
+	if _, err := fw.Write(msg); err != nil {
+		return dst, false
+	}
+
+	if err := fw.Close(); err != nil {
+		return dst, false
+	}
+
+	metric.CountCompression.Add(DirectionOut+"_raw", int64(len(msg)))
+	metric.CountCompression.Add(DirectionOut+"_compressed", int64(len(out.buf)-len(dst)))
+
+	return out.buf, true
+}
+
+// Decompress msg into a new slice of at most limit bytes
+func Inflate(msg []byte, limit int) ([]byte, error) {
+	br := bytes.NewReader(msg)
+	fr, _ := readers.Get().(io.ReadCloser)
+	if fr == nil {
+		fr = flate.NewReader(br)
+	} else if err := fr.(flate.Resetter).Reset(br, nil); err != nil {
+		return nil, ErrBadData
+	}
+	defer readers.Put(fr)
+
+	// One extra byte tells a body of exactly limit bytes from a larger one
+	var out bytes.Buffer
+	n, err := out.ReadFrom(io.LimitReader(fr, int64(limit)+1))
+	if err != nil {
+		return nil, ErrBadData
+	}
+
+	if n > int64(limit) {
+		return nil, ErrTooLarge
+	}
+
+	metric.CountCompression.Add(DirectionIn+"_raw", n)
+	metric.CountCompression.Add(DirectionIn+"_compressed", int64(len(msg)))
+
+	return out.Bytes(), nil
+}
+
+// Pick the algorithm of a negotiation request, the body lists the algorithms the client supports
+func Negotiate(offer []byte) byte {
+	if bytes.IndexByte(offer, AlgorithmDeflate) >= 0 {
+		return AlgorithmDeflate
+	}
+
+	return AlgorithmNone
+}
@@ -0,0 +1,122 @@
+package compress
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestDeflate(t *testing.T) {
+	text := bytes.Repeat([]byte("compressible "), 100)
+	random := make([]byte, 1024)
+	rand.Read(random)
+
+	tests := []struct {
+		name  string
+		msg   []byte
+		room  int // Capacity of dst
+		level int
+		ok    bool
+	}{
+		{"text", text, len(text), MinLevel, true},
+		{"best", text, len(text), MaxLevel, true},
+		{"random", random, 2 * len(random), MinLevel, true},
+		{"no room", random, len(random) / 2, MinLevel, false},
+		{"level 0", text, len(text), 0, false},
+		{"level over max", text, len(text), MaxLevel + 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := append(make([]byte, 0, tt.room+2), 'h', 'd')
+			out, ok := Deflate(dst, tt.msg, tt.level)
+			if ok != tt.ok {
+				t.Fatalf("Deflate() ok %v, want %v", ok, tt.ok)
+			}
+
+			if !ok {
+				if len(out) != 2 {
+					t.Fatalf("dst changed to %d bytes", len(out))
+				}
+				return
+			}
+
+			// Appended after the header in dst
+			if string(out[:2]) != "hd" {
+				t.Fatalf("dst prefix %q", out[:2])
+			}
+
+			msg, err := Inflate(out[2:], len(tt.msg))
+			if err != nil || !bytes.Equal(msg, tt.msg) {
+				t.Fatalf("Inflate() = %d bytes, %v", len(msg), err)
+			}
+		})
+	}
+}
+
+func TestInflate(t *testing.T) {
+	msg := bytes.Repeat([]byte("a"), 1000)
+	deflated, _ := Deflate(make([]byte, 0, 1000), msg, MinLevel)
+
+	tests := []struct {
+		name  string
+		body  []byte
+		limit int
+		err   error
+	}{
+		{"under the limit", deflated, 2000, nil},
+		{"at the limit", deflated, 1000, nil},
+		{"over the limit", deflated, 999, ErrTooLarge},
+		{"bomb", bomb(t), 1 << 20, ErrTooLarge},
+		{"bad data", []byte{0xff, 0xff, 0xff}, 1000, ErrBadData},
+		{"truncated", deflated[:len(deflated)/2], 1000, ErrBadData},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out, err := Inflate(tt.body, tt.limit)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Inflate() = %v, want %v", err, tt.err)
+			}
+
+			if err == nil && !bytes.Equal(out, msg) {
+				t.Fatalf("Inflate() = %d bytes, want %d", len(out), len(msg))
+			}
+		})
+	}
+}
+
+// A few KB inflating to 8 MB
+func bomb(t *testing.T) []byte {
+	t.Helper()
+
+	out, ok := Deflate(make([]byte, 0, 1<<20), make([]byte, 8<<20), MaxLevel)
+	if !ok {
+		t.Fatal("bomb does not fit")
+	}
+
+	return out
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name  string
+		offer []byte
+		want  byte
+	}{
+		{"deflate", []byte{AlgorithmDeflate}, AlgorithmDeflate},
+		{"among others", []byte{7, AlgorithmDeflate, 9}, AlgorithmDeflate},
+		{"unknown", []byte{7, 9}, AlgorithmNone},
+		{"none", []byte{AlgorithmNone}, AlgorithmNone},
+		{"empty", nil, AlgorithmNone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Negotiate(tt.offer); got != tt.want {
+				t.Fatalf("Negotiate(%v) = %d, want %d", tt.offer, got, tt.want)
+			}
+		})
+	}
+}
@@ -4,19 +4,72 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"gateway/pkg/codec"
 	"gateway/pkg/version"
 	"io"
 	"net/http"
+	"os"
+	"runtime"
+	"slices"
 	"strings"
 	"sync"
 )
 
+const (
+	RejectModeClose = "close"
+	RejectModeFrame = "frame"
+
+	ModeGoroutine = "goroutine"
+	ModeEvent     = "event"
+
+	ErrorFormatJSON   = "json"
+	ErrorFormatBinary = "binary"
+
+	AuthModeJWT     = "jwt"
+	AuthModeBackend = "backend"
+
+	ReplayActionClose = "close"
+	ReplayActionDrop  = "drop"
+
+	PolicyActionAllow = "allow"
+	PolicyActionDeny  = "deny"
+
+	PolicyStateHandshaking   = "handshaking"
+	PolicyStateAuthenticated = "authenticated"
+
+	DispatchConcurrent = "concurrent"
+	DispatchOrdered    = "ordered"
+	DispatchKeyed      = "keyed"
+)
+
 var (
 	Entry         = EntryConfig{}
 	metaDataCache sync.Map
 
 	ErrorNeedCosFilePathOfEntry = errors.New("need cos file path of entry")
 	ErrorEmptyEntryConfig       = errors.New("empty entry config")
+	ErrorNeedConfigFile         = errors.New("need config file")
+	ErrorBadListenerName        = errors.New("bad listener name")
+	ErrorBadListenerPort        = errors.New("bad listener port")
+	ErrorBadListenerTimeout     = errors.New("bad listener timeout")
+	ErrorBadAdmission           = errors.New("bad admission")
+	ErrorBadListenerMode        = errors.New("bad listener mode")
+	ErrorBadListenerResume      = errors.New("bad listener resume")
+	ErrorBadListenerSequence    = errors.New("bad listener sequence")
+	ErrorBadListenerCorrelation = errors.New("bad listener correlation")
+	ErrorBadListenerErrorReply  = errors.New("bad listener error reply")
+	ErrorBadListenerSecure      = errors.New("bad listener secure")
+	ErrorBadListenerCompression = errors.New("bad listener compression")
+	ErrorBadListenerCodec       = errors.New("bad listener codec")
+	ErrorBadListenerFragment    = errors.New("bad listener fragment")
+	ErrorBadListenerStreams     = errors.New("bad listener streams")
+	ErrorBadListenerBandwidth   = errors.New("bad listener bandwidth")
+	ErrorBadListenerAuth        = errors.New("bad listener auth")
+	ErrorBadListenerCRC         = errors.New("bad listener crc")
+	ErrorBadListenerReplay      = errors.New("bad listener replay")
+	ErrorBadListenerPolicy      = errors.New("bad listener policy")
+	ErrorBadListenerDispatch    = errors.New("bad listener dispatch")
+	ErrorBadListenerControl     = errors.New("bad listener control msg id")
 )
 
 type DiscoveryConfig struct {
@@ -43,15 +96,333 @@ type NodeInfoConfig struct {
 	BuildVersion    string `json:"build_version"`     // Build version
 	GitVersion      string `json:"git_version"`       // Git commit
 	MetricData      string `json:"metric_data"`       // Statistics data
+
+	PublicTcpPorts map[string]uint64 `json:"public_tcp_ports"` // Listener name to TCP port
+}
+
+// Connection admission control, shared by all listeners
+type AdmissionConfig struct {
+	MaxConnections      int64   `json:"max_connections"`        // Max concurrent connections, 0 means unlimited
+	MaxConnectionsPerIP int64   `json:"max_connections_per_ip"` // Max concurrent connections of one IP, 0 means unlimited
+	AcceptRate          float64 `json:"accept_rate"`            // Accepted connections per second, 0 means unlimited
+	AcceptBurst         int     `json:"accept_burst"`           // Accept rate burst
+	RejectMode          string  `json:"reject_mode"`            // close: close immediately, frame: send a "server full" frame then close
+	RejectMsgID         uint32  `json:"reject_msg_id"`          // MsgID of the "server full" frame, the body is the reject reason
+}
+
+// Event-loop networking, shared by all listeners in event mode
+type EventLoopConfig struct {
+	Workers   int `json:"workers"`    // Workers decoding and dispatching frames, 0 means 4 per CPU
+	QueueSize int `json:"queue_size"` // Readable events waiting for a worker
+}
+
+// Application-level heartbeat, answered by the gateway itself
+type HeartbeatConfig struct {
+	MsgID           uint32 `json:"msg_id"`            // Heartbeat msgID, 0 disables heartbeat handling
+	PingIntervalSec uint64 `json:"ping_interval_sec"` // Server-initiated ping interval, 0 disables pings
+}
+
+// Session resume after a reconnect
+type ResumeConfig struct {
+	MsgID       uint32 `json:"msg_id"`        // MsgID of the token frame sent on connect and of the resume request, 0 disables resume
+	NotifyMsgID uint32 `json:"notify_msg_id"` // MsgID forwarded to the service when a session is resumed
+	WindowSec   uint64 `json:"window_sec"`    // Time a disconnected session waits for a resume
+	MaxFrames   int    `json:"max_frames"`    // Outbound frames kept for replay
+}
+
+// Outbound sequence numbers and client acknowledgements
+type SequenceConfig struct {
+	Enabled    bool   `json:"enabled"`     // Carry the sequence number of data frames in the last 4 bytes of the header
+	AckMsgID   uint32 `json:"ack_msg_id"`  // MsgID of client acknowledgements, 0 disables acknowledgements
+	Reliable   bool   `json:"reliable"`    // Keep unacknowledged frames and retransmit them on resume
+	MaxUnacked int    `json:"max_unacked"` // Unacknowledged frames kept in reliable mode, the connection is closed beyond
+}
+
+// Inbound data frames carry a client sequence number in the tail, replayed and too old numbers are rejected
+type ReplayConfig struct {
+	Enabled    bool   `json:"enabled"`
+	Window     int    `json:"window"`      // Numbers accepted out of order behind the highest one, 1 to 64
+	Action     string `json:"action"`      // close: close the connection on a rejection, drop: discard the message
+	MaxRejects int    `json:"max_rejects"` // drop: rejections tolerated before closing the connection, 0 never closes
+}
+
+// Error frame sent to the client when a message is not handled
+type ErrorReplyConfig struct {
+	MsgID  uint32 `json:"msg_id"` // MsgID of the error frame, 0 disables error replies
+	Format string `json:"format"` // json or binary body
+}
+
+// Encrypted session handshake
+type SecureConfig struct {
+	MsgID   uint32 `json:"msg_id"`   // MsgID of the handshake frames, 0 disables encryption
+	KeyFile string `json:"key_file"` // Server ed25519 key, the hex encoded 32 byte seed
+}
+
+// Login required before any other message is forwarded
+type AuthConfig struct {
+	MsgID         uint32 `json:"msg_id"`          // MsgID of the login message, 0 disables the login phase
+	Mode          string `json:"mode"`            // jwt: HS256 token checked by the gateway, backend: checked by the service
+	KeyFile       string `json:"key_file"`        // jwt: HMAC secret, hex encoded
+	LeewaySec     int    `json:"leeway_sec"`      // jwt: clock skew allowed on exp and nbf
+	ServiceAPIURL string `json:"service_api_url"` // backend: login endpoint, empty uses the backend of the login msgID
+	TimeoutSec    int    `json:"timeout_sec"`     // backend: login call timeout
+	MaxQueued     int    `json:"max_queued"`      // backend: messages received while the login is checked, the connection is closed beyond
+}
+
+// Per-frame compression negotiated on connect
+type CompressionConfig struct {
+	MsgID     uint32 `json:"msg_id"`    // MsgID of the negotiation frames, 0 disables compression
+	Threshold int    `json:"threshold"` // Outbound bodies smaller than this are never compressed
+	Level     int    `json:"level"`     // Deflate level, 1 (fastest) to 9 (smallest)
+}
+
+// Messages split into continuation frames
+type FragmentConfig struct {
+	Size          int `json:"size"`           // Largest body of an outbound frame, longer messages are split, 0 disables outbound fragmentation
+	MaxReassembly int `json:"max_reassembly"` // Largest inbound message reassembled from fragments, 0 disables inbound fragmentation
+}
+
+// Outbound rate limit of every connection, the private API overrides it per connection
+type BandwidthConfig struct {
+	Rate  int `json:"rate"`  // Bytes per second, 0 disables shaping
+	Burst int `json:"burst"` // Bytes sent at once above the rate, 0 is one second of rate
+}
+
+// Logical stream of a connection, frames are routed to a stream by msgID
+type StreamConfig struct {
+	ID            uint16 `json:"id"`              // Stream ID used by window updates
+	Name          string `json:"name"`            // Stream name
+	MinMsgID      uint32 `json:"min_msg_id"`      // Smallest msgID of the stream, both directions
+	MaxMsgID      uint32 `json:"max_msg_id"`      // Largest msgID of the stream, both directions
+	ServiceAPIURL string `json:"service_api_url"` // Backend of the stream, empty uses the listener backend
+	Window        int    `json:"window"`          // Outbound bytes sent before the client grants more, 0 disables flow control
+	MaxQueued     int    `json:"max_queued"`      // Outbound bytes waiting in the stream, writes fail beyond
+	MaxPending    int    `json:"max_pending"`     // Inbound messages waiting for the stream worker, the connection is closed beyond
+}
+
+// Streams of a listener, msgIDs out of every range use the default stream
+type StreamsConfig struct {
+	WindowMsgID uint32         `json:"window_msg_id"` // MsgID of client window updates
+	List        []StreamConfig `json:"list"`
+}
+
+// Rule of the msgID policy, the first rule matching a msgID applies
+type PolicyRuleConfig struct {
+	MinMsgID uint32   `json:"min_msg_id"` // Smallest msgID of the rule
+	MaxMsgID uint32   `json:"max_msg_id"` // Largest msgID of the rule
+	Action   string   `json:"action"`     // allow or deny
+	States   []string `json:"states"`     // Connection states the msgIDs are accepted in (handshaking|authenticated), empty accepts every state
+	MaxSize  uint32   `json:"max_size"`   // Largest body once reassembled and inflated, 0 keeps the listener limit
+	Rate     float64  `json:"rate"`       // Messages per second of one connection, shared by the msgIDs of the rule, 0 disables the limit
+	Burst    int      `json:"burst"`      // Messages accepted at once above the rate, 0 is one second of rate
+}
+
+// msgID policy of a listener, reloaded from the config file at runtime
+type PolicyConfig struct {
+	Default string             `json:"default"` // Action of msgIDs matching no rule
+	Rules   []PolicyRuleConfig `json:"rules"`
+}
+
+// Dispatch mode of a msgID range
+type DispatchRuleConfig struct {
+	MinMsgID uint32 `json:"min_msg_id"` // Smallest msgID of the rule
+	MaxMsgID uint32 `json:"max_msg_id"` // Largest msgID of the rule
+	Mode     string `json:"mode"`       // concurrent, ordered or keyed
+}
+
+// How the concurrent middleware runs the messages of a connection
+type DispatchConfig struct {
+	Mode      string               `json:"mode"`       // concurrent: in parallel, ordered: one at a time per connection, keyed: one at a time per connection and msgID
+	Rules     []DispatchRuleConfig `json:"rules"`      // Modes of msgID ranges, the first matching rule applies
+	MaxQueued int                  `json:"max_queued"` // Ordered and keyed messages waiting per connection, answered rate_limited beyond
+}
+
+// Timeouts per connection state
+type TimeoutConfig struct {
+	HandshakeSec uint64 `json:"handshake_sec"` // Idle time allowed before the first valid frame
+	IdleSec      uint64 `json:"idle_sec"`      // Idle time allowed once a valid frame was received
+	WriteSec     uint64 `json:"write_sec"`     // Time allowed to flush queued frames
+}
+
+// Socket options applied to accepted connections
+type SocketConfig struct {
+	NoDelay            bool   `json:"no_delay"`              // TCP_NODELAY
+	KeepAlive          bool   `json:"keep_alive"`            // SO_KEEPALIVE
+	KeepAlivePeriodSec uint64 `json:"keep_alive_period_sec"` // Keepalive idle time and probe interval
+	ReadBufferSize     int    `json:"read_buffer_size"`      // SO_RCVBUF, 0 keeps the system default
+	WriteBufferSize    int    `json:"write_buffer_size"`     // SO_SNDBUF, 0 keeps the system default
+	LingerSec          int    `json:"linger_sec"`            // SO_LINGER, negative keeps the system default
+}
+
+// Public listener
+type ListenerConfig struct {
+	Name            string   `json:"name"`              // Listener name
+	PublicTcpPort   uint64   `json:"public_tcp_port"`   // TCP port for client-facing services
+	ServiceAPIURL   string   `json:"service_api_url"`   // Service API URL
+	DisconnectMsgID uint32   `json:"disconnect_msg_id"` // MsgID forwarded to the service when a connection is closed
+	MinMsgID        uint32   `json:"min_msg_id"`        // Smallest accepted msgID
+	MaxMsgID        uint32   `json:"max_msg_id"`        // Largest accepted msgID
+	MinMsgSize      uint32   `json:"min_msg_size"`      // Smallest accepted frame size (header included)
+	MaxMsgSize      uint32   `json:"max_msg_size"`      // Largest accepted frame size (header included)
+	Middlewares     []string `json:"middlewares"`       // Middleware chain applied to inbound messages
+	Sniff           bool     `json:"sniff"`             // Serve binary frames, WebSocket and HTTP health checks on the same port
+	Mode            string   `json:"mode"`              // goroutine: goroutines per connection, event: epoll event loop (linux only)
+	Correlation     bool     `json:"correlation"`       // The tail of a request header carries a request ID echoed in the response header
+	CRC             bool     `json:"crc"`               // The tail of every header carries the crc of the body salted with the message index
+	Codec           string   `json:"codec"`             // Frame header layout: classic or v2
+
+	Heartbeat   HeartbeatConfig   `json:"heartbeat"`
+	Resume      ResumeConfig      `json:"resume"`
+	Sequence    SequenceConfig    `json:"sequence"`
+	Replay      ReplayConfig      `json:"replay"`
+	ErrorReply  ErrorReplyConfig  `json:"error_reply"`
+	Secure      SecureConfig      `json:"secure"`
+	Auth        AuthConfig        `json:"auth"`
+	Compression CompressionConfig `json:"compression"`
+	Fragment    FragmentConfig    `json:"fragment"`
+	Streams     StreamsConfig     `json:"streams"`
+	Bandwidth   BandwidthConfig   `json:"bandwidth"`
+	Policy      PolicyConfig      `json:"policy"`
+	Dispatch    DispatchConfig    `json:"dispatch"`
+	Timeout     TimeoutConfig     `json:"timeout"`
+	Socket      SocketConfig      `json:"socket"`
 }
 
 type EntryConfig struct {
-	Discovery DiscoveryConfig `json:"discovery"`
-	NodeInfo  NodeInfoConfig  `json:"node_info"`
-	Env       string          `json:"env"`
+	Discovery DiscoveryConfig  `json:"discovery"`
+	NodeInfo  NodeInfoConfig   `json:"node_info"`
+	Listeners []ListenerConfig `json:"listeners"`
+	Admission AdmissionConfig  `json:"admission"`
+	EventLoop EventLoopConfig  `json:"event_loop"`
+	Env       string           `json:"env"`
+
+	ConfigFile string `json:"-"` // Optional JSON file merged over the command line flags
+}
+
+func DefaultListenerConfig() ListenerConfig {
+	return ListenerConfig{
+		Name:            "default",
+		Mode:            ModeGoroutine,
+		Codec:           codec.NameClassic,
+		DisconnectMsgID: 5006,
+		MinMsgID:        1000,
+		MaxMsgID:        60000,
+		MinMsgSize:      10,              // 10 字节
+		MaxMsgSize:      1024 * 1024 * 1, // 1 兆
+		Middlewares:     []string{"rate_limit", "concurrent", "rate_limit_end", "stress_test", "log"},
+		Resume: ResumeConfig{
+			NotifyMsgID: 5007,
+			WindowSec:   30,
+			MaxFrames:   128,
+		},
+		Sequence: SequenceConfig{
+			MaxUnacked: 1024,
+		},
+		Replay: ReplayConfig{
+			Window: 32,
+			Action: ReplayActionClose,
+		},
+		ErrorReply: ErrorReplyConfig{
+			Format: ErrorFormatJSON,
+		},
+		Auth: AuthConfig{
+			Mode:       AuthModeJWT,
+			LeewaySec:  30,
+			TimeoutSec: 5,
+			MaxQueued:  16,
+		},
+		Policy: PolicyConfig{
+			Default: PolicyActionAllow,
+		},
+		Dispatch: DispatchConfig{
+			Mode:      DispatchConcurrent,
+			MaxQueued: 64,
+		},
+		Compression: CompressionConfig{
+			Threshold: 512,
+			Level:     1,
+		},
+		Timeout: TimeoutConfig{
+			HandshakeSec: 60,
+			IdleSec:      60,
+			WriteSec:     60,
+		},
+		Socket: SocketConfig{
+			NoDelay:            true,
+			KeepAlive:          true,
+			KeepAlivePeriodSec: 15,
+			LingerSec:          -1,
+		},
+	}
+}
+
+func DefaultStreamConfig() StreamConfig {
+	return StreamConfig{
+		Name:       "default",
+		MaxQueued:  1024 * 1024 * 1, // 1 兆
+		MaxPending: 64,
+	}
+}
+
+// Fields missing from the file keep their default values
+func (config *StreamConfig) UnmarshalJSON(data []byte) error {
+	type plain StreamConfig
+	tmp := plain(DefaultStreamConfig())
+	tmp.Name = ""
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	*config = StreamConfig(tmp)
+	return nil
+}
+
+// Backend of a message, the one of its stream if set
+func (config ListenerConfig) ServiceURL(msgID uint32) string {
+	for _, stream := range config.Streams.List {
+		if msgID >= stream.MinMsgID && msgID <= stream.MaxMsgID && stream.ServiceAPIURL != "" {
+			return stream.ServiceAPIURL
+		}
+	}
+
+	return config.ServiceAPIURL
+}
+
+// Fields missing from the file keep their default values
+func (config *ListenerConfig) UnmarshalJSON(data []byte) error {
+	type plain ListenerConfig
+	tmp := plain(DefaultListenerConfig())
+	tmp.Name = ""
+	if err := json.Unmarshal(data, &tmp); err != nil {
+		return err
+	}
+
+	*config = ListenerConfig(tmp)
+	return nil
 }
 
 func Init() error {
+	// Load config file
+	if err := LoadFile(); err != nil {
+		return err
+	}
+
+	// Without explicit listeners, serve the command line port
+	if len(Entry.Listeners) == 0 {
+		listener := DefaultListenerConfig()
+		listener.PublicTcpPort = Entry.NodeInfo.PublicTcpPort
+		listener.ServiceAPIURL = Entry.NodeInfo.ServiceAPIURL
+		Entry.Listeners = []ListenerConfig{listener}
+	}
+
+	if Entry.EventLoop.Workers <= 0 {
+		Entry.EventLoop.Workers = runtime.NumCPU() * 4
+	}
+
+	if Entry.EventLoop.QueueSize <= 0 {
+		Entry.EventLoop.QueueSize = 4096
+	}
+
 	// Load node information on first startup
 	if err := LoadNodeInfo(); err != nil {
 		return err
@@ -66,19 +437,467 @@ func Init() error {
 }
 
 func validate() error {
-	// TODO Validate configuration items
+	// TODO Validate other configuration items
+	if err := validateAdmission(Entry.Admission); err != nil {
+		return err
+	}
+
+	names := make(map[string]struct{})
+	ports := make(map[uint64]struct{})
+	for _, listener := range Entry.Listeners {
+		if strings.TrimSpace(listener.Name) == "" {
+			return ErrorBadListenerName
+		}
+
+		if _, ok := names[listener.Name]; ok {
+			return fmt.Errorf("%w: %s is duplicated", ErrorBadListenerName, listener.Name)
+		}
+		names[listener.Name] = struct{}{}
+
+		if listener.PublicTcpPort == 0 || listener.PublicTcpPort > 65535 || listener.PublicTcpPort == Entry.NodeInfo.PrivateHttpPort {
+			return fmt.Errorf("%w: %s %d", ErrorBadListenerPort, listener.Name, listener.PublicTcpPort)
+		}
+
+		if _, ok := ports[listener.PublicTcpPort]; ok {
+			return fmt.Errorf("%w: %s %d is duplicated", ErrorBadListenerPort, listener.Name, listener.PublicTcpPort)
+		}
+		ports[listener.PublicTcpPort] = struct{}{}
+
+		if err := validateListener(listener); err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
 
+func validateAdmission(admission AdmissionConfig) error {
+	if admission.RejectMode != RejectModeClose && admission.RejectMode != RejectModeFrame {
+		return fmt.Errorf("%w: unknown reject mode %s", ErrorBadAdmission, admission.RejectMode)
+	}
+
+	if admission.RejectMode == RejectModeFrame && admission.RejectMsgID == 0 {
+		return fmt.Errorf("%w: reject msg id is required", ErrorBadAdmission)
+	}
+
+	if admission.MaxConnections < 0 || admission.MaxConnectionsPerIP < 0 || admission.AcceptRate < 0 {
+		return ErrorBadAdmission
+	}
+
+	return nil
+}
+
+// Options of one listener, every sub-config is checked on its own then control msgIDs are checked together
+func validateListener(listener ListenerConfig) error {
+	if listener.Timeout.HandshakeSec == 0 || listener.Timeout.IdleSec == 0 || listener.Timeout.WriteSec == 0 {
+		return fmt.Errorf("%w: %s", ErrorBadListenerTimeout, listener.Name)
+	}
+
+	if listener.Mode != ModeGoroutine && listener.Mode != ModeEvent {
+		return fmt.Errorf("%w: %s %s", ErrorBadListenerMode, listener.Name, listener.Mode)
+	}
+
+	// Sniffed connections are buffered or wrapped, the event loop needs the raw socket
+	if listener.Mode == ModeEvent && listener.Sniff {
+		return fmt.Errorf("%w: %s event mode can not sniff", ErrorBadListenerMode, listener.Name)
+	}
+
+	for _, validate := range []func(ListenerConfig) error{
+		validateCodec,
+		validateResume,
+		validateSequence,
+		validateTail,
+		validateReplay,
+		validateErrorReply,
+		validateSecure,
+		validateCompression,
+		validateFragment,
+		validateStreams,
+		validateAuth,
+		validateBandwidth,
+		validateControl,
+		validatePolicy,
+		validateDispatch,
+	} {
+		if err := validate(listener); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Msg IDs sent on the wire fit the header
+func validateCodec(listener ListenerConfig) error {
+	fc, err := codec.Get(listener.Codec)
+	if err != nil {
+		return fmt.Errorf("%w: %s %s", ErrorBadListenerCodec, listener.Name, listener.Codec)
+	}
+
+	ids := []uint32{listener.MaxMsgID, Entry.Admission.RejectMsgID}
+	for _, control := range controlMsgIDs(listener) {
+		ids = append(ids, control.id)
+	}
+
+	for _, id := range ids {
+		if id > fc.MaxMsgID() {
+			return fmt.Errorf("%w: %s msg id %d does not fit the %s header", ErrorBadListenerCodec, listener.Name, id, fc.Name())
+		}
+	}
+
+	return nil
+}
+
+func validateResume(listener ListenerConfig) error {
+	if resume := listener.Resume; resume.MsgID != 0 && (resume.WindowSec == 0 || resume.MaxFrames < 0) {
+		return fmt.Errorf("%w: %s", ErrorBadListenerResume, listener.Name)
+	}
+
+	return nil
+}
+
+func validateSequence(listener ListenerConfig) error {
+	sequence := listener.Sequence
+	if sequence.AckMsgID == 0 && !sequence.Reliable {
+		return nil
+	}
+
+	if !sequence.Enabled || sequence.AckMsgID == 0 {
+		return fmt.Errorf("%w: %s", ErrorBadListenerSequence, listener.Name)
+	}
+
+	// Unacknowledged frames are only retransmitted on resume
+	if sequence.Reliable && (listener.Resume.MsgID == 0 || sequence.MaxUnacked <= 0) {
+		return fmt.Errorf("%w: %s reliable mode needs resume", ErrorBadListenerSequence, listener.Name)
+	}
+
+	return nil
+}
+
+// Correlation, crc and sequence numbers use the tail of the header
+func validateTail(listener ListenerConfig) error {
+	if listener.Correlation && listener.Sequence.Enabled {
+		return fmt.Errorf("%w: %s can not be combined with sequence numbers", ErrorBadListenerCorrelation, listener.Name)
+	}
+
+	if listener.CRC && (listener.Correlation || listener.Sequence.Enabled) {
+		return fmt.Errorf("%w: %s can not be combined with correlation or sequence numbers", ErrorBadListenerCRC, listener.Name)
+	}
+
+	return nil
+}
+
+func validateReplay(listener ListenerConfig) error {
+	replay := listener.Replay
+	if !replay.Enabled {
+		return nil
+	}
+
+	if replay.Window < 1 || replay.Window > 64 || replay.MaxRejects < 0 || (replay.Action != ReplayActionClose && replay.Action != ReplayActionDrop) {
+		return fmt.Errorf("%w: %s", ErrorBadListenerReplay, listener.Name)
+	}
+
+	// The inbound tail carries the request ID or the crc
+	if listener.Correlation || listener.CRC {
+		return fmt.Errorf("%w: %s can not be combined with correlation or crc", ErrorBadListenerReplay, listener.Name)
+	}
+
+	return nil
+}
+
+func validateErrorReply(listener ListenerConfig) error {
+	if reply := listener.ErrorReply; reply.MsgID != 0 && reply.Format != ErrorFormatJSON && reply.Format != ErrorFormatBinary {
+		return fmt.Errorf("%w: %s unknown format %s", ErrorBadListenerErrorReply, listener.Name, reply.Format)
+	}
+
+	return nil
+}
+
+func validateSecure(listener ListenerConfig) error {
+	if secure := listener.Secure; secure.MsgID != 0 && strings.TrimSpace(secure.KeyFile) == "" {
+		return fmt.Errorf("%w: %s key file is required", ErrorBadListenerSecure, listener.Name)
+	}
+
+	return nil
+}
+
+func validateCompression(listener ListenerConfig) error {
+	if compression := listener.Compression; compression.MsgID != 0 && (compression.Threshold < 0 || compression.Level < 1 || compression.Level > 9) {
+		return fmt.Errorf("%w: %s", ErrorBadListenerCompression, listener.Name)
+	}
+
+	return nil
+}
+
+func validateFragment(listener ListenerConfig) error {
+	// Classic frames are smaller than 1 GB
+	if fragment := listener.Fragment; fragment.Size < 0 || fragment.Size >= 1<<30 || fragment.MaxReassembly < 0 {
+		return fmt.Errorf("%w: %s", ErrorBadListenerFragment, listener.Name)
+	}
+
+	return nil
+}
+
+func validateAuth(listener ListenerConfig) error {
+	auth := listener.Auth
+	if auth.MsgID == 0 {
+		return nil
+	}
+
+	if auth.Mode != AuthModeJWT && auth.Mode != AuthModeBackend {
+		return fmt.Errorf("%w: %s unknown mode %s", ErrorBadListenerAuth, listener.Name, auth.Mode)
+	}
+
+	if auth.Mode == AuthModeJWT && strings.TrimSpace(auth.KeyFile) == "" {
+		return fmt.Errorf("%w: %s key file is required", ErrorBadListenerAuth, listener.Name)
+	}
+
+	// The login is a data message, it goes through the header hook
+	if auth.MsgID < listener.MinMsgID || auth.MsgID > listener.MaxMsgID || auth.LeewaySec < 0 || auth.TimeoutSec <= 0 || auth.MaxQueued < 0 {
+		return fmt.Errorf("%w: %s", ErrorBadListenerAuth, listener.Name)
+	}
+
+	return nil
+}
+
+func validateBandwidth(listener ListenerConfig) error {
+	if bandwidth := listener.Bandwidth; bandwidth.Rate < 0 || bandwidth.Burst < 0 {
+		return fmt.Errorf("%w: %s", ErrorBadListenerBandwidth, listener.Name)
+	}
+
+	return nil
+}
+
+// MsgID of a frame consumed or sent by the gateway itself
+type controlMsgID struct {
+	name string
+	id   uint32
+}
+
+// Enabled control msgIDs of a listener
+func controlMsgIDs(listener ListenerConfig) []controlMsgID {
+	ids := []controlMsgID{
+		{"heartbeat", listener.Heartbeat.MsgID},
+		{"resume", listener.Resume.MsgID},
+		{"ack", listener.Sequence.AckMsgID},
+		{"error reply", listener.ErrorReply.MsgID},
+		{"secure", listener.Secure.MsgID},
+		{"compression", listener.Compression.MsgID},
+		{"window", listener.Streams.WindowMsgID},
+	}
+
+	return slices.DeleteFunc(ids, func(control controlMsgID) bool { return control.id == 0 })
+}
+
+// Control frames are told apart by their msgID only, it can not be shared with another control frame or a data message
+func validateControl(listener ListenerConfig) error {
+	controls := controlMsgIDs(listener)
+	for i, control := range controls {
+		for _, other := range controls[:i] {
+			if control.id == other.id {
+				return fmt.Errorf("%w: %s %s and %s share msg id %d", ErrorBadListenerControl, listener.Name, other.name, control.name, control.id)
+			}
+		}
+
+		if control.id == listener.Auth.MsgID {
+			return fmt.Errorf("%w: %s %s msg id %d is the login msg id", ErrorBadListenerControl, listener.Name, control.name, control.id)
+		}
+
+		for _, stream := range listener.Streams.List {
+			if control.id >= stream.MinMsgID && control.id <= stream.MaxMsgID {
+				return fmt.Errorf("%w: %s %s msg id %d is in stream %d", ErrorBadListenerControl, listener.Name, control.name, control.id, stream.ID)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validateStreams(listener ListenerConfig) error {
+	streams := listener.Streams
+	if len(streams.List) == 0 {
+		return nil
+	}
+
+	// Stream frames are reordered, resume and sequence numbers need one outbound order
+	if listener.Resume.MsgID != 0 || listener.Sequence.Enabled {
+		return fmt.Errorf("%w: %s can not be combined with resume or sequence numbers", ErrorBadListenerStreams, listener.Name)
+	}
+
+	windowed := false
+	ids := make(map[uint16]struct{})
+	for i, stream := range streams.List {
+		if stream.ID == 0 || strings.TrimSpace(stream.Name) == "" || stream.MinMsgID > stream.MaxMsgID || stream.Window < 0 || stream.MaxQueued <= 0 || stream.MaxPending <= 0 {
+			return fmt.Errorf("%w: %s stream %d", ErrorBadListenerStreams, listener.Name, stream.ID)
+		}
+
+		if _, ok := ids[stream.ID]; ok {
+			return fmt.Errorf("%w: %s stream %d is duplicated", ErrorBadListenerStreams, listener.Name, stream.ID)
+		}
+		ids[stream.ID] = struct{}{}
+
+		for _, other := range streams.List[:i] {
+			if stream.MinMsgID <= other.MaxMsgID && other.MinMsgID <= stream.MaxMsgID {
+				return fmt.Errorf("%w: %s streams %d and %d overlap", ErrorBadListenerStreams, listener.Name, other.ID, stream.ID)
+			}
+		}
+
+		windowed = windowed || stream.Window > 0
+	}
+
+	if windowed && streams.WindowMsgID == 0 {
+		return fmt.Errorf("%w: %s window msg id is required", ErrorBadListenerStreams, listener.Name)
+	}
+
+	return nil
+}
+
+func validatePolicy(listener ListenerConfig) error {
+	policy := listener.Policy
+	if policy.Default != PolicyActionAllow && policy.Default != PolicyActionDeny {
+		return fmt.Errorf("%w: %s unknown default action %s", ErrorBadListenerPolicy, listener.Name, policy.Default)
+	}
+
+	for i, rule := range policy.Rules {
+		if rule.MinMsgID > rule.MaxMsgID || (rule.Action != PolicyActionAllow && rule.Action != PolicyActionDeny) || rule.Rate < 0 || rule.Burst < 0 {
+			return fmt.Errorf("%w: %s rule %d", ErrorBadListenerPolicy, listener.Name, i)
+		}
+
+		for _, state := range rule.States {
+			if state != PolicyStateHandshaking && state != PolicyStateAuthenticated {
+				return fmt.Errorf("%w: %s rule %d unknown state %s", ErrorBadListenerPolicy, listener.Name, i, state)
+			}
+		}
+
+		// Control frames are never checked, a rule covering one would not apply
+		for _, control := range controlMsgIDs(listener) {
+			if control.id >= rule.MinMsgID && control.id <= rule.MaxMsgID {
+				return fmt.Errorf("%w: %s rule %d covers the %s msg id %d", ErrorBadListenerPolicy, listener.Name, i, control.name, control.id)
+			}
+		}
+	}
+
+	// The login is the first message of a connection
+	if id := listener.Auth.MsgID; id != 0 && !policy.Allows(id, PolicyStateHandshaking) {
+		return fmt.Errorf("%w: %s login msg id is denied", ErrorBadListenerPolicy, listener.Name)
+	}
+
+	return nil
+}
+
+// First rule matching a msgID and its index, nil if none
+func (policy PolicyConfig) Rule(msgID uint32) (int, *PolicyRuleConfig) {
+	for i := range policy.Rules {
+		if msgID >= policy.Rules[i].MinMsgID && msgID <= policy.Rules[i].MaxMsgID {
+			return i, &policy.Rules[i]
+		}
+	}
+
+	return -1, nil
+}
+
+// A msgID is accepted in a connection state
+func (policy PolicyConfig) Allows(msgID uint32, state string) bool {
+	_, rule := policy.Rule(msgID)
+	if rule == nil {
+		return policy.Default == PolicyActionAllow
+	}
+
+	return rule.Action == PolicyActionAllow && (len(rule.States) == 0 || slices.Contains(rule.States, state))
+}
+
+func validateDispatch(listener ListenerConfig) error {
+	dispatch := listener.Dispatch
+	modes := []string{DispatchConcurrent, DispatchOrdered, DispatchKeyed}
+	if !slices.Contains(modes, dispatch.Mode) || dispatch.MaxQueued <= 0 {
+		return fmt.Errorf("%w: %s", ErrorBadListenerDispatch, listener.Name)
+	}
+
+	for i, rule := range dispatch.Rules {
+		if rule.MinMsgID > rule.MaxMsgID || !slices.Contains(modes, rule.Mode) {
+			return fmt.Errorf("%w: %s rule %d", ErrorBadListenerDispatch, listener.Name, i)
+		}
+	}
+
+	return nil
+}
+
+// Dispatch mode of a msgID
+func (dispatch DispatchConfig) ModeOf(msgID uint32) string {
+	for _, rule := range dispatch.Rules {
+		if msgID >= rule.MinMsgID && msgID <= rule.MaxMsgID {
+			return rule.Mode
+		}
+	}
+
+	return dispatch.Mode
+}
+
 func Show() string {
 	nodeInfo := GetNodeInfo()
 	discoveryInfo := GetDiscovery()
+	listeners := GetListeners()
 
 	strNodeInfo, _ := json.MarshalIndent(nodeInfo, "", "	")
 	discoveryInfo.RedisPassword = "***"
 	strdiscoveryInfo, _ := json.MarshalIndent(discoveryInfo, "", "	")
-	return fmt.Sprintf("load node info:\n%s\n\nload discovery info:\n%s\n", string(strNodeInfo), string(strdiscoveryInfo))
+	strListeners, _ := json.MarshalIndent(listeners, "", "	")
+	return fmt.Sprintf("load node info:\n%s\n\nload discovery info:\n%s\n\nload listeners:\n%s\n", string(strNodeInfo), string(strdiscoveryInfo), string(strListeners))
+}
+
+// Merge the config file over the command line flags
+func LoadFile() error {
+	path := strings.TrimSpace(Entry.ConfigFile)
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return ErrorEmptyEntryConfig
+	}
+
+	return json.Unmarshal(data, &Entry)
+}
+
+// Policies of the listeners in the config file, by listener name
+func LoadPolicies() (map[string]PolicyConfig, error) {
+	path := strings.TrimSpace(Entry.ConfigFile)
+	if path == "" {
+		return nil, ErrorNeedConfigFile
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var entry EntryConfig
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string]PolicyConfig, len(entry.Listeners))
+	for _, listener := range entry.Listeners {
+		// Checked against the running listener, its other options are not reloaded
+		for _, running := range Entry.Listeners {
+			if running.Name != listener.Name {
+				continue
+			}
+
+			running.Policy = listener.Policy
+			if err := validatePolicy(running); err != nil {
+				return nil, err
+			}
+			policies[listener.Name] = listener.Policy
+		}
+	}
+
+	return policies, nil
 }
 
 // Set node information
@@ -109,6 +928,11 @@ func LoadNodeInfo() error {
 	Entry.NodeInfo.LocalIP = localIP
 	Entry.NodeInfo.InstanceName = instanceName
 	Entry.NodeInfo.InstanceID = instanceID
+	Entry.NodeInfo.PublicTcpPort = Entry.Listeners[0].PublicTcpPort
+	Entry.NodeInfo.PublicTcpPorts = make(map[string]uint64, len(Entry.Listeners))
+	for _, listener := range Entry.Listeners {
+		Entry.NodeInfo.PublicTcpPorts[listener.Name] = listener.PublicTcpPort
+	}
 	Entry.NodeInfo.ID = fmt.Sprintf("%s_%d_%d", instanceID, Entry.NodeInfo.PublicTcpPort, Entry.NodeInfo.PrivateHttpPort)
 	Entry.NodeInfo.BuildVersion = version.BUILD_DATE
 	Entry.NodeInfo.GitVersion = version.VERSION
@@ -149,3 +973,15 @@ func GetNodeInfo() NodeInfoConfig {
 func GetDiscovery() DiscoveryConfig {
 	return Entry.Discovery
 }
+
+func GetAdmission() AdmissionConfig {
+	return Entry.Admission
+}
+
+func GetEventLoop() EventLoopConfig {
+	return Entry.EventLoop
+}
+
+func GetListeners() []ListenerConfig {
+	return Entry.Listeners
+}
@@ -0,0 +1,107 @@
+package configs
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateListener(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*ListenerConfig)
+		err    error
+	}{
+		{"default", func(*ListenerConfig) {}, nil},
+		{"controls", func(c *ListenerConfig) {
+			c.Heartbeat.MsgID = 5001
+			c.Resume.MsgID = 5002
+			c.ErrorReply.MsgID = 5003
+		}, nil},
+		{"heartbeat and resume", func(c *ListenerConfig) {
+			c.Heartbeat.MsgID = 5001
+			c.Resume.MsgID = 5001
+		}, ErrorBadListenerControl},
+		{"error reply and compression", func(c *ListenerConfig) {
+			c.ErrorReply.MsgID = 5003
+			c.Compression.MsgID = 5003
+		}, ErrorBadListenerControl},
+		{"ack and window", func(c *ListenerConfig) {
+			c.Sequence.Enabled = true
+			c.Sequence.AckMsgID = 5004
+			c.Streams.WindowMsgID = 5004
+		}, ErrorBadListenerControl},
+		{"login", func(c *ListenerConfig) {
+			c.Auth.MsgID = 1000
+			c.Auth.KeyFile = "key"
+			c.Heartbeat.MsgID = 1000
+		}, ErrorBadListenerControl},
+		{"stream range", func(c *ListenerConfig) {
+			stream := DefaultStreamConfig()
+			stream.ID, stream.Name, stream.MinMsgID, stream.MaxMsgID = 1, "chat", 3000, 3999
+			c.Streams.List = []StreamConfig{stream}
+			c.Heartbeat.MsgID = 3500
+		}, ErrorBadListenerControl},
+		{"policy rule", func(c *ListenerConfig) {
+			c.Heartbeat.MsgID = 5001
+			c.Policy.Rules = []PolicyRuleConfig{{MinMsgID: 5000, MaxMsgID: 5999, Action: PolicyActionDeny}}
+		}, ErrorBadListenerPolicy},
+		{"codec", func(c *ListenerConfig) {
+			c.Heartbeat.MsgID = 1 << 16
+		}, ErrorBadListenerCodec},
+		{"reliable without resume", func(c *ListenerConfig) {
+			c.Sequence.Enabled = true
+			c.Sequence.AckMsgID = 5004
+			c.Sequence.Reliable = true
+		}, ErrorBadListenerSequence},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultListenerConfig()
+			tt.modify(&config)
+
+			if err := validateListener(config); !errors.Is(err, tt.err) {
+				t.Fatalf("validateListener() = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLoadPolicies(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		err  error
+	}{
+		{"valid", `{"listeners": [{"name": "default", "policy": {"default": "deny", "rules": [{"min_msg_id": 1000, "max_msg_id": 1999, "action": "allow"}]}}]}`, nil},
+		{"unknown action", `{"listeners": [{"name": "default", "policy": {"default": "drop"}}]}`, ErrorBadListenerPolicy},
+		{"control msg id", `{"listeners": [{"name": "default", "policy": {"default": "allow", "rules": [{"min_msg_id": 5000, "max_msg_id": 5999, "action": "deny"}]}}]}`, ErrorBadListenerPolicy},
+	}
+
+	entry := Entry
+	t.Cleanup(func() { Entry = entry })
+
+	running := DefaultListenerConfig()
+	running.Heartbeat.MsgID = 5001
+	Entry.Listeners = []ListenerConfig{running}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			Entry.ConfigFile = filepath.Join(t.TempDir(), "config.json")
+			if err := os.WriteFile(Entry.ConfigFile, []byte(tt.file), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			policies, err := LoadPolicies()
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("LoadPolicies() = %v, want %v", err, tt.err)
+			}
+
+			if err == nil && len(policies) != 1 {
+				t.Fatalf("loaded %d policies, want 1", len(policies))
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"gateway/pkg/agent"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/limiter"
+	"gateway/pkg/metric"
+	"gateway/pkg/writer"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	RejectReasonMaxConnections      = "max_connections"
+	RejectReasonMaxConnectionsPerIP = "max_connections_per_ip"
+	RejectReasonAcceptRate          = "accept_rate"
+
+	rejectWriteTimeout = time.Second
+	maxRejectWriters   = 256 // Reject frames written at once, connections beyond are closed without the frame
+)
+
+// Connection admission control shared by all listeners
+type admission struct {
+	sync.Mutex
+
+	config  configs.AdmissionConfig
+	bucket  *limiter.Bucket
+	total   int64
+	perIP   map[string]int64
+	writers chan struct{} // Goroutines writing a reject frame
+}
+
+func newAdmission(config configs.AdmissionConfig) *admission {
+	a := &admission{
+		config:  config,
+		perIP:   make(map[string]int64),
+		writers: make(chan struct{}, maxRejectWriters),
+	}
+
+	if config.AcceptRate > 0 {
+		a.bucket = limiter.NewBucket(config.AcceptRate, config.AcceptBurst)
+	}
+	return a
+}
+
+// Take a connection slot, returns the reject reason when the connection is not admitted
+func (a *admission) admit(conn net.Conn) (net.Conn, string) {
+	ip := remoteIP(conn)
+
+	a.Lock()
+	defer a.Unlock()
+
+	if a.config.MaxConnections > 0 && a.total >= a.config.MaxConnections {
+		return nil, RejectReasonMaxConnections
+	}
+
+	if a.config.MaxConnectionsPerIP > 0 && a.perIP[ip] >= a.config.MaxConnectionsPerIP {
+		return nil, RejectReasonMaxConnectionsPerIP
+	}
+
+	if !a.bucket.Allow() {
+		return nil, RejectReasonAcceptRate
+	}
+
+	a.total++
+	a.perIP[ip]++
+
+	return &admittedConn{Conn: conn, admission: a, ip: ip}, ""
+}
+
+func (a *admission) release(ip string) {
+	a.Lock()
+	defer a.Unlock()
+
+	a.total--
+	a.perIP[ip]--
+	if a.perIP[ip] <= 0 {
+		delete(a.perIP, ip)
+	}
+}
+
+// Refuse a connection according to the reject mode, the frame uses the codec of the listener
+func (a *admission) reject(conn net.Conn, reason string, fc codec.FrameCodec) {
+	metric.CountRejectConnection.Add(reason, 1)
+
+	if a.config.RejectMode != configs.RejectModeFrame {
+		conn.Close()
+		return
+	}
+
+	// Do not block the accept loop on a slow client, a flood of refused connections is closed
+	select {
+	case a.writers <- struct{}{}:
+	default:
+		conn.Close()
+		return
+	}
+
+	go func() {
+		defer func() { <-a.writers }()
+		defer conn.Close()
+
+		w := writer.New(conn, fc)
+		if err := w.Write(a.config.RejectMsgID, []byte(reason), 0); err != nil {
+			return
+		}
+
+		b, err := w.Pop()
+		if err != nil || b.Len() == 0 {
+			return
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(rejectWriteTimeout))
+		w.Flush(b)
+	}()
+}
+
+// Gives the connection slot back on close
+type admittedConn struct {
+	net.Conn
+	admission *admission
+	ip        string
+	once      sync.Once
+}
+
+func (conn *admittedConn) Close() error {
+	conn.once.Do(func() {
+		conn.admission.release(conn.ip)
+	})
+
+	return conn.Conn.Close()
+}
+
+func (conn *admittedConn) WriteBuffers(b *net.Buffers) (int64, error) {
+	return writer.WriteBuffers(conn.Conn, b)
+}
+
+// The event loop reads the socket directly
+func (conn *admittedConn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := conn.Conn.(syscall.Conn)
+	if !ok {
+		return nil, agent.ErrNoRawConn
+	}
+
+	return sc.SyscallConn()
+}
+
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+
+	return host
+}
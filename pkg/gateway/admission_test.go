@@ -0,0 +1,194 @@
+package gateway
+
+import (
+	"bufio"
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/metric"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Connection from ip, the peer end is returned to read what the gateway sends
+func newTestConn(t *testing.T, ip string) (net.Conn, net.Conn) {
+	t.Helper()
+
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+
+	return &testConn{Conn: server, addr: &net.TCPAddr{IP: net.ParseIP(ip), Port: 40000}}, client
+}
+
+type testConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (conn *testConn) RemoteAddr() net.Addr { return conn.addr }
+
+func TestAdmit(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  configs.AdmissionConfig
+		ips     []string
+		reasons []string // Reject reason of each connection, empty when admitted
+	}{
+		{
+			name:    "unlimited",
+			ips:     []string{"10.0.0.1", "10.0.0.1", "10.0.0.1"},
+			reasons: []string{"", "", ""},
+		},
+		{
+			name:    "max connections",
+			config:  configs.AdmissionConfig{MaxConnections: 2},
+			ips:     []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			reasons: []string{"", "", RejectReasonMaxConnections},
+		},
+		{
+			name:    "max connections per ip",
+			config:  configs.AdmissionConfig{MaxConnectionsPerIP: 2},
+			ips:     []string{"10.0.0.1", "10.0.0.1", "10.0.0.1", "10.0.0.2"},
+			reasons: []string{"", "", RejectReasonMaxConnectionsPerIP, ""},
+		},
+		{
+			name:    "accept rate",
+			config:  configs.AdmissionConfig{AcceptRate: 0.001, AcceptBurst: 2},
+			ips:     []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"},
+			reasons: []string{"", "", RejectReasonAcceptRate},
+		},
+		{
+			name:    "caps before rate",
+			config:  configs.AdmissionConfig{MaxConnectionsPerIP: 1, AcceptRate: 0.001, AcceptBurst: 2},
+			ips:     []string{"10.0.0.1", "10.0.0.1", "10.0.0.2"},
+			reasons: []string{"", RejectReasonMaxConnectionsPerIP, ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdmission(tt.config)
+			for i, ip := range tt.ips {
+				conn, _ := newTestConn(t, ip)
+				admitted, reason := a.admit(conn)
+				if reason != tt.reasons[i] {
+					t.Fatalf("connection %d from %s rejected for %q, want %q", i, ip, reason, tt.reasons[i])
+				}
+
+				if (admitted == nil) != (reason != "") {
+					t.Fatalf("connection %d: admitted %v with reason %q", i, admitted, reason)
+				}
+			}
+		})
+	}
+}
+
+func TestAdmissionRelease(t *testing.T) {
+	a := newAdmission(configs.AdmissionConfig{MaxConnections: 3, MaxConnectionsPerIP: 1})
+
+	first, _ := newTestConn(t, "10.0.0.1")
+	admitted, _ := a.admit(first)
+	second, _ := newTestConn(t, "10.0.0.2")
+	if _, reason := a.admit(second); reason != "" {
+		t.Fatalf("second connection rejected for %s", reason)
+	}
+
+	again, _ := newTestConn(t, "10.0.0.1")
+	if _, reason := a.admit(again); reason != RejectReasonMaxConnectionsPerIP {
+		t.Fatalf("connection over the ip cap rejected for %q", reason)
+	}
+
+	// Closing twice gives the slot back once
+	admitted.Close()
+	admitted.Close()
+	if a.total != 1 || a.perIP["10.0.0.1"] != 0 {
+		t.Fatalf("total %d, 10.0.0.1 %d after close, want 1 and 0", a.total, a.perIP["10.0.0.1"])
+	}
+
+	if _, ok := a.perIP["10.0.0.1"]; ok {
+		t.Fatal("released ip still tracked")
+	}
+
+	if _, reason := a.admit(again); reason != "" {
+		t.Fatalf("connection rejected for %s after a release", reason)
+	}
+}
+
+func TestAdmissionReject(t *testing.T) {
+	const rejectMsgID = 9000
+
+	tests := []struct {
+		name  string
+		mode  string
+		full  bool // Every reject writer is busy
+		frame bool
+	}{
+		{name: "close", mode: configs.RejectModeClose},
+		{name: "frame", mode: configs.RejectModeFrame, frame: true},
+		{name: "frame with busy writers", mode: configs.RejectModeFrame, full: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdmission(configs.AdmissionConfig{RejectMode: tt.mode, RejectMsgID: rejectMsgID})
+			if tt.full {
+				for i := 0; i < maxRejectWriters; i++ {
+					a.writers <- struct{}{}
+				}
+			}
+
+			conn, client := newTestConn(t, "10.0.0.1")
+			before := metric.CountRejectConnection.Out()[RejectReasonMaxConnections]
+			a.reject(conn, RejectReasonMaxConnections, codec.Classic{})
+
+			if got := metric.CountRejectConnection.Out()[RejectReasonMaxConnections] - before; got != 1 {
+				t.Fatalf("count reject +%d, want +1", got)
+			}
+
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			br := bufio.NewReader(client)
+			if tt.frame {
+				header, _, err := codec.ReadHeader(br, codec.Classic{}, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				body := make([]byte, header.Size)
+				if _, err := io.ReadFull(br, body); err != nil {
+					t.Fatal(err)
+				}
+
+				if header.MsgID != rejectMsgID || string(body) != RejectReasonMaxConnections {
+					t.Fatalf("reject frame %d %q, want %d %q", header.MsgID, body, rejectMsgID, RejectReasonMaxConnections)
+				}
+			}
+
+			// The connection is closed after the frame, or right away
+			if _, err := br.ReadByte(); !errors.Is(err, io.EOF) {
+				t.Fatalf("read after reject = %v, want EOF", err)
+			}
+
+			if !tt.full {
+				waitWriters(t, a)
+			}
+		})
+	}
+}
+
+// Reject writers give their slot back once the frame was written
+func waitWriters(t *testing.T, a *admission) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for len(a.writers) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d reject writers left", len(a.writers))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -9,8 +9,11 @@ import (
 	"gateway/pkg/hot/middlewares"
 	"gateway/pkg/interfaces"
 	"gateway/pkg/metric"
+	"gateway/pkg/netpoll"
+	"gateway/pkg/registry"
 	"gateway/pkg/utils"
 	"gateway/pkg/version"
+	"log"
 	"math"
 	"math/rand/v2"
 	"net"
@@ -29,17 +32,19 @@ var (
 )
 
 type Gateway struct {
-	sync.RWMutex
-
-	agents             map[string]interfaces.Agent
+	agents             *registry.Registry
 	agentUIDBase       atomic.Uint64
 	privateHttpService *http.Server
-	publicTcpService   net.Listener
+	publicTcpServices  []*Listener
+	admission          *admission
+	poller             *netpoll.Poller // Shared by listeners in event mode
+	reload             sync.Mutex      // Serializes policy reloads, the last file read is the one applied
 }
 
 func New() *Gateway {
 	gateway := &Gateway{
-		agents: make(map[string]interfaces.Agent),
+		agents:    registry.New(),
+		admission: newAdmission(configs.GetAdmission()),
 	}
 	return gateway
 }
@@ -103,7 +108,7 @@ func (gateway *Gateway) Run() {
 		jsonMsg := struct {
 			ConnID string `json:"connID"`
 			Bytes  string `json:"bytes"`
-			MsgID  uint16 `json:"msgID"`
+			MsgID  uint32 `json:"msgID"`
 		}{}
 		err := ctx.ShouldBindJSON(&jsonMsg)
 		if err != nil {
@@ -135,7 +140,7 @@ func (gateway *Gateway) Run() {
 		jsonMsg := struct {
 			ConnID string `json:"connID"`
 			Bytes  string `json:"bytes"`
-			MsgID  uint16 `json:"msgID"`
+			MsgID  uint32 `json:"msgID"`
 		}{}
 		err := ctx.ShouldBindJSON(&jsonMsg)
 		if err != nil {
@@ -177,7 +182,7 @@ func (gateway *Gateway) Run() {
 		jsonMsg := struct {
 			ConnIDs         []string `json:"connIDs"`
 			Bytes           string   `json:"bytes"`
-			MsgID           uint16   `json:"msgID"`
+			MsgID           uint32   `json:"msgID"`
 			DurationSeconds int      `json:"durationSeconds"` // Send duration (report time taken)
 		}{}
 		err := ctx.ShouldBindJSON(&jsonMsg)
@@ -218,6 +223,123 @@ func (gateway *Gateway) Run() {
 		})
 	})
 
+	// Outbound rate limit of one connection, rate 0 disables shaping
+	r.POST("/agent/v1/bandwidth", func(ctx *gin.Context) {
+		jsonMsg := struct {
+			ConnID string `json:"connID"`
+			Rate   int    `json:"rate"`
+			Burst  int    `json:"burst"`
+		}{}
+		err := ctx.ShouldBindJSON(&jsonMsg)
+		if err != nil {
+			ctx.JSON(200, gin.H{
+				"code":    1,
+				"message": err,
+			})
+			return
+		}
+
+		if jsonMsg.Rate < 0 || jsonMsg.Burst < 0 {
+			ctx.JSON(200, gin.H{
+				"code":    1,
+				"message": "bad rate",
+			})
+			return
+		}
+
+		agent := gateway.GetAgent(jsonMsg.ConnID)
+		if agent == nil {
+			ctx.JSON(200, gin.H{
+				"code":    1,
+				"message": "agent not found",
+			})
+			return
+		}
+
+		agent.SetBandwidth(jsonMsg.Rate, jsonMsg.Burst)
+		ctx.JSON(200, gin.H{
+			"code":    0,
+			"message": "success",
+		})
+	})
+
+	// Traffic of one connection
+	r.POST("/agent/v1/stats", func(ctx *gin.Context) {
+		jsonMsg := struct {
+			ConnID string `json:"connID"`
+		}{}
+		err := ctx.ShouldBindJSON(&jsonMsg)
+		if err != nil {
+			ctx.JSON(200, gin.H{
+				"code":    1,
+				"message": err,
+			})
+			return
+		}
+
+		agent := gateway.GetAgent(jsonMsg.ConnID)
+		if agent == nil {
+			ctx.JSON(200, gin.H{
+				"code":    1,
+				"message": "agent not found",
+			})
+			return
+		}
+
+		ctx.JSON(200, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    newAgentStats(jsonMsg.ConnID, agent),
+		})
+	})
+
+	// Connections with the most traffic
+	r.POST("/agent/v1/top", func(ctx *gin.Context) {
+		jsonMsg := struct {
+			By    string `json:"by"`
+			Limit int    `json:"limit"`
+		}{}
+		err := ctx.ShouldBindJSON(&jsonMsg)
+		if err != nil {
+			ctx.JSON(200, gin.H{
+				"code":    1,
+				"message": err,
+			})
+			return
+		}
+
+		top, err := gateway.topAgents(jsonMsg.By, jsonMsg.Limit)
+		if err != nil {
+			ctx.JSON(200, gin.H{
+				"code":    1,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		ctx.JSON(200, gin.H{
+			"code":    0,
+			"message": "success",
+			"data":    top,
+		})
+	})
+
+	// Reload the msgID policies from the config file
+	r.POST("/agent/v1/policy/reload", func(ctx *gin.Context) {
+		if err := gateway.ReloadPolicies(); err != nil {
+			ctx.JSON(200, gin.H{
+				"code":    1,
+				"message": err.Error(),
+			})
+			return
+		}
+
+		ctx.JSON(200, gin.H{
+			"code":    0,
+			"message": "success",
+		})
+	})
+
 	// Start private HTTP service
 	nodeInfoConfig := configs.GetNodeInfo()
 	gateway.privateHttpService = &http.Server{
@@ -243,42 +365,118 @@ func (gateway *Gateway) Run() {
 		}
 	}()
 
-	// Start public TCP service
-	var err error
-	gateway.publicTcpService, err = net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", nodeInfoConfig.PublicTcpPort))
-	if err != nil {
-		utils.AlertPanic(fmt.Sprintf("public tcp service listen fail: %v", err))
+	// Start public TCP services
+	for _, listenerConfig := range configs.GetListeners() {
+		if listenerConfig.Mode == configs.ModeEvent && gateway.poller == nil {
+			eventLoopConfig := configs.GetEventLoop()
+			poller, err := netpoll.New(eventLoopConfig.Workers, eventLoopConfig.QueueSize)
+			if err != nil {
+				utils.AlertPanic(fmt.Sprintf("public tcp service event loop init fail: %v", err))
+			}
+			gateway.poller = poller
+		}
+
+		listener, err := NewListener(listenerConfig)
+		if err != nil {
+			utils.AlertPanic(fmt.Sprintf("public tcp service %s init fail: %v", listenerConfig.Name, err))
+		}
+
+		if listener.key != nil {
+			log.Printf("public tcp service %s secure public key: %x", listenerConfig.Name, listener.key.Public())
+		}
+
+		listener.service, err = net.Listen("tcp4", fmt.Sprintf("0.0.0.0:%d", listenerConfig.PublicTcpPort))
+		if err != nil {
+			utils.AlertPanic(fmt.Sprintf("public tcp service %s listen fail: %v", listenerConfig.Name, err))
+		}
+
+		gateway.publicTcpServices = append(gateway.publicTcpServices, listener)
+		go gateway.serve(listener)
 	}
+}
 
-	go func() {
-		defer func() {
-			if err := recover(); err != nil {
-				utils.AlertPanic(fmt.Sprintf("public tcp service accept fail: %v", err))
+// Accept loop of a public listener
+func (gateway *Gateway) serve(listener *Listener) {
+	config := listener.GetConfig()
+	defer func() {
+		if err := recover(); err != nil {
+			utils.AlertPanic(fmt.Sprintf("public tcp service %s accept fail: %v", config.Name, err))
+		}
+	}()
+
+	for {
+		newConn, err := listener.service.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
 			}
-		}()
+			continue
+		}
 
-		for {
-			newConn, err := gateway.publicTcpService.Accept()
-			if err != nil {
-				if errors.Is(err, net.ErrClosed) {
+		if err := setSocketOptions(newConn, config.Socket); err != nil {
+			utils.AlertLowFrequency(err.Error(), fmt.Sprintf("public tcp service %s set socket options fail: %v", config.Name, err))
+		}
+
+		// Admission control
+		admittedConn, reason := gateway.admission.admit(newConn)
+		if admittedConn == nil {
+			gateway.admission.reject(newConn, reason, listener.codec)
+			continue
+		}
+		newConn = admittedConn
+
+		// Sniffing waits for the first bytes, keep it out of the accept loop
+		if config.Sniff {
+			go func() {
+				defer func() {
+					if err := recover(); err != nil {
+						utils.AlertAuto(fmt.Sprintf("public tcp service %s sniff panic: %v", config.Name, err))
+					}
+				}()
+
+				conn, err := sniff(newConn, time.Duration(config.Timeout.HandshakeSec)*time.Second)
+				if err != nil || conn == nil {
+					newConn.Close()
 					return
 				}
-				continue
-			}
 
-			agentUID := gateway.GenerateAgentUID()
-			agent := agent.New(gateway, newConn, agentUID)
-			if err := gateway.AddAgent(agentUID, agent); err != nil {
-				utils.AlertAuto(fmt.Sprintf("add agent: %s fail: %v", newConn.RemoteAddr(), err))
+				gateway.accept(listener, conn)
+			}()
+			continue
+		}
 
-				newConn.Close()
-				continue
-			}
+		gateway.accept(listener, newConn)
+	}
+}
+
+// Attach an agent to a new client connection
+func (gateway *Gateway) accept(listener *Listener, newConn net.Conn) {
+	agentUID := gateway.GenerateAgentUID()
+	agent := agent.New(gateway, listener, newConn, agentUID)
+	if err := gateway.AddAgent(agentUID, agent); err != nil {
+		utils.AlertAuto(fmt.Sprintf("add agent: %s fail: %v", newConn.RemoteAddr(), err))
+
+		newConn.Close()
+		return
+	}
+
+	metric.CountConnection.Add(1)
+	config := listener.GetConfig()
+	if config.Mode != configs.ModeEvent {
+		agent.Run()
+		return
+	}
+
+	if err := agent.RunEvent(gateway.poller); err != nil {
+		utils.AlertLowFrequency(err.Error(), fmt.Sprintf("public tcp service %s event loop register fail: %v", config.Name, err))
 
-			metric.CountConnection.Add(1)
-			agent.Run()
+		// Failed before the agent started, its finalizer will not run
+		if agent.GetState() == interfaces.StateAccepted {
+			gateway.RemoveAgent(agentUID)
+			metric.CountConnection.Add(-1)
+			newConn.Close()
 		}
-	}()
+	}
 }
 
 func (gateway *Gateway) Close() {
@@ -286,22 +484,23 @@ func (gateway *Gateway) Close() {
 		return
 	}
 
-	if gateway.publicTcpService != nil {
-		gateway.publicTcpService.Close()
+	for _, listener := range gateway.publicTcpServices {
+		if listener.service != nil {
+			listener.service.Close()
+		}
 	}
 
 	if gateway.privateHttpService != nil {
 		gateway.privateHttpService.Close()
 	}
 
-	gateway.Lock()
-	defer gateway.Unlock()
+	if gateway.poller != nil {
+		gateway.poller.Close()
+	}
 
-	for _, agent := range gateway.agents {
+	for _, agent := range gateway.agents.Clear() {
 		agent.Close()
 	}
-
-	gateway.agents = nil
 }
 
 func (gateway *Gateway) GenerateAgentUID() string {
@@ -320,16 +519,10 @@ func (gateway *Gateway) AddAgent(id string, agent *agent.Agent) error {
 		return ErrBadAgentUID
 	}
 
-	gateway.Lock()
-	defer gateway.Unlock()
-
-	_, ok := gateway.agents[id]
-	if ok {
+	if !gateway.agents.Add(id, agent) {
 		return ErrAgentUIDDuplicated
 	}
 
-	gateway.agents[id] = agent
-
 	return nil
 }
 
@@ -338,17 +531,16 @@ func (gateway *Gateway) RemoveAgent(id string) interfaces.Agent {
 		return nil
 	}
 
-	gateway.Lock()
-	defer gateway.Unlock()
+	return gateway.agents.Remove(id)
+}
 
-	agent, ok := gateway.agents[id]
-	if !ok {
-		return nil
+// Hand a resumed session over to the agent of the new connection
+func (gateway *Gateway) ReplaceAgent(id string, old interfaces.Agent, agent interfaces.Agent) bool {
+	if strings.TrimSpace(id) == "" {
+		return false
 	}
 
-	delete(gateway.agents, id)
-
-	return agent
+	return gateway.agents.Replace(id, old, agent)
 }
 
 func (gateway *Gateway) GetAgent(id string) interfaces.Agent {
@@ -356,15 +548,7 @@ func (gateway *Gateway) GetAgent(id string) interfaces.Agent {
 		return nil
 	}
 
-	gateway.RLock()
-	defer gateway.RUnlock()
-
-	agent, ok := gateway.agents[id]
-	if ok {
-		return agent
-	}
-
-	return nil
+	return gateway.agents.Get(id)
 }
 
 func (gateway *Gateway) GetAgents() map[string]interfaces.Agent {
@@ -372,13 +556,20 @@ func (gateway *Gateway) GetAgents() map[string]interfaces.Agent {
 		return nil
 	}
 
-	gateway.RLock()
-	defer gateway.RUnlock()
-
-	ret := make(map[string]interfaces.Agent, len(gateway.agents))
-	for id, agent := range gateway.agents {
+	ret := make(map[string]interfaces.Agent, gateway.agents.Len())
+	gateway.agents.Range(func(id string, agent interfaces.Agent) bool {
 		ret[id] = agent
-	}
+		return true
+	})
 
 	return ret
 }
+
+// Visit every agent without blocking accepts and disconnects
+func (gateway *Gateway) RangeAgents(fn func(id string, agent interfaces.Agent) bool) {
+	if gateway == nil {
+		return
+	}
+
+	gateway.agents.Range(fn)
+}
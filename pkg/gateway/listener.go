@@ -0,0 +1,108 @@
+package gateway
+
+import (
+	"crypto/ed25519"
+	"gateway/pkg/auth"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/hot/plugins"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/secure"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// Public listener, every listener owns its pipeline and backend
+type Listener struct {
+	config   atomic.Pointer[configs.ListenerConfig] // Replaced when the policy is reloaded
+	update   sync.Mutex                             // Serializes the replacements of config
+	pipeline interfaces.EndPoint
+	service  net.Listener
+	key      ed25519.PrivateKey // Signs the handshakes of a secure listener
+	authKey  []byte             // Checks login tokens in jwt mode
+	codec    codec.FrameCodec
+}
+
+func NewListener(config configs.ListenerConfig) (*Listener, error) {
+	pipeline, err := plugins.Build(config.Middlewares)
+	if err != nil {
+		return nil, err
+	}
+
+	fc, err := codec.Get(config.Codec)
+	if err != nil {
+		return nil, err
+	}
+
+	listener := &Listener{
+		pipeline: pipeline,
+		codec:    fc,
+	}
+	listener.config.Store(&config)
+
+	if config.Secure.MsgID != 0 {
+		listener.key, err = secure.LoadKey(config.Secure.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Auth.MsgID != 0 && config.Auth.Mode == configs.AuthModeJWT {
+		listener.authKey, err = auth.LoadKey(config.Auth.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return listener, nil
+}
+
+func (listener *Listener) GetConfig() *configs.ListenerConfig {
+	return listener.config.Load()
+}
+
+// Replace the msgID policy, connections apply it from their next message
+func (listener *Listener) SetPolicy(policy configs.PolicyConfig) {
+	listener.update.Lock()
+	defer listener.update.Unlock()
+
+	config := *listener.GetConfig()
+	config.Policy = policy
+	listener.config.Store(&config)
+}
+
+func (listener *Listener) GetPipeline() interfaces.EndPoint {
+	return listener.pipeline
+}
+
+func (listener *Listener) GetServerKey() ed25519.PrivateKey {
+	return listener.key
+}
+
+func (listener *Listener) GetAuthKey() []byte {
+	return listener.authKey
+}
+
+func (listener *Listener) GetCodec() codec.FrameCodec {
+	return listener.codec
+}
+
+// Reload the msgID policies from the config file, listeners missing from the file keep theirs
+func (gateway *Gateway) ReloadPolicies() error {
+	gateway.reload.Lock()
+	defer gateway.reload.Unlock()
+
+	policies, err := configs.LoadPolicies()
+	if err != nil {
+		return err
+	}
+
+	for _, listener := range gateway.publicTcpServices {
+		if policy, ok := policies[listener.GetConfig().Name]; ok {
+			listener.SetPolicy(policy)
+		}
+	}
+
+	return nil
+}
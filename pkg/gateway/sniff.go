@@ -0,0 +1,139 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"gateway/pkg/websocket"
+	"gateway/pkg/writer"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+const (
+	healthReply    = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok"
+	maxRequestLine = 4096 // Size of the sniffing buffer
+	httpVersion    = "HTTP/1.?\r\n"
+)
+
+// Methods of an HTTP request line, anything else is treated as a binary frame
+var httpMethods = [][]byte{
+	[]byte("GET"),
+	[]byte("HEAD"),
+	[]byte("POST"),
+	[]byte("PUT"),
+	[]byte("OPTIONS"),
+	[]byte("DELETE"),
+	[]byte("PATCH"),
+}
+
+// Keeps the sniffed bytes in front of the connection
+type sniffedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (conn *sniffedConn) Read(p []byte) (int, error) {
+	return conn.br.Read(p)
+}
+
+func (conn *sniffedConn) WriteBuffers(b *net.Buffers) (int64, error) {
+	return writer.WriteBuffers(conn.Conn, b)
+}
+
+// Peek at a new connection and pick the protocol, returns nil when the connection was fully served here
+func sniff(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	br := bufio.NewReaderSize(conn, maxRequestLine)
+	isHttp, err := sniffHttp(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// Binary frame client
+	if !isHttp {
+		return &sniffedConn{Conn: conn, br: br}, nil
+	}
+
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+
+	// WebSocket client
+	if websocket.IsUpgrade(req) {
+		wsConn, err := websocket.Upgrade(conn, br, req)
+		if err != nil {
+			return nil, err
+		}
+
+		return wsConn, nil
+	}
+
+	// Health check of the LB
+	_, err = conn.Write([]byte(healthReply))
+	return nil, err
+}
+
+// Peek until the buffered bytes are a complete HTTP/1 request line or can not be one, a
+// binary frame is told apart by its first bytes that do not fit the request line
+func sniffHttp(br *bufio.Reader) (bool, error) {
+	n := 1
+	for {
+		head, err := br.Peek(n)
+		if err != nil {
+			return false, err
+		}
+
+		isHttp, more := requestLine(head)
+		if isHttp || !more || n == maxRequestLine {
+			return isHttp, nil
+		}
+
+		n = min(max(n+1, br.Buffered()), maxRequestLine)
+	}
+}
+
+// Whether b starts with a request line "METHOD target HTTP/1.x\r\n", more is set while b is
+// too short to tell
+func requestLine(b []byte) (bool, bool) {
+	sp := bytes.IndexByte(b, ' ')
+	if sp < 0 {
+		return false, slices.ContainsFunc(httpMethods, func(method []byte) bool { return bytes.HasPrefix(method, b) })
+	}
+
+	if !slices.ContainsFunc(httpMethods, func(method []byte) bool { return bytes.Equal(method, b[:sp]) }) {
+		return false, false
+	}
+
+	// Target, printable without spaces
+	rest := b[sp+1:]
+	i := 0
+	for i < len(rest) && rest[i] > ' ' && rest[i] < 0x7f {
+		i++
+	}
+
+	if i == len(rest) {
+		return false, true
+	}
+
+	if i == 0 || rest[i] != ' ' {
+		return false, false
+	}
+
+	version := rest[i+1:]
+	for j := 0; j < len(version) && j < len(httpVersion); j++ {
+		if httpVersion[j] == '?' && (version[j] < '0' || version[j] > '9') || httpVersion[j] != '?' && version[j] != httpVersion[j] {
+			return false, false
+		}
+	}
+
+	if len(version) < len(httpVersion) {
+		return false, true
+	}
+
+	return true, false
+}
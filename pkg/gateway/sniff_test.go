@@ -0,0 +1,71 @@
+package gateway
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestRequestLine(t *testing.T) {
+	tests := []struct {
+		name   string
+		head   string
+		isHttp bool
+		more   bool
+	}{
+		{"get", "GET / HTTP/1.1\r\n", true, false},
+		{"options", "OPTIONS * HTTP/1.0\r\nHost: a\r\n", true, false},
+		{"method prefix", "GE", false, true},
+		{"method", "GET", false, true},
+		{"target", "GET /health", false, true},
+		{"version prefix", "GET /health HTTP/1", false, true},
+		{"no cr lf", "GET /health HTTP/1.1", false, true},
+		{"frame with method prefix", "GET \x00\x10\x00\x00", false, false},
+		{"frame with size bytes", "GET /\x01", false, false},
+		{"unknown method", "GETS / HTTP/1.1\r\n", false, false},
+		{"empty target", "GET  HTTP/1.1\r\n", false, false},
+		{"http 2", "GET / HTTP/2.0\r\n", false, false},
+		{"binary", "\x47\x45\x00\x02", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isHttp, more := requestLine([]byte(tt.head))
+			if isHttp != tt.isHttp || more != tt.more {
+				t.Fatalf("requestLine(%q) = %v, %v, want %v, %v", tt.head, isHttp, more, tt.isHttp, tt.more)
+			}
+		})
+	}
+}
+
+func TestSniffHttp(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		isHttp bool
+	}{
+		{"health check", "GET /health HTTP/1.1\r\nHost: a\r\n\r\n", true},
+		{"frame", "\x00\x01\x02\x03\x04\x05", false},
+		{"frame with method prefix", "GET \x00\x10\x00\x00body", false},
+		{"long target", "GET /" + strings.Repeat("a", maxRequestLine) + " HTTP/1.1\r\n", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			br := bufio.NewReaderSize(strings.NewReader(tt.data), maxRequestLine)
+			isHttp, err := sniffHttp(br)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if isHttp != tt.isHttp {
+				t.Fatalf("sniffHttp = %v, want %v", isHttp, tt.isHttp)
+			}
+
+			// Sniffing does not consume the bytes
+			if br.Buffered() == 0 {
+				t.Fatal("nothing buffered")
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package gateway
+
+import (
+	"gateway/pkg/configs"
+	"net"
+	"time"
+)
+
+// Apply the listener socket options to an accepted connection
+func setSocketOptions(conn net.Conn, config configs.SocketConfig) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetNoDelay(config.NoDelay); err != nil {
+		return err
+	}
+
+	if err := tcpConn.SetKeepAlive(config.KeepAlive); err != nil {
+		return err
+	}
+
+	if config.KeepAlive && config.KeepAlivePeriodSec > 0 {
+		if err := tcpConn.SetKeepAlivePeriod(time.Duration(config.KeepAlivePeriodSec) * time.Second); err != nil {
+			return err
+		}
+	}
+
+	if config.ReadBufferSize > 0 {
+		if err := tcpConn.SetReadBuffer(config.ReadBufferSize); err != nil {
+			return err
+		}
+	}
+
+	if config.WriteBufferSize > 0 {
+		if err := tcpConn.SetWriteBuffer(config.WriteBufferSize); err != nil {
+			return err
+		}
+	}
+
+	if config.LingerSec >= 0 {
+		if err := tcpConn.SetLinger(config.LingerSec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+//go:build linux
+
+package gateway
+
+import (
+	"gateway/pkg/configs"
+	"net"
+	"syscall"
+	"testing"
+	"unsafe"
+)
+
+// Accepted end of a loopback TCP connection
+func newTCPConn(t *testing.T) *net.TCPConn {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	return server.(*net.TCPConn)
+}
+
+func getsockopt(t *testing.T, conn *net.TCPConn, level int, opt int) int {
+	t.Helper()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var value int
+	var optErr error
+	raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if optErr != nil {
+		t.Fatal(optErr)
+	}
+
+	return value
+}
+
+func getLinger(t *testing.T, conn *net.TCPConn) *syscall.Linger {
+	t.Helper()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The syscall package has no getter for SO_LINGER
+	var linger syscall.Linger
+	var errno syscall.Errno
+	raw.Control(func(fd uintptr) {
+		size := uint32(unsafe.Sizeof(linger))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, syscall.SOL_SOCKET, syscall.SO_LINGER, uintptr(unsafe.Pointer(&linger)), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+
+	return &linger
+}
+
+func TestSetSocketOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    configs.SocketConfig
+		noDelay   int
+		keepAlive int
+		keepIdle  int // 0 leaves the system default
+		linger    int // -1 leaves linger off
+	}{
+		{"default", configs.DefaultListenerConfig().Socket, 1, 1, 15, -1},
+		{"nagle", configs.SocketConfig{LingerSec: -1}, 0, 0, 0, -1},
+		{"keepalive period", configs.SocketConfig{KeepAlive: true, KeepAlivePeriodSec: 30, LingerSec: -1}, 0, 1, 30, -1},
+		{"linger", configs.SocketConfig{NoDelay: true, LingerSec: 5}, 1, 0, 0, 5},
+		{"reset on close", configs.SocketConfig{LingerSec: 0}, 0, 0, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := newTCPConn(t)
+			if err := setSocketOptions(conn, tt.config); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY); got != tt.noDelay {
+				t.Fatalf("TCP_NODELAY %d, want %d", got, tt.noDelay)
+			}
+
+			if got := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); got != tt.keepAlive {
+				t.Fatalf("SO_KEEPALIVE %d, want %d", got, tt.keepAlive)
+			}
+
+			if tt.keepIdle > 0 {
+				if got := getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); got != tt.keepIdle {
+					t.Fatalf("TCP_KEEPIDLE %d, want %d", got, tt.keepIdle)
+				}
+			}
+
+			linger := getLinger(t, conn)
+			if tt.linger < 0 && linger.Onoff != 0 || tt.linger >= 0 && (linger.Onoff == 0 || int(linger.Linger) != tt.linger) {
+				t.Fatalf("SO_LINGER %+v, want %d", linger, tt.linger)
+			}
+		})
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	conn := newTCPConn(t)
+	before := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+
+	// The kernel doubles the requested sizes for its bookkeeping
+	config := configs.SocketConfig{ReadBufferSize: 32 * 1024, WriteBufferSize: 48 * 1024, LingerSec: -1}
+	if err := setSocketOptions(conn, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_RCVBUF); got != 2*config.ReadBufferSize {
+		t.Fatalf("SO_RCVBUF %d, want %d", got, 2*config.ReadBufferSize)
+	}
+
+	if got := getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_SNDBUF); got != 2*config.WriteBufferSize {
+		t.Fatalf("SO_SNDBUF %d, want %d (was %d)", got, 2*config.WriteBufferSize, before)
+	}
+
+	// Other connections are left alone
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	if err := setSocketOptions(server, config); err != nil {
+		t.Fatalf("setSocketOptions() on a pipe = %v", err)
+	}
+}
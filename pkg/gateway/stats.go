@@ -0,0 +1,77 @@
+package gateway
+
+import (
+	"cmp"
+	"errors"
+	"gateway/pkg/interfaces"
+	"slices"
+)
+
+const maxTopAgents = 1000
+
+var ErrBadStatsKey = errors.New("bad stats key")
+
+// Traffic of one connection as returned by the private API
+type AgentStats struct {
+	ConnID  string `json:"connID"`
+	Address string `json:"address"`
+	State   string `json:"state"`
+	UserID  string `json:"userID,omitempty"`
+	RTT     int64  `json:"rtt"` // Milliseconds
+	interfaces.Traffic
+}
+
+// Counters agents can be ranked by
+var statsKeys = map[string]func(interfaces.Traffic) int64{
+	"bytes_in":  func(t interfaces.Traffic) int64 { return t.BytesIn },
+	"bytes_out": func(t interfaces.Traffic) int64 { return t.BytesOut },
+	"msgs_in":   func(t interfaces.Traffic) int64 { return t.MsgsIn },
+	"msgs_out":  func(t interfaces.Traffic) int64 { return t.MsgsOut },
+	"dropped":   func(t interfaces.Traffic) int64 { return t.Dropped },
+}
+
+func newAgentStats(id string, agent interfaces.Agent) AgentStats {
+	stats := AgentStats{
+		ConnID:  id,
+		Address: agent.Address(),
+		State:   agent.GetState().String(),
+		RTT:     agent.GetRTT().Milliseconds(),
+		Traffic: agent.GetTraffic(),
+	}
+
+	if identity := agent.GetIdentity(); identity != nil {
+		stats.UserID = identity.UserID
+	}
+
+	return stats
+}
+
+// Agents with the largest counter, at most limit of them
+func (gateway *Gateway) topAgents(by string, limit int) ([]AgentStats, error) {
+	key, ok := statsKeys[by]
+	if !ok {
+		return nil, ErrBadStatsKey
+	}
+
+	limit = min(max(limit, 1), maxTopAgents)
+	top := make([]AgentStats, 0, limit+1)
+	gateway.RangeAgents(func(id string, agent interfaces.Agent) bool {
+		stats := newAgentStats(id, agent)
+		if len(top) == limit && key(stats.Traffic) <= key(top[limit-1].Traffic) {
+			return true
+		}
+
+		// Keep top sorted, largest first
+		i, _ := slices.BinarySearchFunc(top, key(stats.Traffic), func(s AgentStats, v int64) int {
+			return cmp.Compare(v, key(s.Traffic))
+		})
+		top = slices.Insert(top, i, stats)
+		if len(top) > limit {
+			top = top[:limit]
+		}
+
+		return true
+	})
+
+	return top, nil
+}
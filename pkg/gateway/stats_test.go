@@ -0,0 +1,96 @@
+package gateway
+
+import (
+	"errors"
+	"gateway/pkg/interfaces"
+	"slices"
+	"testing"
+	"time"
+)
+
+// Agent with fixed traffic
+type statsAgent struct {
+	interfaces.Agent
+	traffic interfaces.Traffic
+	user    string
+}
+
+func (agent *statsAgent) Address() string                { return "10.0.0.1:40000" }
+func (agent *statsAgent) GetState() interfaces.State     { return interfaces.StateAuthenticated }
+func (agent *statsAgent) GetRTT() time.Duration          { return 25 * time.Millisecond }
+func (agent *statsAgent) GetTraffic() interfaces.Traffic { return agent.traffic }
+func (agent *statsAgent) GetIdentity() *interfaces.Identity {
+	if agent.user == "" {
+		return nil
+	}
+
+	return &interfaces.Identity{UserID: agent.user}
+}
+
+func TestTopAgents(t *testing.T) {
+	gateway := New()
+	for id, traffic := range map[string]interfaces.Traffic{
+		"a": {BytesIn: 100, MsgsOut: 1},
+		"b": {BytesIn: 300, MsgsOut: 5, Dropped: 2},
+		"c": {BytesIn: 200, MsgsOut: 3},
+		"d": {BytesIn: 50, MsgsOut: 9},
+	} {
+		gateway.agents.Add(id, &statsAgent{traffic: traffic})
+	}
+
+	tests := []struct {
+		name  string
+		by    string
+		limit int
+		ids   []string
+		err   error
+	}{
+		{"bytes in", "bytes_in", 2, []string{"b", "c"}, nil},
+		{"msgs out", "msgs_out", 3, []string{"d", "b", "c"}, nil},
+		{"all", "bytes_in", 10, []string{"b", "c", "a", "d"}, nil},
+		{"min limit", "dropped", 0, []string{"b"}, nil},
+		{"bad key", "bytes", 2, nil, ErrBadStatsKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			top, err := gateway.topAgents(tt.by, tt.limit)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("topAgents() = %v, want %v", err, tt.err)
+			}
+
+			var ids []string
+			for _, stats := range top {
+				ids = append(ids, stats.ConnID)
+			}
+
+			if !slices.Equal(ids, tt.ids) {
+				t.Fatalf("top %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
+
+func TestAgentStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		agent *statsAgent
+		user  string
+	}{
+		{"anonymous", &statsAgent{traffic: interfaces.Traffic{BytesIn: 10}}, ""},
+		{"logged in", &statsAgent{traffic: interfaces.Traffic{BytesIn: 10}, user: "u1"}, "u1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := newAgentStats("id", tt.agent)
+			if stats.ConnID != "id" || stats.Address != "10.0.0.1:40000" || stats.State != interfaces.StateAuthenticated.String() || stats.RTT != 25 {
+				t.Fatalf("stats %+v", stats)
+			}
+
+			if stats.UserID != tt.user || stats.Traffic != tt.agent.traffic {
+				t.Fatalf("user %q traffic %+v, want %q %+v", stats.UserID, stats.Traffic, tt.user, tt.agent.traffic)
+			}
+		})
+	}
+}
@@ -1,8 +1,9 @@
 package hooks
 
 import (
-	"encoding/binary"
 	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/encoding"
 	"gateway/pkg/interfaces"
 )
 
@@ -10,41 +11,35 @@ var (
 	Version    = "0.0.1"
 	HookHeader = interfaces.HookHeader(hookHeader)
 	HookBody   = interfaces.HookBody(hookBody)
-
-	minID   uint16 = 1000
-	maxID   uint16 = 60000
-	minSize uint32 = 10              // 10 字节
-	maxSize uint32 = 1024 * 1024 * 1 // 1 兆
 )
 
 var (
 	ErrBadHeaderSize = errors.New("bad header size")
 	ErrBadHeaderID   = errors.New("bad header id")
+	ErrBadCRC        = errors.New("bad crc")
 )
 
-func hookHeader(agent interfaces.Agent, header []byte) error {
-	if header != nil {
-		id := binary.LittleEndian.Uint16(header[:2])
-		size := binary.LittleEndian.Uint32(header[2:6])
-		crc := binary.LittleEndian.Uint32(header[6:10])
-		_ = crc
-
-		if id < minID || id > maxID {
-			return ErrBadHeaderID
-		}
+func hookHeader(agent interfaces.Agent, header codec.Header) error {
+	// Limits come from the listener the agent was accepted on, compressed frames are checked by their size on the wire
+	config := agent.GetListenerConfig()
+	if header.MsgID < config.MinMsgID || header.MsgID > config.MaxMsgID {
+		return ErrBadHeaderID
+	}
 
-		if size < minSize || size > maxSize {
-			return ErrBadHeaderSize
-		}
+	size := uint32(header.Len) + header.Size // Header included
+	if size < config.MinMsgSize || size > config.MaxMsgSize {
+		return ErrBadHeaderSize
 	}
 
-	return nil
+	return checkPolicy(agent, config.Policy, header)
 }
 
-func hookBody(agent interfaces.Agent, header []byte, body []byte) error {
-	if body != nil {
-		// TODO
+func hookBody(agent interfaces.Agent, header codec.Header, body []byte) error {
+	// The tail carries the crc of the whole message, checked once it was opened, reassembled and inflated
+	config := agent.GetListenerConfig()
+	if config.CRC && header.Tail != encoding.CRC(body, agent.GetMsgIndex()) {
+		return ErrBadCRC
 	}
 
-	return nil
+	return limitPolicy(agent, config, header, body)
 }
@@ -0,0 +1,70 @@
+package hooks
+
+import (
+	"gateway/pkg/interfaces"
+	"sync"
+)
+
+// Lifecycle callbacks registered by plugins, they run on the goroutine that changed the
+// state (read loop, finalizer or private API handler) and must not block
+
+var lifecycle struct {
+	sync.RWMutex
+	connect     []interfaces.OnConnect
+	stateChange []interfaces.OnStateChange
+	close       []interfaces.OnClose
+}
+
+// Called once the agent starts reading
+func OnConnect(fn interfaces.OnConnect) {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+
+	lifecycle.connect = append(lifecycle.connect, fn)
+}
+
+// Called after every state transition
+func OnStateChange(fn interfaces.OnStateChange) {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+
+	lifecycle.stateChange = append(lifecycle.stateChange, fn)
+}
+
+// Called once the connection is closed, a detached session may still be resumed
+func OnClose(fn interfaces.OnClose) {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+
+	lifecycle.close = append(lifecycle.close, fn)
+}
+
+func Connect(agent interfaces.Agent) {
+	lifecycle.RLock()
+	callbacks := lifecycle.connect
+	lifecycle.RUnlock()
+
+	for _, fn := range callbacks {
+		fn(agent)
+	}
+}
+
+func StateChange(agent interfaces.Agent, from interfaces.State, to interfaces.State) {
+	lifecycle.RLock()
+	callbacks := lifecycle.stateChange
+	lifecycle.RUnlock()
+
+	for _, fn := range callbacks {
+		fn(agent, from, to)
+	}
+}
+
+func Close(agent interfaces.Agent) {
+	lifecycle.RLock()
+	callbacks := lifecycle.close
+	lifecycle.RUnlock()
+
+	for _, fn := range callbacks {
+		fn(agent)
+	}
+}
@@ -0,0 +1,142 @@
+package hooks
+
+import (
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/hot/plugins"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/limiter"
+	"gateway/pkg/metric"
+	"math"
+	"slices"
+	"sync"
+)
+
+// msgID policy: the first rule of the listener policy matching a msgID decides whether it is
+// accepted, in which connection state, how large its body may be and how often a connection
+// may send it. The policy is read on every message, a reload applies from the next one
+
+const (
+	PolicyDenied      = "denied"
+	PolicyState       = "state"
+	PolicySize        = "size"
+	PolicyRateLimited = "rate_limited"
+
+	policyKey = "policy" // Rate limits of a connection in the agent storage
+)
+
+var (
+	ErrDeniedMsgID = errors.New("msg id denied")
+	ErrBadMsgState = errors.New("msg id not accepted in this state")
+	ErrBadBodySize = errors.New("bad body size")
+	ErrRateLimited = errors.New("msg rate limited")
+)
+
+// Rate limit of one rule, replaced when the limit of the rule changes
+type policyBucket struct {
+	rate   float64
+	burst  int
+	bucket *limiter.Bucket
+}
+
+// Rules are told apart by their msgID range, a reload that reorders the rules keeps the buckets
+type policyRange struct {
+	min uint32
+	max uint32
+}
+
+// Rate limits of one connection. The agent storage is copied to the agent resuming a session,
+// the copy is not reused
+type policyLimits struct {
+	sync.Mutex
+	agent   interfaces.Agent
+	buckets map[policyRange]*policyBucket
+}
+
+// Checked on every frame, before its body is read
+func checkPolicy(agent interfaces.Agent, policy configs.PolicyConfig, header codec.Header) error {
+	_, rule := policy.Rule(header.MsgID)
+	if rule == nil {
+		if policy.Default == configs.PolicyActionDeny {
+			metric.CountPolicy.Add(PolicyDenied, 1)
+			return ErrDeniedMsgID
+		}
+
+		return nil
+	}
+
+	if rule.Action == configs.PolicyActionDeny {
+		metric.CountPolicy.Add(PolicyDenied, 1)
+		return ErrDeniedMsgID
+	}
+
+	// Messages of a kicked connection are dropped later
+	state := agent.GetState()
+	if len(rule.States) > 0 && (state == interfaces.StateHandshaking || state == interfaces.StateAuthenticated) && !slices.Contains(rule.States, state.String()) {
+		metric.CountPolicy.Add(PolicyState, 1)
+		return ErrBadMsgState
+	}
+
+	return nil
+}
+
+// Checked once per message, a rate limited message is answered with an error reply
+func limitPolicy(agent interfaces.Agent, config *configs.ListenerConfig, header codec.Header, body []byte) error {
+	_, rule := config.Policy.Rule(header.MsgID)
+	if rule == nil {
+		return nil
+	}
+
+	if rule.MaxSize > 0 && uint32(len(body)) > rule.MaxSize {
+		metric.CountPolicy.Add(PolicySize, 1)
+		return ErrBadBodySize
+	}
+
+	if rule.Rate <= 0 || allowPolicy(agent, rule) {
+		return nil
+	}
+
+	metric.CountPolicy.Add(PolicyRateLimited, 1)
+	msg := interfaces.Msg{ID: header.MsgID}
+	if config.Correlation {
+		msg.RequestID = header.Tail
+	}
+	if err := plugins.ReplyError(agent, msg, plugins.ErrorCodeRateLimited, 0); err != nil {
+		return err
+	}
+
+	return ErrRateLimited
+}
+
+func allowPolicy(agent interfaces.Agent, rule *configs.PolicyRuleConfig) bool {
+	limits := getPolicyLimits(agent)
+	limits.Lock()
+	defer limits.Unlock()
+
+	key := policyRange{min: rule.MinMsgID, max: rule.MaxMsgID}
+	b := limits.buckets[key]
+	if b == nil || b.rate != rule.Rate || b.burst != rule.Burst {
+		burst := rule.Burst
+		if burst == 0 {
+			burst = int(math.Ceil(rule.Rate))
+		}
+
+		b = &policyBucket{rate: rule.Rate, burst: rule.Burst, bucket: limiter.NewBucket(rule.Rate, burst)}
+		limits.buckets[key] = b
+	}
+
+	return b.bucket.Allow()
+}
+
+func getPolicyLimits(agent interfaces.Agent) *policyLimits {
+	if v, ok := agent.Get(policyKey); ok {
+		if limits, ok := v.(*policyLimits); ok && limits.agent == agent {
+			return limits
+		}
+	}
+
+	limits := &policyLimits{agent: agent, buckets: make(map[policyRange]*policyBucket)}
+	agent.Set(policyKey, limits)
+	return limits
+}
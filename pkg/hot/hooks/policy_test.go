@@ -0,0 +1,168 @@
+package hooks
+
+import (
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"sync"
+	"testing"
+)
+
+// Agent with the methods used by the policy
+type testAgent struct {
+	interfaces.Agent
+	state   interfaces.State
+	config  configs.ListenerConfig
+	storage sync.Map
+	dropped int
+}
+
+func (agent *testAgent) GetState() interfaces.State                 { return agent.state }
+func (agent *testAgent) GetListenerConfig() *configs.ListenerConfig { return &agent.config }
+func (agent *testAgent) Get(key string) (any, bool)                 { return agent.storage.Load(key) }
+func (agent *testAgent) Set(key string, value any)                  { agent.storage.Store(key, value) }
+func (agent *testAgent) Drop()                                      { agent.dropped++ }
+
+var testPolicy = configs.PolicyConfig{
+	Default: configs.PolicyActionAllow,
+	Rules: []configs.PolicyRuleConfig{
+		{MinMsgID: 1000, MaxMsgID: 1000, Action: configs.PolicyActionAllow, States: []string{configs.PolicyStateHandshaking}},
+		{MinMsgID: 2000, MaxMsgID: 2099, Action: configs.PolicyActionDeny},
+		{MinMsgID: 3000, MaxMsgID: 3999, Action: configs.PolicyActionAllow, States: []string{configs.PolicyStateAuthenticated}, MaxSize: 4},
+	},
+}
+
+func TestCheckPolicy(t *testing.T) {
+	denyAll := configs.PolicyConfig{Default: configs.PolicyActionDeny, Rules: testPolicy.Rules}
+
+	tests := []struct {
+		name   string
+		policy configs.PolicyConfig
+		state  interfaces.State
+		msgID  uint32
+		err    error
+	}{
+		{"no rule", testPolicy, interfaces.StateAuthenticated, 5000, nil},
+		{"default deny", denyAll, interfaces.StateAuthenticated, 5000, ErrDeniedMsgID},
+		{"allowed by rule", denyAll, interfaces.StateHandshaking, 1000, nil},
+		{"denied by rule", testPolicy, interfaces.StateAuthenticated, 2050, ErrDeniedMsgID},
+		{"login after login", testPolicy, interfaces.StateAuthenticated, 1000, ErrBadMsgState},
+		{"before login", testPolicy, interfaces.StateHandshaking, 3000, ErrBadMsgState},
+		{"after login", testPolicy, interfaces.StateAuthenticated, 3999, nil},
+		{"kicked", testPolicy, interfaces.StateDisabled, 3000, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &testAgent{state: tt.state}
+			if err := checkPolicy(agent, tt.policy, codec.Header{MsgID: tt.msgID}); !errors.Is(err, tt.err) {
+				t.Fatalf("checkPolicy(%d) = %v, want %v", tt.msgID, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestLimitPolicy(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []configs.PolicyRuleConfig
+		msgID uint32
+		body  int
+		errs  []error // Results of consecutive messages
+	}{
+		{"no rule", nil, 3000, 8, []error{nil, nil, nil}},
+		{"size", testPolicy.Rules, 3000, 5, []error{ErrBadBodySize}},
+		{"size limit", testPolicy.Rules, 3000, 4, []error{nil}},
+		{"rate", []configs.PolicyRuleConfig{{MinMsgID: 3000, MaxMsgID: 3999, Action: configs.PolicyActionAllow, Rate: 0.001, Burst: 2}}, 3000, 1, []error{nil, nil, ErrRateLimited, ErrRateLimited}},
+		{"rate burst default", []configs.PolicyRuleConfig{{MinMsgID: 3000, MaxMsgID: 3999, Action: configs.PolicyActionAllow, Rate: 1}}, 3500, 1, []error{nil, ErrRateLimited}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := &testAgent{config: configs.DefaultListenerConfig()}
+			agent.config.Policy.Rules = tt.rules
+
+			rateLimited := 0
+			for i, want := range tt.errs {
+				err := limitPolicy(agent, &agent.config, codec.Header{MsgID: tt.msgID}, make([]byte, tt.body))
+				if !errors.Is(err, want) {
+					t.Fatalf("message %d: limitPolicy() = %v, want %v", i, err, want)
+				}
+
+				if errors.Is(err, ErrRateLimited) {
+					rateLimited++
+				}
+			}
+
+			// Rate limited messages are answered and counted as dropped
+			if agent.dropped != rateLimited {
+				t.Fatalf("dropped %d, want %d", agent.dropped, rateLimited)
+			}
+		})
+	}
+}
+
+// Buckets follow their rule across a reload, a resumed agent starts with its own
+func TestPolicyBuckets(t *testing.T) {
+	rule := configs.PolicyRuleConfig{MinMsgID: 3000, MaxMsgID: 3999, Action: configs.PolicyActionAllow, Rate: 0.001, Burst: 1}
+	other := configs.PolicyRuleConfig{MinMsgID: 4000, MaxMsgID: 4999, Action: configs.PolicyActionAllow, Rate: 0.001, Burst: 1}
+
+	agent := &testAgent{config: configs.DefaultListenerConfig()}
+	agent.config.Policy.Rules = []configs.PolicyRuleConfig{rule, other}
+	if err := limitPolicy(agent, &agent.config, codec.Header{MsgID: 3000}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reordered rules keep the spent bucket of 3000-3999 and the full one of 4000-4999
+	agent.config.Policy.Rules = []configs.PolicyRuleConfig{other, rule}
+	if err := limitPolicy(agent, &agent.config, codec.Header{MsgID: 3000}, nil); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("limitPolicy(3000) after reorder = %v, want %v", err, ErrRateLimited)
+	}
+
+	if err := limitPolicy(agent, &agent.config, codec.Header{MsgID: 4000}, nil); err != nil {
+		t.Fatalf("limitPolicy(4000) after reorder = %v", err)
+	}
+
+	// A new limit replaces the bucket
+	agent.config.Policy.Rules[1].Burst = 2
+	if err := limitPolicy(agent, &agent.config, codec.Header{MsgID: 3000}, nil); err != nil {
+		t.Fatalf("limitPolicy(3000) after a new limit = %v", err)
+	}
+
+	// The storage copied to a resumed agent is not shared
+	resumed := &testAgent{config: agent.config}
+	v, _ := agent.Get(policyKey)
+	resumed.Set(policyKey, v)
+	if err := limitPolicy(resumed, &resumed.config, codec.Header{MsgID: 4000}, nil); err != nil {
+		t.Fatalf("limitPolicy(4000) on the resumed agent = %v", err)
+	}
+
+	if getPolicyLimits(resumed) == v {
+		t.Fatal("resumed agent shares the limits of the old agent")
+	}
+}
+
+// Both agents of a resumed session check their messages at once
+func TestPolicyBucketsRace(t *testing.T) {
+	config := configs.DefaultListenerConfig()
+	config.Policy.Rules = []configs.PolicyRuleConfig{{MinMsgID: 3000, MaxMsgID: 3999, Action: configs.PolicyActionAllow, Rate: 1000, Burst: 1000}}
+
+	old := &testAgent{config: config}
+	limitPolicy(old, &old.config, codec.Header{MsgID: 3000}, nil)
+	resumed := &testAgent{config: config}
+	v, _ := old.Get(policyKey)
+	resumed.Set(policyKey, v)
+
+	var wg sync.WaitGroup
+	for _, agent := range []*testAgent{old, resumed} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := uint32(0); i < 500; i++ {
+				limitPolicy(agent, &agent.config, codec.Header{MsgID: 3000 + i}, nil)
+			}
+		}()
+	}
+	wg.Wait()
+}
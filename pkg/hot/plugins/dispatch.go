@@ -0,0 +1,106 @@
+package plugins
+
+import (
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"sync"
+)
+
+// Dispatch: the concurrent middleware runs concurrent messages on a goroutine each. Ordered
+// messages of a connection, or keyed messages of a connection and msgID, wait in a queue
+// drained by one goroutine at a time, the goroutine exits once its queue is empty or the
+// connection is closed. A dispatcher belongs to one agent, a resumed connection gets its own
+
+const (
+	dispatchKey = "dispatch" // Queues of a connection in the agent storage
+	orderedKey  = -1         // Queue of the ordered messages, keyed queues use the msgID
+)
+
+// Queues of one connection, a key is present while a goroutine drains its queue
+type dispatcher struct {
+	sync.Mutex
+	agent  interfaces.Agent
+	queues map[int64][]interfaces.Msg
+	queued int // Messages waiting in all queues
+}
+
+func getDispatcher(agent interfaces.Agent) *dispatcher {
+	// The storage is copied to the agent resuming the session, the copy is not reused
+	if v, ok := agent.Get(dispatchKey); ok {
+		if d, ok := v.(*dispatcher); ok && d.agent == agent {
+			return d
+		}
+	}
+
+	d := &dispatcher{agent: agent, queues: make(map[int64][]interfaces.Msg)}
+	agent.Set(dispatchKey, d)
+	return d
+}
+
+// Key of the queue of a message, false if the message runs on its own goroutine
+func dispatchKeyOf(agent interfaces.Agent, msg interfaces.Msg) (int64, bool) {
+	switch agent.GetListenerConfig().Dispatch.ModeOf(msg.ID) {
+	case configs.DispatchOrdered:
+		return orderedKey, true
+	case configs.DispatchKeyed:
+		return int64(msg.ID), true
+	default:
+		return 0, false
+	}
+}
+
+// Queue a message behind the previous ones with the same key, a full dispatcher answers rate_limited
+// and keeps the connection
+func dispatch(agent interfaces.Agent, msg interfaces.Msg, key int64, next interfaces.EndPoint) error {
+	d := getDispatcher(agent)
+	d.Lock()
+	if d.queued >= agent.GetListenerConfig().Dispatch.MaxQueued {
+		d.Unlock()
+		return ReplyError(agent, msg, ErrorCodeRateLimited, 0)
+	}
+
+	queue, running := d.queues[key]
+	d.queues[key] = append(queue, msg)
+	d.queued++
+	d.Unlock()
+
+	if !running {
+		go d.drain(key, next)
+	}
+
+	return nil
+}
+
+// Run the messages of one queue in order, the rest is dropped once the connection is closed
+func (d *dispatcher) drain(key int64, next interfaces.EndPoint) {
+	for {
+		d.Lock()
+		queue := d.queues[key]
+		if len(queue) == 0 {
+			delete(d.queues, key)
+			d.Unlock()
+			return
+		}
+
+		select {
+		case <-d.agent.Done():
+			delete(d.queues, key)
+			d.queued -= len(queue)
+			d.Unlock()
+
+			for range queue {
+				d.agent.Drop()
+			}
+			return
+		default:
+		}
+
+		msg := queue[0]
+		queue[0] = interfaces.Msg{}
+		d.queues[key] = queue[1:]
+		d.queued--
+		d.Unlock()
+
+		handle(d.agent, msg, next)
+	}
+}
@@ -0,0 +1,247 @@
+package plugins
+
+import (
+	"context"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Agent with the methods used by the dispatch path
+type testAgent struct {
+	interfaces.Agent
+	config  configs.ListenerConfig
+	storage sync.Map
+	ctx     context.Context
+	cancel  context.CancelFunc
+	dropped atomic.Int64
+	replies chan testReply
+}
+
+// Frame written to the client
+type testReply struct {
+	msgID     uint32
+	body      []byte
+	requestID uint32
+}
+
+func newTestAgent(t *testing.T, dispatch configs.DispatchConfig) *testAgent {
+	t.Helper()
+
+	config := configs.DefaultListenerConfig()
+	config.Dispatch = dispatch
+	agent := &testAgent{config: config, replies: make(chan testReply, 16)}
+	agent.ctx, agent.cancel = context.WithCancel(context.Background())
+	t.Cleanup(agent.cancel)
+
+	return agent
+}
+
+func (agent *testAgent) Get(key string) (any, bool) { return agent.storage.Load(key) }
+func (agent *testAgent) Set(key string, value any)  { agent.storage.Store(key, value) }
+func (agent *testAgent) Done() <-chan struct{}      { return agent.ctx.Done() }
+func (agent *testAgent) Drop()                      { agent.dropped.Add(1) }
+func (agent *testAgent) GetCID() string             { return "cid" }
+func (agent *testAgent) Address() string            { return "127.0.0.1" }
+func (agent *testAgent) GetSID() string             { return "sid" }
+
+func (agent *testAgent) GetIdentity() *interfaces.Identity { return nil }
+
+func (agent *testAgent) WriteReply(msgID uint32, body []byte, requestID uint32) error {
+	agent.replies <- testReply{msgID: msgID, body: body, requestID: requestID}
+	return nil
+}
+
+func (agent *testAgent) GetListenerConfig() *configs.ListenerConfig {
+	return &agent.config
+}
+
+// End of the chain recording the handled msgIDs, every message waits for release
+type testEndPoint struct {
+	sync.Mutex
+	ids     []uint32
+	release chan struct{}
+	running atomic.Int32
+	maxRun  atomic.Int32
+}
+
+func (e *testEndPoint) handle(agent interfaces.Agent, msg interfaces.Msg) error {
+	running := e.running.Add(1)
+	defer e.running.Add(-1)
+	for {
+		max := e.maxRun.Load()
+		if running <= max || e.maxRun.CompareAndSwap(max, running) {
+			break
+		}
+	}
+
+	<-e.release
+
+	e.Lock()
+	e.ids = append(e.ids, msg.ID)
+	e.Unlock()
+	return nil
+}
+
+func (e *testEndPoint) handled() []uint32 {
+	e.Lock()
+	defer e.Unlock()
+
+	return slices.Clone(e.ids)
+}
+
+func waitHandled(t *testing.T, e *testEndPoint, n int) []uint32 {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for len(e.handled()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("handled %v, want %d messages", e.handled(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	return e.handled()
+}
+
+func TestDispatchOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		dispatch configs.DispatchConfig
+		ids      []uint32
+		maxRun   int32 // Messages running at once
+	}{
+		{
+			name:     "ordered",
+			dispatch: configs.DispatchConfig{Mode: configs.DispatchOrdered, MaxQueued: 64},
+			ids:      []uint32{1000, 1001, 1000, 1002, 1001, 1000, 1003, 1004, 1005, 1006, 1007, 1008, 1009, 1010, 1011, 1012, 1013, 1014, 1015, 1016},
+			maxRun:   1,
+		},
+		{
+			name: "ordered rule",
+			dispatch: configs.DispatchConfig{Mode: configs.DispatchConcurrent, MaxQueued: 64, Rules: []configs.DispatchRuleConfig{
+				{MinMsgID: 1000, MaxMsgID: 1999, Mode: configs.DispatchOrdered},
+			}},
+			ids:    []uint32{1003, 1002, 1001, 1000},
+			maxRun: 1,
+		},
+		{
+			name:     "keyed",
+			dispatch: configs.DispatchConfig{Mode: configs.DispatchKeyed, MaxQueued: 64},
+			ids:      []uint32{1000, 1001, 1000, 1001, 1000, 1001},
+			maxRun:   2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newTestAgent(t, tt.dispatch)
+			e := &testEndPoint{release: make(chan struct{})}
+			chain := interfaces.Use([]interfaces.Middleware{RateLimitMiddle, ConcurrentMiddle, RateLimitEndMiddle}, e.handle)
+
+			// More messages than the rate limit wait behind a blocked one
+			for _, id := range tt.ids {
+				if err := chain(agent, interfaces.Msg{ID: id}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			close(e.release)
+
+			handled := waitHandled(t, e, len(tt.ids))
+			if dropped := agent.dropped.Load(); dropped != 0 {
+				t.Fatalf("%d messages rate limited", dropped)
+			}
+
+			// Messages of one queue keep their order
+			for _, id := range tt.ids {
+				if tt.dispatch.ModeOf(id) == configs.DispatchKeyed {
+					want := slices.DeleteFunc(slices.Clone(tt.ids), func(other uint32) bool { return other != id })
+					got := slices.DeleteFunc(slices.Clone(handled), func(other uint32) bool { return other != id })
+					if !slices.Equal(got, want) {
+						t.Fatalf("msg %d handled %v, want %v", id, got, want)
+					}
+				}
+			}
+			if tt.maxRun == 1 && !slices.Equal(handled, tt.ids) {
+				t.Fatalf("handled %v, want %v", handled, tt.ids)
+			}
+
+			if maxRun := e.maxRun.Load(); maxRun > tt.maxRun {
+				t.Fatalf("%d messages ran at once, want at most %d", maxRun, tt.maxRun)
+			}
+		})
+	}
+}
+
+func TestDispatchLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		queued  int
+		close   bool
+		handled int
+		dropped int64
+	}{
+		{name: "max queued", queued: 4, handled: 4},
+		{name: "full", queued: 5, handled: 4, dropped: 1},
+		{name: "closed", queued: 4, close: true, handled: 1, dropped: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newTestAgent(t, configs.DispatchConfig{Mode: configs.DispatchOrdered, MaxQueued: 3})
+			e := &testEndPoint{release: make(chan struct{})}
+
+			// The first message runs, the others wait behind it
+			var err error
+			for i := 0; i < tt.queued && err == nil; i++ {
+				err = dispatch(agent, interfaces.Msg{ID: uint32(1000 + i)}, orderedKey, e.handle)
+				if i == 0 {
+					for e.running.Load() == 0 {
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}
+
+			// A message beyond max_queued is answered, the connection is kept
+			if err != nil {
+				t.Fatalf("dispatch() = %v", err)
+			}
+
+			if tt.close {
+				agent.cancel()
+			}
+			close(e.release)
+
+			// Only the running message of a closed connection reaches the endpoint
+			deadline := time.Now().Add(time.Second)
+			for agent.dropped.Load() < tt.dropped && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			if got := len(waitHandled(t, e, tt.handled)); got != tt.handled || agent.dropped.Load() != tt.dropped {
+				t.Fatalf("handled %d dropped %d, want %d and %d", got, agent.dropped.Load(), tt.handled, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestDispatchResume(t *testing.T) {
+	dispatch := configs.DispatchConfig{Mode: configs.DispatchOrdered, MaxQueued: 8}
+	old := newTestAgent(t, dispatch)
+	d := getDispatcher(old)
+
+	// The resumed agent gets the storage of the old one
+	resumed := newTestAgent(t, dispatch)
+	resumed.Set(dispatchKey, d)
+
+	if getDispatcher(resumed) == d {
+		t.Fatal("resumed agent reuses the dispatcher of the old agent")
+	}
+	if getDispatcher(old) != d {
+		t.Fatal("old agent lost its dispatcher")
+	}
+}
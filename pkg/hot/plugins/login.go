@@ -0,0 +1,91 @@
+package plugins
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"gateway/pkg/interfaces"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrLoginRejected = errors.New("login rejected")
+
+// Answer of the service to a login, code 0 accepts it
+type LoginReply struct {
+	Code      int            `json:"code"`
+	UserID    string         `json:"userID"`
+	ExpiresAt int64          `json:"expiresAt"`
+	Claims    map[string]any `json:"claims,omitempty"`
+}
+
+// Ask the service to check a login message, the body is forwarded as is
+func Login(agent interfaces.Agent, msg interfaces.Msg) (interfaces.Identity, error) {
+	config := agent.GetListenerConfig()
+	client := http.Client{
+		Timeout: time.Duration(config.Auth.TimeoutSec) * time.Second,
+	}
+
+	reqMsg, _ := json.Marshal(LuaMsg{
+		ServerID:  agent.GetSID(),
+		ConnID:    agent.GetCID(),
+		MsgID:     msg.ID,
+		Bytes:     base64.StdEncoding.EncodeToString(msg.Body),
+		RequestID: msg.RequestID,
+	})
+
+	form := url.Values{}
+	form.Set("proto_type", "auth")
+	form.Set("msg_id", strconv.FormatUint(uint64(msg.ID), 10))
+	form.Set("msg", string(reqMsg))
+
+	serviceURL := config.Auth.ServiceAPIURL
+	if serviceURL == "" {
+		serviceURL = config.ServiceURL(msg.ID)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, serviceURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return interfaces.Identity{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-Real-IP", agent.Address())
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return interfaces.Identity{}, err
+	}
+	defer resp.Body.Close()
+
+	bytesBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return interfaces.Identity{}, err
+	}
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return interfaces.Identity{}, ErrServiceAPIReturn5xx
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return interfaces.Identity{}, ErrLoginRejected
+	}
+
+	reply := LoginReply{}
+	if err := json.Unmarshal(bytesBody, &reply); err != nil || reply.Code != 0 || reply.UserID == "" {
+		return interfaces.Identity{}, ErrLoginRejected
+	}
+
+	return interfaces.Identity{UserID: reply.UserID, ExpiresAt: reply.ExpiresAt, Claims: reply.Claims}, nil
+}
+
+func userID(agent interfaces.Agent) string {
+	if identity := agent.GetIdentity(); identity != nil {
+		return identity.UserID
+	}
+
+	return ""
+}
@@ -21,18 +21,44 @@ import (
 )
 
 var (
-	PluginsMain = interfaces.Use([]interfaces.Middleware{RateLimitMiddle, ConcurrentMiddle, RateLimitEndMiddle, StressTest, LogMiddle}, ForwadHttp)
+	// Middlewares selectable by name from the listener config
+	middlewares = map[string]interfaces.Middleware{
+		"recover":        RecoverMiddle,
+		"rate_limit":     RateLimitMiddle,
+		"concurrent":     ConcurrentMiddle,
+		"rate_limit_end": RateLimitEndMiddle,
+		"stress_test":    StressTest,
+		"log":            LogMiddle,
+	}
 
 	ErrServiceAPIReturn4xx = errors.New("service api return status code 4xx")
 	ErrServiceAPIReturn5xx = errors.New("service api return status code 5xx")
+	ErrUnknownMiddleware   = errors.New("unknown middleware")
 )
 
 type LuaMsg struct {
 	SequenceID uint32 `json:"sequenceID"`
 	ServerID   string `json:"serverID"`
 	ConnID     string `json:"connID"`
-	MsgID      uint16 `json:"msgID"`
+	MsgID      uint32 `json:"msgID"`
 	Bytes      string `json:"bytes"`
+	RequestID  uint32 `json:"requestID,omitempty"` // Client request ID in correlation mode
+	UserID     string `json:"userID,omitempty"`    // Identity of the login
+}
+
+// Build the middleware chain of a listener, ending with the HTTP forwarder
+func Build(names []string) (interfaces.EndPoint, error) {
+	chain := make([]interfaces.Middleware, 0, len(names))
+	for _, name := range names {
+		middleware, ok := middlewares[name]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownMiddleware, name)
+		}
+
+		chain = append(chain, middleware)
+	}
+
+	return interfaces.Use(chain, ForwadHttp), nil
 }
 
 func RecoverMiddle(next interfaces.EndPoint) interfaces.EndPoint {
@@ -47,7 +73,7 @@ func RecoverMiddle(next interfaces.EndPoint) interfaces.EndPoint {
 	}
 }
 
-// Rate Limiting
+// Rate Limiting, ordered and keyed messages are limited by dispatch.max_queued instead
 func RateLimitMiddle(next interfaces.EndPoint) interfaces.EndPoint {
 	return func(agent interfaces.Agent, msg interfaces.Msg) error {
 		metric.CountPublicTCPRequest.Add(1)
@@ -57,12 +83,11 @@ func RateLimitMiddle(next interfaces.EndPoint) interfaces.EndPoint {
 		}
 
 		v, ok := agent.Get("concurrent")
-		if ok {
+		if _, queued := dispatchKeyOf(agent, msg); ok && !queued {
 			if concurrent, ok := v.(*atomic.Int32); ok {
 				if concurrent.Load() > 10 {
-					// TODO Send client error message indicating flow control
 					utils.AlertAuto(fmt.Sprintf("public tcp service speed limit, conn id: %s client ip: %s", agent.GetCID(), agent.Address()))
-					return nil
+					return ReplyError(agent, msg, ErrorCodeRateLimited, 0)
 				}
 
 				concurrent.Add(1)
@@ -77,31 +102,47 @@ func RateLimitMiddle(next interfaces.EndPoint) interfaces.EndPoint {
 	}
 }
 
-// Concurrent Requests
+// Concurrent Requests, ordered and keyed messages wait for the previous ones
 func ConcurrentMiddle(next interfaces.EndPoint) interfaces.EndPoint {
 	return func(agent interfaces.Agent, msg interfaces.Msg) error {
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-					utils.AlertAuto(fmt.Sprintf("public tcp service panic, conn id: %s client ip: %s msg: %v err: %v stack: %s", agent.GetCID(), agent.Address(), msg, r, string(debug.Stack())))
-				}
-			}()
-			metric.CountPublicHTTPRequest.Add(1)
-
-			if err := next(agent, msg); err != nil {
-				utils.AlertAuto(fmt.Sprintf("public tcp service error, conn id: %s client ip: %s err: %v msg: %v", agent.GetCID(), agent.Address(), err, msg))
-				return
-			}
-		}()
+		if key, ok := dispatchKeyOf(agent, msg); ok {
+			return dispatch(agent, msg, key, next)
+		}
 
+		go handle(agent, msg, next)
 		return nil
 	}
 }
 
+// Run the rest of the chain for one message, failures are answered with an error reply
+func handle(agent interfaces.Agent, msg interfaces.Msg, next interfaces.EndPoint) {
+	defer func() {
+		if r := recover(); r != nil {
+			utils.AlertAuto(fmt.Sprintf("public tcp service panic, conn id: %s client ip: %s msg: %v err: %v stack: %s", agent.GetCID(), agent.Address(), msg, r, string(debug.Stack())))
+		}
+	}()
+	metric.CountPublicHTTPRequest.Add(1)
+
+	if err := next(agent, msg); err != nil {
+		utils.AlertAuto(fmt.Sprintf("public tcp service error, conn id: %s client ip: %s err: %v msg: %v", agent.GetCID(), agent.Address(), err, msg))
+
+		var forwardErr *ForwardError
+		var seq uint32
+		if errors.As(err, &forwardErr) {
+			seq = forwardErr.Seq
+		}
+		ReplyError(agent, msg, errorCode(err), seq)
+	}
+}
+
 // Rate Limiting Ended
 func RateLimitEndMiddle(next interfaces.EndPoint) interfaces.EndPoint {
 	return func(agent interfaces.Agent, msg interfaces.Msg) error {
 		defer func() {
+			if _, queued := dispatchKeyOf(agent, msg); queued {
+				return
+			}
+
 			if v, ok := agent.Get("concurrent"); ok {
 				if concurrent_req, ok := v.(*atomic.Int32); ok {
 					concurrent_req.Add(-1)
@@ -168,18 +209,20 @@ func ForwadHttp(agent interfaces.Agent, msg interfaces.Msg) error {
 		ConnID:     agent.GetCID(),
 		MsgID:      msg.ID,
 		Bytes:      base64.StdEncoding.EncodeToString(msg.Body),
+		RequestID:  msg.RequestID,
+		UserID:     userID(agent),
 	})
 
-	nodeInfoConfig := agent.GetNodeInfoConfig()
+	listenerConfig := agent.GetListenerConfig()
 
 	form := url.Values{}
 	form.Set("proto_type", "stream")
 	form.Set("msg_id", strconv.FormatUint(uint64(msg.ID), 10))
 	form.Set("msg", string(reqMsg))
 
-	req, err := http.NewRequest(http.MethodPost, nodeInfoConfig.ServiceAPIURL, strings.NewReader(form.Encode()))
+	req, err := http.NewRequest(http.MethodPost, listenerConfig.ServiceURL(msg.ID), strings.NewReader(form.Encode()))
 	if err != nil {
-		return err
+		return &ForwardError{Seq: newSeq, Err: err}
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("X-Real-IP", agent.Address())
@@ -187,22 +230,22 @@ func ForwadHttp(agent interfaces.Agent, msg interfaces.Msg) error {
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return err
+		return &ForwardError{Seq: newSeq, Err: err}
 	}
 	defer resp.Body.Close()
 
 	bytesBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return err
+		return &ForwardError{Seq: newSeq, Err: err}
 	}
 
 	if resp.StatusCode != http.StatusOK {
 		if resp.StatusCode >= http.StatusInternalServerError {
-			return ErrServiceAPIReturn5xx
+			return &ForwardError{Seq: newSeq, Err: ErrServiceAPIReturn5xx}
 		}
 
 		if resp.StatusCode >= http.StatusBadRequest {
-			return ErrServiceAPIReturn4xx
+			return &ForwardError{Seq: newSeq, Err: ErrServiceAPIReturn4xx}
 		}
 
 		return nil
@@ -214,8 +257,9 @@ func ForwadHttp(agent interfaces.Agent, msg interfaces.Msg) error {
 	if respLuaMsg.MsgID == 0 {
 		//log.Println("gateway <== php: discard: ", string(bytesBody))
 	} else {
+		// The response carries the ID of the request it answers
 		bytes, _ := base64.StdEncoding.DecodeString(respLuaMsg.Bytes)
-		agent.Write(respLuaMsg.MsgID, bytes)
+		agent.WriteReply(respLuaMsg.MsgID, bytes, msg.RequestID)
 	}
 
 	return nil
@@ -0,0 +1,64 @@
+package plugins
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID uint32
+		answer    bool
+	}{
+		{"request", 42, true},
+		{"no request ID", 0, true},
+		{"no answer", 42, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received := make(chan LuaMsg, 1)
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var msg LuaMsg
+				json.Unmarshal([]byte(r.FormValue("msg")), &msg)
+				received <- msg
+
+				// A message without msgID is not answered to the client
+				var msgID uint32
+				if tt.answer {
+					msgID = msg.MsgID + 1
+				}
+				fmt.Fprintf(w, `{"msgID": %d, "bytes": %q}`, msgID, base64.StdEncoding.EncodeToString([]byte("pong")))
+			}))
+			defer server.Close()
+
+			agent := newTestAgent(t, configs.DispatchConfig{})
+			agent.config.ServiceAPIURL = server.URL
+			if err := ForwadHttp(agent, interfaces.Msg{ID: 2000, Body: []byte("ping"), RequestID: tt.requestID}); err != nil {
+				t.Fatal(err)
+			}
+
+			if msg := <-received; msg.RequestID != tt.requestID || msg.MsgID != 2000 {
+				t.Fatalf("service got msgID %d request ID %d, want 2000 and %d", msg.MsgID, msg.RequestID, tt.requestID)
+			}
+
+			select {
+			case reply := <-agent.replies:
+				if !tt.answer || reply.msgID != 2001 || string(reply.body) != "pong" || reply.requestID != tt.requestID {
+					t.Fatalf("reply %+v, want 2001 pong with request ID %d", reply, tt.requestID)
+				}
+			default:
+				if tt.answer {
+					t.Fatal("no reply")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package plugins
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/metric"
+	"net"
+)
+
+const (
+	ErrorCodeRateLimited        = "rate_limited"
+	ErrorCodeBackendUnavailable = "backend_unavailable"
+	ErrorCodeBackendError       = "backend_error"
+	ErrorCodeTimeout            = "timeout"
+)
+
+// Codes of the binary format
+var errorCodes = map[string]uint16{
+	ErrorCodeRateLimited:        1,
+	ErrorCodeBackendUnavailable: 2,
+	ErrorCodeBackendError:       3,
+	ErrorCodeTimeout:            4,
+}
+
+// Body of an error frame in json format
+type ErrorMsg struct {
+	Code       string `json:"code"`
+	MsgID      uint32 `json:"msgID"`               // MsgID of the failed message
+	SequenceID uint32 `json:"sequenceID"`          // Sequence ID sent to the service, 0 if it was not forwarded
+	RequestID  uint32 `json:"requestID,omitempty"` // Client request ID in correlation mode
+}
+
+// Failed forward, Seq is the sequence ID sent to the service
+type ForwardError struct {
+	Seq uint32
+	Err error
+}
+
+func (e *ForwardError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ForwardError) Unwrap() error {
+	return e.Err
+}
+
+func errorCode(err error) string {
+	if errors.Is(err, ErrServiceAPIReturn4xx) || errors.Is(err, ErrServiceAPIReturn5xx) {
+		return ErrorCodeBackendError
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) && netError.Timeout() {
+		return ErrorCodeTimeout
+	}
+
+	return ErrorCodeBackendUnavailable
+}
+
+// Tell the client a message was not handled, the frame answers msg in correlation mode
+func ReplyError(agent interfaces.Agent, msg interfaces.Msg, code string, seq uint32) error {
+	metric.CountErrorReply.Add(code, 1)
+	agent.Drop()
+
+	config := agent.GetListenerConfig().ErrorReply
+	if config.MsgID == 0 {
+		return nil
+	}
+
+	var body []byte
+	if config.Format == configs.ErrorFormatBinary {
+		// code uint16, msgID uint32, sequenceID uint32, requestID uint32, little-endian
+		body = make([]byte, 0, 14)
+		body = binary.LittleEndian.AppendUint16(body, errorCodes[code])
+		body = binary.LittleEndian.AppendUint32(body, msg.ID)
+		body = binary.LittleEndian.AppendUint32(body, seq)
+		body = binary.LittleEndian.AppendUint32(body, msg.RequestID)
+	} else {
+		body, _ = json.Marshal(ErrorMsg{
+			Code:       code,
+			MsgID:      msg.ID,
+			SequenceID: seq,
+			RequestID:  msg.RequestID,
+		})
+	}
+
+	return agent.WriteReply(config.MsgID, body, msg.RequestID)
+}
@@ -0,0 +1,91 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"gateway/pkg/configs"
+	"gateway/pkg/interfaces"
+	"gateway/pkg/metric"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestReplyError(t *testing.T) {
+	msg := interfaces.Msg{ID: 2000, RequestID: 42}
+	tests := []struct {
+		name   string
+		format string
+		code   string
+		msg    interfaces.Msg
+		seq    uint32
+		body   string
+	}{
+		{"json", configs.ErrorFormatJSON, ErrorCodeTimeout, msg, 7, `{"code":"timeout","msgID":2000,"sequenceID":7,"requestID":42}`},
+		{"json without request ID", configs.ErrorFormatJSON, ErrorCodeRateLimited, interfaces.Msg{ID: 2000}, 0, `{"code":"rate_limited","msgID":2000,"sequenceID":0}`},
+		{"binary", configs.ErrorFormatBinary, ErrorCodeTimeout, msg, 7, "\x04\x00\xd0\x07\x00\x00\x07\x00\x00\x00\x2a\x00\x00\x00"},
+		{"binary rate limited", configs.ErrorFormatBinary, ErrorCodeRateLimited, interfaces.Msg{ID: 70000}, 0, "\x01\x00\x70\x11\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00"},
+		{"binary backend unavailable", configs.ErrorFormatBinary, ErrorCodeBackendUnavailable, msg, 0, "\x02\x00\xd0\x07\x00\x00\x00\x00\x00\x00\x2a\x00\x00\x00"},
+		{"binary backend error", configs.ErrorFormatBinary, ErrorCodeBackendError, msg, 1, "\x03\x00\xd0\x07\x00\x00\x01\x00\x00\x00\x2a\x00\x00\x00"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			agent := newTestAgent(t, configs.DispatchConfig{})
+			agent.config.ErrorReply = configs.ErrorReplyConfig{MsgID: 9001, Format: tt.format}
+			before := metric.CountErrorReply.Out()[tt.code]
+
+			if err := ReplyError(agent, tt.msg, tt.code, tt.seq); err != nil {
+				t.Fatal(err)
+			}
+
+			reply := <-agent.replies
+			if reply.msgID != 9001 || string(reply.body) != tt.body || reply.requestID != tt.msg.RequestID {
+				t.Fatalf("reply %d %q request ID %d, want 9001 %q %d", reply.msgID, reply.body, reply.requestID, tt.body, tt.msg.RequestID)
+			}
+
+			// The failed message is dropped and counted by code
+			if agent.dropped.Load() != 1 || metric.CountErrorReply.Out()[tt.code]-before != 1 {
+				t.Fatalf("dropped %d, counted %d", agent.dropped.Load(), metric.CountErrorReply.Out()[tt.code]-before)
+			}
+		})
+	}
+}
+
+func TestReplyErrorDisabled(t *testing.T) {
+	agent := newTestAgent(t, configs.DispatchConfig{})
+	if err := ReplyError(agent, interfaces.Msg{ID: 2000}, ErrorCodeTimeout, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(agent.replies) != 0 || agent.dropped.Load() != 1 {
+		t.Fatalf("%d replies, dropped %d, want none and 1", len(agent.replies), agent.dropped.Load())
+	}
+}
+
+func TestErrorCode(t *testing.T) {
+	timeout := &url.Error{Op: "Post", URL: "http://service", Err: os.ErrDeadlineExceeded}
+	refused := &url.Error{Op: "Post", URL: "http://service", Err: syscall.ECONNREFUSED}
+
+	tests := []struct {
+		name string
+		err  error
+		code string
+	}{
+		{"4xx", &ForwardError{Seq: 1, Err: ErrServiceAPIReturn4xx}, ErrorCodeBackendError},
+		{"5xx", &ForwardError{Seq: 1, Err: ErrServiceAPIReturn5xx}, ErrorCodeBackendError},
+		{"timeout", &ForwardError{Seq: 1, Err: timeout}, ErrorCodeTimeout},
+		{"refused", &ForwardError{Seq: 1, Err: refused}, ErrorCodeBackendUnavailable},
+		{"wrapped", fmt.Errorf("forward: %w", &ForwardError{Err: ErrServiceAPIReturn5xx}), ErrorCodeBackendError},
+		{"other", errors.New("bad url"), ErrorCodeBackendUnavailable},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code := errorCode(tt.err); code != tt.code {
+				t.Fatalf("errorCode(%v) = %s, want %s", tt.err, code, tt.code)
+			}
+		})
+	}
+}
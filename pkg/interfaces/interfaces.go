@@ -1,29 +1,95 @@
 package interfaces
 
-import "gateway/pkg/configs"
+import (
+	"crypto/ed25519"
+	"gateway/pkg/codec"
+	"gateway/pkg/configs"
+	"time"
+)
 
 type Msg struct {
-	ID   uint16
-	Body []byte
+	ID        uint32
+	Body      []byte
+	RequestID uint32 // Client request ID in correlation mode
+}
+
+// Traffic of a connection, messages only count data frames
+type Traffic struct {
+	BytesIn     int64 `json:"bytesIn"`
+	BytesOut    int64 `json:"bytesOut"`
+	MsgsIn      int64 `json:"msgsIn"`
+	MsgsOut     int64 `json:"msgsOut"`
+	Dropped     int64 `json:"dropped"`     // Messages not handled or not sent
+	ConnectedAt int64 `json:"connectedAt"` // Unix milliseconds
+	LastActive  int64 `json:"lastActive"`  // Unix milliseconds of the last frame received or sent
+}
+
+// Connection state, see agent.setState for the allowed transitions
+type State int32
+
+const (
+	StateAccepted      State = iota // Created, not running yet
+	StateHandshaking                // Running, no valid data frame yet
+	StateAuthenticated              // Logged in, or a valid data frame was received on listeners without login
+	StateDisabled                   // Kicked, messages are no longer forwarded
+	StateClosing                    // The connection is being torn down
+	StateClosed
+)
+
+var stateNames = [...]string{"accepted", "handshaking", "authenticated", "disabled", "closing", "closed"}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return "unknown"
+	}
+
+	return stateNames[s]
+}
+
+// Identity of a connection that passed the login
+type Identity struct {
+	UserID    string         `json:"userID"`
+	ExpiresAt int64          `json:"expiresAt"` // Unix seconds, 0 if unknown
+	Claims    map[string]any `json:"claims,omitempty"`
 }
 
 type Gateway interface {
 	GenerateAgentUID() string
 	RemoveAgent(string) Agent
+	GetAgent(string) Agent
+	ReplaceAgent(string, Agent, Agent) bool
+}
+
+type Listener interface {
+	GetConfig() *configs.ListenerConfig // Never modified, replaced as a whole on reload
+	GetPipeline() EndPoint
+	GetServerKey() ed25519.PrivateKey // nil unless the listener is secure
+	GetAuthKey() []byte               // nil unless tokens are checked by the gateway
+	GetCodec() codec.FrameCodec
 }
 
 type Agent interface {
 	Close()
+	Done() <-chan struct{} // Closed once the connection is closed
 	Enable()
 	Disable()
-	Write(uint16, []byte) error
+	Write(uint32, []byte) error
+	WriteReply(uint32, []byte, uint32) error
 	Get(string) (any, bool)
 	Set(string, any)
 	Address() string
 	GetSID() string
 	GetCID() string
+	GetRTT() time.Duration
+	GetTraffic() Traffic
+	Drop()
+	SetBandwidth(int, int)
+	GetState() State
+	GetIdentity() *Identity
+	GetMsgIndex() uint32 // Index of the inbound message being handled, only valid in hooks
 	GetDiscoveryConfig() configs.DiscoveryConfig
 	GetNodeInfoConfig() configs.NodeInfoConfig
+	GetListenerConfig() *configs.ListenerConfig // Shared, must not be modified
 }
 
 // service discovery
@@ -31,8 +97,13 @@ type RegiserCallback func() error
 type GetMetaData func() (string, error)
 
 // hook
-type HookHeader func(Agent, []byte) error
-type HookBody func(Agent, []byte, []byte) error
+type HookHeader func(Agent, codec.Header) error
+type HookBody func(Agent, codec.Header, []byte) error
+
+// lifecycle
+type OnConnect func(Agent)
+type OnStateChange func(agent Agent, from State, to State)
+type OnClose func(Agent)
 
 // plugin & middleware
 type EndPoint func(Agent, Msg) error
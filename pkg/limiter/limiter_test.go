@@ -0,0 +1,83 @@
+package limiter
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    float64
+		burst   int
+		n       []int // Tokens asked at once
+		allowed []bool
+	}{
+		{"burst", 0.001, 3, []int{1, 1, 1, 1}, []bool{true, true, true, false}},
+		{"min burst", 0.001, 0, []int{1, 1}, []bool{true, false}},
+		{"batch", 0.001, 3, []int{2, 2, 1}, []bool{true, false, true}},
+		{"batch over burst", 0.001, 3, []int{4, 3}, []bool{false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBucket(tt.rate, tt.burst)
+			for i, n := range tt.n {
+				if got := b.AllowN(n); got != tt.allowed[i] {
+					t.Fatalf("AllowN(%d) #%d = %v, want %v", n, i, got, tt.allowed[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRefill(t *testing.T) {
+	b := NewBucket(100, 2)
+	if !b.AllowN(2) || b.Allow() {
+		t.Fatal("burst not spent")
+	}
+
+	// Refilled up to the burst only
+	b.refill(b.last.Add(time.Second))
+	if b.tokens != 2 {
+		t.Fatalf("tokens %v after a second, want 2", b.tokens)
+	}
+
+	var unlimited *Bucket
+	if !unlimited.AllowN(1000) {
+		t.Fatal("nil bucket refused")
+	}
+}
+
+func TestTake(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		n     []int           // Tokens taken in a row
+		waits []time.Duration // Debt to wait for after each take
+	}{
+		{"within burst", 1000, 100, []int{50, 50}, []time.Duration{0, 0}},
+		{"debt", 1000, 100, []int{100, 50, 50}, []time.Duration{0, 50 * time.Millisecond, 100 * time.Millisecond}},
+		{"over burst", 1000, 100, []int{300}, []time.Duration{200 * time.Millisecond}},
+		{"no rate", 0, 100, []int{300}, []time.Duration{0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewBucket(tt.rate, tt.burst)
+			for i, n := range tt.n {
+				// The bucket refills while the test runs, allow a few milliseconds
+				wait := b.Take(n)
+				if wait > tt.waits[i] || wait < tt.waits[i]-5*time.Millisecond {
+					t.Fatalf("Take(%d) #%d = %v, want %v", n, i, wait, tt.waits[i])
+				}
+			}
+		})
+	}
+
+	var unlimited *Bucket
+	if wait := unlimited.Take(1 << 20); wait != 0 {
+		t.Fatalf("nil bucket Take() = %v", wait)
+	}
+}
@@ -22,6 +22,14 @@ var (
 	CountPublicTCPRequest   atomic.Int64 // agent TCP Request Count
 	CountPublicHTTPRequest  atomic.Int64 // agent HTTP Request Count
 	CountPrivateHTTPRequest atomic.Int64 // private Request Count
+	CountRejectConnection   ProtoCount   // Rejected connection count by reason
+	CountSession            ProtoCount   // Session resume events by result
+	CountErrorReply         ProtoCount   // Messages not handled by error code
+	CountCompression        ProtoCount   // Raw and compressed bytes of compressed bodies by direction
+	CountTraffic            ProtoCount   // Bytes and messages of all connections by direction, dropped messages
+	CountLogin              ProtoCount   // Logins by result
+	CountReplay             ProtoCount   // Rejected inbound sequence numbers by reason
+	CountPolicy             ProtoCount   // Messages rejected by the msgID policy by reason
 	CountGoroutine          atomic.Uint64
 	CountFreeMemory         atomic.Uint64
 	CountReleasedMemory     atomic.Uint64
@@ -32,11 +40,13 @@ var (
 
 	P99PublicHTTPRequestLatency  ProtoP99 = ProtoP99{} // public http Request Duration p99
 	P99PrivateHTTPRequestLatency ProtoP99 = ProtoP99{} // private http Request Duration p99
+	P99HeartbeatRTT              ProtoP99 = ProtoP99{} // heartbeat round trip time p99 by listener
 
 	Buckets = []int64{1, 5, 10, 20, 50, 100, 150, 200, 250, 300, 400, 500, 1000, 2000, 5000, 10000, 9999999999} // 毫秒
 )
 
 type ProtoP99 sync.Map
+type ProtoCount sync.Map
 
 type P99 struct {
 	count   atomic.Int64
@@ -135,6 +145,51 @@ func (pp99 *ProtoP99) Reset() {
 	})
 }
 
+func (pc *ProtoCount) Add(proto string, delta int64) {
+	p := (*sync.Map)(pc)
+	v, ok := p.Load(proto)
+	if !ok {
+		v, _ = p.LoadOrStore(proto, new(atomic.Int64))
+	}
+
+	v.(*atomic.Int64).Add(delta)
+}
+
+func (pc *ProtoCount) Out() map[string]int64 {
+	p := (*sync.Map)(pc)
+	ret := make(map[string]int64)
+
+	p.Range(func(k, v any) bool {
+		if vv := v.(*atomic.Int64).Load(); vv > 0 {
+			ret[k.(string)] = vv
+		}
+		return true
+	})
+
+	return ret
+}
+
+func (pc *ProtoCount) Reset() {
+	p := (*sync.Map)(pc)
+	p.Range(func(k, v any) bool {
+		v.(*atomic.Int64).Store(0)
+		return true
+	})
+}
+
+// Compressed size over raw size by direction
+func compressionRatio() map[string]string {
+	counts := CountCompression.Out()
+	ret := make(map[string]string)
+	for _, direction := range []string{"in", "out"} {
+		if raw := counts[direction+"_raw"]; raw > 0 {
+			ret[direction] = fmt.Sprintf("%.2f", float64(counts[direction+"_compressed"])/float64(raw))
+		}
+	}
+
+	return ret
+}
+
 func getRuntume() {
 	// 定义要获取的指标
 	metricsList := []string{
@@ -229,6 +284,15 @@ uptime: %s
 count connection: %d
 count public tcp request qps: %d
 count private http request qps: %d
+count reject connection: %v
+count session: %v
+count error reply: %v
+count compression: %v
+compression ratio: %v
+count traffic: %v
+count login: %v
+count replay: %v
+count policy: %v
 count goroutine: %d
 count free memory: %d
 count released memory: %d
@@ -238,12 +302,22 @@ count total memory: %d
 count objects memory: %d
 count tcp status: %v
 p99 public http request latency: %v
-p99 private http request latency: %v`,
+p99 private http request latency: %v
+p99 heartbeat rtt: %v`,
 		time.Now().UnixMilli(),
 		time.Since(StartTime).String(),
 		CountConnection.Load(),
 		CountPublicTCPRequest.Load()/interval,
 		CountPrivateHTTPRequest.Load()/interval,
+		CountRejectConnection.Out(),
+		CountSession.Out(),
+		CountErrorReply.Out(),
+		CountCompression.Out(),
+		compressionRatio(),
+		CountTraffic.Out(),
+		CountLogin.Out(),
+		CountReplay.Out(),
+		CountPolicy.Out(),
 		CountGoroutine.Load(),
 		CountFreeMemory.Load(),
 		CountReleasedMemory.Load(),
@@ -253,7 +327,8 @@ p99 private http request latency: %v`,
 		CountObjectsMemory.Load(),
 		lastTCPStatus,
 		P99PublicHTTPRequestLatency.Out(),
-		P99PrivateHTTPRequestLatency.Out())
+		P99PrivateHTTPRequestLatency.Out(),
+		P99HeartbeatRTT.Out())
 
 	// 清理
 	reset()
@@ -297,6 +372,14 @@ func Report(intervalSec int) {
 func reset() {
 	CountPublicTCPRequest.Store(0)
 	CountPrivateHTTPRequest.Store(0)
+	CountRejectConnection.Reset()
+	CountSession.Reset()
+	CountErrorReply.Reset()
+	CountCompression.Reset()
+	CountTraffic.Reset()
+	CountLogin.Reset()
+	CountReplay.Reset()
+	CountPolicy.Reset()
 	CountGoroutine.Store(0)
 	CountFreeMemory.Store(0)
 	CountReleasedMemory.Store(0)
@@ -306,4 +389,5 @@ func reset() {
 	CountObjectsMemory.Store(0)
 	P99PublicHTTPRequestLatency.Reset()
 	P99PrivateHTTPRequestLatency.Reset()
+	P99HeartbeatRTT.Reset()
 }
@@ -0,0 +1,55 @@
+package netpoll
+
+import (
+	"errors"
+	"fmt"
+	"gateway/pkg/utils"
+	"runtime/debug"
+)
+
+var (
+	ErrUnsupported = errors.New("netpoll is not supported on this platform")
+	ErrClosed      = errors.New("netpoll handle is closed")
+)
+
+// Worker pool running the readable callbacks and other short tasks
+type workers struct {
+	tasks chan func()
+}
+
+func newWorkers(num int, queueSize int) *workers {
+	w := &workers{
+		tasks: make(chan func(), queueSize),
+	}
+
+	for i := 0; i < num; i++ {
+		go w.loop()
+	}
+	return w
+}
+
+func (w *workers) loop() {
+	for task := range w.tasks {
+		w.run(task)
+	}
+}
+
+// Queue a task without blocking, a full queue runs it on its own goroutine so the
+// epoll loop keeps serving the other connections
+func (w *workers) submit(task func()) {
+	select {
+	case w.tasks <- task:
+	default:
+		go w.run(task)
+	}
+}
+
+func (w *workers) run(task func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			utils.AlertAuto(fmt.Sprintf("netpoll worker panic: %v stack: %s", err, string(debug.Stack())))
+		}
+	}()
+
+	task()
+}
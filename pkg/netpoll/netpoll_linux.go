@@ -0,0 +1,209 @@
+//go:build linux
+
+package netpoll
+
+import (
+	"errors"
+	"fmt"
+	"gateway/pkg/utils"
+	"runtime/debug"
+	"sync"
+	"syscall"
+)
+
+const (
+	maxEvents = 1024
+	// One event per registration until Rearm, so a connection is never handled by two workers
+	readEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+)
+
+// Epoll instance waking workers when a registered connection becomes readable
+type Poller struct {
+	sync.Mutex
+
+	epfd    int
+	handles map[int]*Handle
+	workers *workers
+	closed  bool
+}
+
+// Registration of one connection
+type Handle struct {
+	sync.Mutex
+
+	poller     *Poller
+	raw        syscall.RawConn
+	fd         int
+	onReadable func(*Handle)
+	closed     bool
+	serial     sync.Mutex // Orders callbacks of the handle for the memory model, never contended
+}
+
+func New(workerNum int, queueSize int) (*Poller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Poller{
+		epfd:    epfd,
+		handles: make(map[int]*Handle),
+		workers: newWorkers(workerNum, queueSize),
+	}
+
+	go p.loop()
+	return p, nil
+}
+
+func (p *Poller) loop() {
+	defer func() {
+		if err := recover(); err != nil {
+			utils.AlertPanic(fmt.Sprintf("netpoll loop panic: %v stack: %s", err, string(debug.Stack())))
+		}
+	}()
+
+	events := make([]syscall.EpollEvent, maxEvents)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+
+			p.Lock()
+			closed := p.closed
+			p.Unlock()
+			if closed {
+				return
+			}
+
+			utils.AlertPanic(fmt.Sprintf("netpoll wait fail: %v", err))
+		}
+
+		for i := 0; i < n; i++ {
+			p.Lock()
+			h, ok := p.handles[int(events[i].Fd)]
+			p.Unlock()
+
+			if ok {
+				p.Submit(h.readable)
+			}
+		}
+	}
+}
+
+// Watch a connection, onReadable runs on a worker and must call Rearm to get the next event
+func (p *Poller) Register(raw syscall.RawConn, onReadable func(*Handle)) (*Handle, error) {
+	h := &Handle{
+		poller:     p,
+		raw:        raw,
+		onReadable: onReadable,
+	}
+
+	var ctlErr error
+	err := raw.Control(func(fd uintptr) {
+		h.fd = int(fd)
+
+		p.Lock()
+		defer p.Unlock()
+
+		if p.closed {
+			ctlErr = ErrClosed
+			return
+		}
+
+		p.handles[h.fd] = h
+		ctlErr = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, h.fd, &syscall.EpollEvent{Events: readEvents, Fd: int32(h.fd)})
+		if ctlErr != nil {
+			delete(p.handles, h.fd)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if ctlErr != nil {
+		return nil, ctlErr
+	}
+
+	return h, nil
+}
+
+// Run a task on the worker pool, never blocks
+func (p *Poller) Submit(task func()) {
+	p.workers.submit(task)
+}
+
+func (p *Poller) Close() {
+	p.Lock()
+	if p.closed {
+		p.Unlock()
+		return
+	}
+	p.closed = true
+	p.Unlock()
+
+	syscall.Close(p.epfd)
+}
+
+func (h *Handle) readable() {
+	h.serial.Lock()
+	defer h.serial.Unlock()
+
+	h.onReadable(h)
+}
+
+// Ask for the next readable event
+func (h *Handle) Rearm() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.closed {
+		return ErrClosed
+	}
+
+	return syscall.EpollCtl(h.poller.epfd, syscall.EPOLL_CTL_MOD, h.fd, &syscall.EpollEvent{Events: readEvents, Fd: int32(h.fd)})
+}
+
+// Non-blocking read, returns syscall.EAGAIN when nothing is buffered
+func (h *Handle) Read(p []byte) (int, error) {
+	var n int
+	var readErr error
+	err := h.raw.Read(func(fd uintptr) bool {
+		n, readErr = syscall.Read(int(fd), p)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if n < 0 {
+		n = 0
+	}
+	return n, readErr
+}
+
+// Stop watching, must be called before the connection is closed
+func (h *Handle) Close() error {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+
+	p := h.poller
+	p.Lock()
+	defer p.Unlock()
+
+	if p.handles[h.fd] == h {
+		delete(p.handles, h.fd)
+	}
+
+	return syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, h.fd, nil)
+}
+
+func IsAgain(err error) bool {
+	return errors.Is(err, syscall.EAGAIN)
+}
@@ -0,0 +1,209 @@
+package netpoll
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Registered server end of a TCP connection, reads are handed to the test
+func newTestHandle(t *testing.T, p *Poller) (net.Conn, chan *Handle, *Handle) {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+
+	raw, err := server.(syscall.Conn).SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readable := make(chan *Handle, 8)
+	h, err := p.Register(raw, func(h *Handle) { readable <- h })
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	return client, readable, h
+}
+
+func newTestPoller(t *testing.T) *Poller {
+	t.Helper()
+
+	p, err := New(2, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+func waitReadable(t *testing.T, readable chan *Handle) *Handle {
+	t.Helper()
+
+	select {
+	case h := <-readable:
+		return h
+	case <-time.After(time.Second):
+		t.Fatal("no readable event")
+		return nil
+	}
+}
+
+func noReadable(t *testing.T, readable chan *Handle) {
+	t.Helper()
+
+	select {
+	case <-readable:
+		t.Fatal("unexpected readable event")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestReadable(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		reads  []int // Bytes read per wakeup, the handle is rearmed after each
+	}{
+		{"one write", []string{"hello"}, []int{5}},
+		{"partial reads", []string{"hello world"}, []int{5, 6}},
+		{"coalesced writes", []string{"ab", "cd"}, []int{4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, readable, _ := newTestHandle(t, newTestPoller(t))
+			for _, w := range tt.writes {
+				if _, err := client.Write([]byte(w)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+
+			for _, size := range tt.reads {
+				h := waitReadable(t, readable)
+				buf := make([]byte, size)
+				if n, err := h.Read(buf); n != size || err != nil {
+					t.Fatalf("Read() = %d, %v, want %d", n, err, size)
+				}
+
+				// One shot: no event until the handle is rearmed
+				noReadable(t, readable)
+				if err := h.Rearm(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Everything was read, the rearmed handle stays quiet
+			noReadable(t, readable)
+		})
+	}
+}
+
+func TestRearmAfterAgain(t *testing.T) {
+	client, readable, h := newTestHandle(t, newTestPoller(t))
+
+	if _, err := h.Read(make([]byte, 16)); !IsAgain(err) {
+		t.Fatalf("Read() on an empty socket = %v, want EAGAIN", err)
+	}
+
+	if err := h.Rearm(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 16)
+	if n, err := waitReadable(t, readable).Read(buf); err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+}
+
+func TestHandleClose(t *testing.T) {
+	p := newTestPoller(t)
+	client, readable, h := newTestHandle(t, p)
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatalf("second Close() = %v", err)
+	}
+
+	if err := h.Rearm(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Rearm() after Close = %v, want %v", err, ErrClosed)
+	}
+
+	client.Write([]byte("ignored"))
+	noReadable(t, readable)
+
+	// The peer closing is readable too, but the handle is gone
+	client.Close()
+	noReadable(t, readable)
+
+	p.Close()
+	if _, err := p.Register(h.raw, func(*Handle) {}); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Register() after Close = %v, want %v", err, ErrClosed)
+	}
+}
+
+func TestPeerClose(t *testing.T) {
+	client, readable, _ := newTestHandle(t, newTestPoller(t))
+	client.Close()
+
+	if n, err := waitReadable(t, readable).Read(make([]byte, 16)); n != 0 || err != nil {
+		t.Fatalf("Read() after the peer closed = %d, %v, want 0, nil", n, err)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	p := newTestPoller(t)
+
+	// Tasks beyond the queue run on their own goroutine instead of blocking
+	release := make(chan struct{})
+	done := make(chan int, 16)
+	for i := 0; i < 16; i++ {
+		p.Submit(func() {
+			<-release
+			done <- i
+		})
+	}
+
+	finished := make(chan struct{})
+	p.Submit(func() { close(finished) })
+	close(release)
+
+	for i := 0; i < 16; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("%d tasks done, want 16", i)
+		}
+	}
+	<-finished
+}
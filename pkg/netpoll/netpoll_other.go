@@ -0,0 +1,40 @@
+//go:build !linux
+
+package netpoll
+
+import "syscall"
+
+type Poller struct{}
+
+type Handle struct{}
+
+func New(workerNum int, queueSize int) (*Poller, error) {
+	return nil, ErrUnsupported
+}
+
+func (p *Poller) Register(raw syscall.RawConn, onReadable func(*Handle)) (*Handle, error) {
+	return nil, ErrUnsupported
+}
+
+func (p *Poller) Submit(task func()) {
+	go task()
+}
+
+func (p *Poller) Close() {
+}
+
+func (h *Handle) Rearm() error {
+	return ErrUnsupported
+}
+
+func (h *Handle) Read(p []byte) (int, error) {
+	return 0, ErrUnsupported
+}
+
+func (h *Handle) Close() error {
+	return nil
+}
+
+func IsAgain(err error) bool {
+	return false
+}
@@ -0,0 +1,139 @@
+package registry
+
+import (
+	"gateway/pkg/interfaces"
+	"sync"
+	"sync/atomic"
+)
+
+const shardCount = 64 // Power of 2
+
+type shard struct {
+	sync.RWMutex
+	agents map[string]interfaces.Agent
+}
+
+// Agent registry split into shards, each shard has its own lock
+type Registry struct {
+	shards [shardCount]*shard
+	count  atomic.Int64
+}
+
+func New() *Registry {
+	r := new(Registry)
+	for i := range r.shards {
+		r.shards[i] = &shard{agents: make(map[string]interfaces.Agent)}
+	}
+	return r
+}
+
+// FNV-1a without allocation
+func (r *Registry) shard(id string) *shard {
+	var h uint32 = 2166136261
+	for i := 0; i < len(id); i++ {
+		h ^= uint32(id[i])
+		h *= 16777619
+	}
+
+	return r.shards[h&(shardCount-1)]
+}
+
+// Returns false if the id is already registered
+func (r *Registry) Add(id string, agent interfaces.Agent) bool {
+	s := r.shard(id)
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.agents[id]; ok {
+		return false
+	}
+
+	s.agents[id] = agent
+	r.count.Add(1)
+
+	return true
+}
+
+func (r *Registry) Remove(id string) interfaces.Agent {
+	s := r.shard(id)
+	s.Lock()
+	defer s.Unlock()
+
+	agent, ok := s.agents[id]
+	if !ok {
+		return nil
+	}
+
+	delete(s.agents, id)
+	r.count.Add(-1)
+
+	return agent
+}
+
+// Register agent in place of old, returns false if id is not registered to old
+func (r *Registry) Replace(id string, old interfaces.Agent, agent interfaces.Agent) bool {
+	s := r.shard(id)
+	s.Lock()
+	defer s.Unlock()
+
+	if current, ok := s.agents[id]; !ok || current != old {
+		return false
+	}
+
+	s.agents[id] = agent
+
+	return true
+}
+
+func (r *Registry) Get(id string) interfaces.Agent {
+	s := r.shard(id)
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.agents[id]
+}
+
+func (r *Registry) Len() int {
+	return int(r.count.Load())
+}
+
+// Visit every agent until fn returns false, fn runs without holding any lock
+// and only one shard is locked at a time while it is copied
+func (r *Registry) Range(fn func(id string, agent interfaces.Agent) bool) {
+	ids := make([]string, 0, 64)
+	agents := make([]interfaces.Agent, 0, 64)
+
+	for _, s := range r.shards {
+		ids = ids[:0]
+		agents = agents[:0]
+
+		s.RLock()
+		for id, agent := range s.agents {
+			ids = append(ids, id)
+			agents = append(agents, agent)
+		}
+		s.RUnlock()
+
+		for i := range ids {
+			if !fn(ids[i], agents[i]) {
+				return
+			}
+		}
+	}
+}
+
+// Remove every agent and return them
+func (r *Registry) Clear() []interfaces.Agent {
+	ret := make([]interfaces.Agent, 0, r.Len())
+	for _, s := range r.shards {
+		s.Lock()
+		for _, agent := range s.agents {
+			ret = append(ret, agent)
+		}
+		r.count.Add(-int64(len(s.agents)))
+		s.agents = make(map[string]interfaces.Agent)
+		s.Unlock()
+	}
+
+	return ret
+}
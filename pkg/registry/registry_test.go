@@ -0,0 +1,337 @@
+package registry
+
+import (
+	"gateway/pkg/interfaces"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// The registry used before sharding: one map behind one RWMutex
+type lockedMap struct {
+	sync.RWMutex
+	agents map[string]interfaces.Agent
+}
+
+func newLockedMap() *lockedMap {
+	return &lockedMap{agents: make(map[string]interfaces.Agent)}
+}
+
+func (m *lockedMap) Add(id string, agent interfaces.Agent) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	if _, ok := m.agents[id]; ok {
+		return false
+	}
+	m.agents[id] = agent
+
+	return true
+}
+
+func (m *lockedMap) Remove(id string) interfaces.Agent {
+	m.Lock()
+	defer m.Unlock()
+
+	agent := m.agents[id]
+	delete(m.agents, id)
+
+	return agent
+}
+
+func (m *lockedMap) Get(id string) interfaces.Agent {
+	m.RLock()
+	defer m.RUnlock()
+
+	return m.agents[id]
+}
+
+func (m *lockedMap) Range(fn func(id string, agent interfaces.Agent) bool) {
+	m.RLock()
+	ret := make(map[string]interfaces.Agent, len(m.agents))
+	for id, agent := range m.agents {
+		ret[id] = agent
+	}
+	m.RUnlock()
+
+	for id, agent := range ret {
+		if !fn(id, agent) {
+			return
+		}
+	}
+}
+
+type registry interface {
+	Add(string, interfaces.Agent) bool
+	Remove(string) interfaces.Agent
+	Get(string) interfaces.Agent
+	Range(func(string, interfaces.Agent) bool)
+}
+
+const preloaded = 100000
+
+func getBenchmarkIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = strconv.Itoa(i) + "_1748400000000000000_1234567"
+	}
+	return ids
+}
+
+func preload(r registry, ids []string) {
+	for _, id := range ids {
+		if !r.Add(id, nil) {
+			panic("duplicated id")
+		}
+	}
+}
+
+// Reconnect storm: every goroutine adds and removes its own agents
+func benchmarkAddRemove(b *testing.B, r registry) {
+	preload(r, getBenchmarkIDs(preloaded))
+	var seq atomic.Int64
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		prefix := "p" + strconv.FormatInt(seq.Add(1), 10) + "_"
+		i := 0
+		for pb.Next() {
+			id := prefix + strconv.Itoa(i)
+			r.Add(id, nil)
+			r.Remove(id)
+			i++
+		}
+	})
+}
+
+// Pushes: lookups while a few writers keep accepting and finalizing
+func benchmarkGetWithWriters(b *testing.B, r registry) {
+	ids := getBenchmarkIDs(preloaded)
+	preload(r, ids)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			prefix := "w" + strconv.Itoa(w) + "_"
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				id := prefix + strconv.Itoa(i)
+				r.Add(id, nil)
+				r.Remove(id)
+			}
+		}(w)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			r.Get(ids[i%len(ids)])
+			i++
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+}
+
+// Broadcast: full iterations while writers keep accepting and finalizing
+func benchmarkRangeWithWriters(b *testing.B, r registry) {
+	preload(r, getBenchmarkIDs(preloaded))
+
+	done := make(chan struct{})
+	var writes atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			prefix := "w" + strconv.Itoa(w) + "_"
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				id := prefix + strconv.Itoa(i)
+				r.Add(id, nil)
+				r.Remove(id)
+				writes.Add(1)
+			}
+		}(w)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		count := 0
+		r.Range(func(string, interfaces.Agent) bool {
+			count++
+			return true
+		})
+		if count < preloaded {
+			panic("missing agents")
+		}
+	}
+	b.StopTimer()
+
+	close(done)
+	wg.Wait()
+	b.ReportMetric(float64(writes.Load())/b.Elapsed().Seconds(), "writes/s")
+}
+
+func BenchmarkRegistryAddRemove(b *testing.B) {
+	benchmarkAddRemove(b, New())
+}
+
+func BenchmarkLockedMapAddRemove(b *testing.B) {
+	benchmarkAddRemove(b, newLockedMap())
+}
+
+func BenchmarkRegistryGetWithWriters(b *testing.B) {
+	benchmarkGetWithWriters(b, New())
+}
+
+func BenchmarkLockedMapGetWithWriters(b *testing.B) {
+	benchmarkGetWithWriters(b, newLockedMap())
+}
+
+func BenchmarkRegistryRangeWithWriters(b *testing.B) {
+	benchmarkRangeWithWriters(b, New())
+}
+
+func BenchmarkLockedMapRangeWithWriters(b *testing.B) {
+	benchmarkRangeWithWriters(b, newLockedMap())
+}
+
+// Distinct agents, compared by pointer
+type testAgent struct {
+	interfaces.Agent
+	name string
+}
+
+func TestRegistry(t *testing.T) {
+	a, b, c := &testAgent{name: "a"}, &testAgent{name: "b"}, &testAgent{name: "c"}
+
+	type op struct {
+		do    string // add, remove, replace
+		id    string
+		old   interfaces.Agent
+		agent interfaces.Agent
+		ok    bool
+	}
+
+	tests := []struct {
+		name string
+		ops  []op
+		want map[string]interfaces.Agent
+	}{
+		{"add", []op{{do: "add", id: "1", agent: a, ok: true}, {do: "add", id: "2", agent: b, ok: true}}, map[string]interfaces.Agent{"1": a, "2": b}},
+		{"add twice", []op{{do: "add", id: "1", agent: a, ok: true}, {do: "add", id: "1", agent: b}}, map[string]interfaces.Agent{"1": a}},
+		{"remove", []op{{do: "add", id: "1", agent: a, ok: true}, {do: "remove", id: "1", agent: a, ok: true}, {do: "remove", id: "1"}}, map[string]interfaces.Agent{}},
+		{"replace", []op{{do: "add", id: "1", agent: a, ok: true}, {do: "replace", id: "1", old: a, agent: b, ok: true}}, map[string]interfaces.Agent{"1": b}},
+		{"replace another", []op{{do: "add", id: "1", agent: a, ok: true}, {do: "replace", id: "1", old: c, agent: b}}, map[string]interfaces.Agent{"1": a}},
+		{"replace missing", []op{{do: "replace", id: "1", old: a, agent: b}}, map[string]interfaces.Agent{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := New()
+			for i, op := range tt.ops {
+				var ok bool
+				switch op.do {
+				case "add":
+					ok = r.Add(op.id, op.agent)
+				case "remove":
+					removed := r.Remove(op.id)
+					ok = removed != nil
+					if ok && removed != op.agent {
+						t.Fatalf("op %d removed %v, want %v", i, removed, op.agent)
+					}
+				case "replace":
+					ok = r.Replace(op.id, op.old, op.agent)
+				}
+
+				if ok != op.ok {
+					t.Fatalf("op %d %s %s = %v, want %v", i, op.do, op.id, ok, op.ok)
+				}
+			}
+
+			if r.Len() != len(tt.want) {
+				t.Fatalf("Len() = %d, want %d", r.Len(), len(tt.want))
+			}
+
+			for id, agent := range tt.want {
+				if got := r.Get(id); got != agent {
+					t.Fatalf("Get(%s) = %v, want %v", id, got, agent)
+				}
+			}
+
+			seen := 0
+			r.Range(func(id string, agent interfaces.Agent) bool {
+				if tt.want[id] != agent {
+					t.Fatalf("Range visited %s %v", id, agent)
+				}
+				seen++
+				return true
+			})
+
+			if seen != len(tt.want) {
+				t.Fatalf("Range visited %d agents, want %d", seen, len(tt.want))
+			}
+		})
+	}
+}
+
+func TestRangeStopAndClear(t *testing.T) {
+	r := New()
+	for i := 0; i < 1000; i++ {
+		r.Add(strconv.Itoa(i), &testAgent{name: strconv.Itoa(i)})
+	}
+
+	visited := 0
+	r.Range(func(string, interfaces.Agent) bool {
+		visited++
+		return visited < 10
+	})
+
+	if visited != 10 {
+		t.Fatalf("Range visited %d agents after stopping at 10", visited)
+	}
+
+	if cleared := r.Clear(); len(cleared) != 1000 || r.Len() != 0 || r.Get("1") != nil {
+		t.Fatalf("Clear() returned %d agents, %d left", len(cleared), r.Len())
+	}
+}
+
+// The count follows concurrent adds and removes across shards
+func TestConcurrentCount(t *testing.T) {
+	r := New()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				id := strconv.Itoa(i)
+				if r.Add(id, &testAgent{name: id}) {
+					r.Remove(id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if r.Len() != 0 {
+		t.Fatalf("Len() = %d after removing every agent", r.Len())
+	}
+}
@@ -0,0 +1,135 @@
+package secure
+
+import (
+	"bufio"
+	"crypto/ed25519"
+	"gateway/pkg/codec"
+	"gateway/pkg/compress"
+	"io"
+	"net"
+	"sync"
+)
+
+const maxInflateSize = 16 * 1024 * 1024
+
+// Client side of a secured connection, for tests and stress tools
+type Client struct {
+	conn  net.Conn
+	codec codec.FrameCodec
+	br    *bufio.Reader
+	rx    *Cipher
+
+	wmu sync.Mutex
+	tx  *Cipher
+}
+
+// Run the handshake on conn, frames received before the reply are dropped
+func NewClient(conn net.Conn, fc codec.FrameCodec, msgID uint32, serverKey ed25519.PublicKey) (*Client, error) {
+	priv, hello, err := Hello()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{conn: conn, codec: fc, br: bufio.NewReader(conn)}
+	frame, err := fc.Append(nil, codec.Header{MsgID: msgID, Size: uint32(len(hello))})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(append(frame, hello...)); err != nil {
+		return nil, err
+	}
+
+	for {
+		header, _, body, err := client.readFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		if header.MsgID != msgID {
+			continue
+		}
+
+		client.rx, client.tx, err = Finish(priv, body, serverKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return client, nil
+	}
+}
+
+// Send a sealed frame, tail fills the tail field of the header
+func (client *Client) WriteFrame(msgID uint32, body []byte, tail uint32) error {
+	client.wmu.Lock()
+	defer client.wmu.Unlock()
+
+	frame, err := client.codec.Append(make([]byte, 0, client.codec.MaxHeaderLen()+len(body)+Overhead), codec.Header{MsgID: msgID, Size: uint32(len(body) + Overhead), Tail: tail})
+	if err != nil {
+		return err
+	}
+
+	frame = client.tx.Seal(frame, body, frame)
+	_, err = client.conn.Write(frame)
+
+	return err
+}
+
+// Receive and open a message, fragments are reassembled and compressed bodies inflated.
+// Not safe for concurrent use
+func (client *Client) ReadFrame() (uint32, []byte, uint32, error) {
+	var header codec.Header
+	var body []byte
+	for first := true; ; first = false {
+		h, raw, fragment, err := client.readFrame()
+		if err != nil {
+			return 0, nil, 0, err
+		}
+
+		fragment, err = client.rx.Open(fragment[:0], fragment, raw)
+		if err != nil {
+			return 0, nil, 0, err
+		}
+
+		if first {
+			header, body = h, fragment
+		} else {
+			body = append(body, fragment...)
+		}
+
+		if !h.More {
+			break
+		}
+
+		if len(body) > maxInflateSize {
+			return 0, nil, 0, ErrBadFrame
+		}
+	}
+
+	var err error
+	if header.Compressed {
+		if body, err = compress.Inflate(body, maxInflateSize); err != nil {
+			return 0, nil, 0, err
+		}
+	}
+
+	return header.MsgID, body, header.Tail, nil
+}
+
+func (client *Client) Close() error {
+	return client.conn.Close()
+}
+
+func (client *Client) readFrame() (codec.Header, []byte, []byte, error) {
+	header, raw, err := codec.ReadHeader(client.br, client.codec, nil)
+	if err != nil {
+		return codec.Header{}, nil, nil, err
+	}
+
+	body := make([]byte, header.Size)
+	if _, err := io.ReadFull(client.br, body); err != nil {
+		return codec.Header{}, nil, nil, err
+	}
+
+	return header, raw, body, nil
+}
@@ -0,0 +1,199 @@
+package secure
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Handshake: the client sends its ephemeral X25519 public key, the server answers with its own
+// ephemeral public key and an ed25519 signature of both keys made with the long-term server key.
+// Each direction derives an AES-256-GCM key with HKDF-SHA256 from the shared secret, nonces are
+// frame counters so nothing but the tag is added to a body.
+
+const (
+	PublicKeySize = 32
+	HelloSize     = PublicKeySize
+	ReplySize     = PublicKeySize + ed25519.SignatureSize
+	Overhead      = 16 // GCM tag
+
+	handshakeLabel = "gateway handshake v1"
+	clientInfo     = "gateway client to server"
+	serverInfo     = "gateway server to client"
+	keySize        = 32
+)
+
+var (
+	ErrBadHandshake = errors.New("bad secure handshake")
+	ErrBadKey       = errors.New("bad secure key")
+	ErrBadFrame     = errors.New("bad secure frame")
+)
+
+// Sealing of one direction, the nonce is the number of frames already sealed or opened
+type Cipher struct {
+	aead    cipher.AEAD
+	counter uint64
+	nonce   [12]byte
+}
+
+func newCipher(secret []byte, salt []byte, info string) (*Cipher, error) {
+	key := make([]byte, keySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, []byte(info)), key); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead: aead}, nil
+}
+
+func (c *Cipher) next() []byte {
+	binary.LittleEndian.PutUint64(c.nonce[4:], c.counter)
+	c.counter++
+	return c.nonce[:]
+}
+
+// Append the sealed msg to dst, ad is authenticated but not encrypted
+func (c *Cipher) Seal(dst []byte, msg []byte, ad []byte) []byte {
+	return c.aead.Seal(dst, c.next(), msg, ad)
+}
+
+// Append the opened msg to dst, msg[:0] opens in place
+func (c *Cipher) Open(dst []byte, msg []byte, ad []byte) ([]byte, error) {
+	out, err := c.aead.Open(dst, c.next(), msg, ad)
+	if err != nil {
+		return nil, ErrBadFrame
+	}
+
+	return out, nil
+}
+
+// Seal a frame body, the whole header is authenticated (writer.Sealer)
+func (c *Cipher) SealFrame(dst []byte, body []byte, header []byte) []byte {
+	return c.Seal(dst, body, header)
+}
+
+func (c *Cipher) Overhead() int {
+	return Overhead
+}
+
+// Server side of the handshake, returns the reply and the ciphers to open client frames and seal server frames
+func Accept(key ed25519.PrivateKey, hello []byte) ([]byte, *Cipher, *Cipher, error) {
+	if len(hello) != HelloSize || len(key) != ed25519.PrivateKeySize {
+		return nil, nil, nil, ErrBadHandshake
+	}
+
+	clientPub, err := ecdh.X25519().NewPublicKey(hello)
+	if err != nil {
+		return nil, nil, nil, ErrBadHandshake
+	}
+
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	secret, err := priv.ECDH(clientPub)
+	if err != nil {
+		return nil, nil, nil, ErrBadHandshake
+	}
+
+	serverPub := priv.PublicKey().Bytes()
+	transcript := transcript(hello, serverPub)
+
+	rx, err := newCipher(secret, transcript, clientInfo)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	tx, err := newCipher(secret, transcript, serverInfo)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	reply := append(serverPub, ed25519.Sign(key, append([]byte(handshakeLabel), transcript...))...)
+	return reply, rx, tx, nil
+}
+
+// Client side of the handshake, hello is the body of the first frame
+func Hello() (*ecdh.PrivateKey, []byte, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return priv, priv.PublicKey().Bytes(), nil
+}
+
+// Check the server reply, returns the ciphers to open server frames and seal client frames
+func Finish(priv *ecdh.PrivateKey, reply []byte, serverKey ed25519.PublicKey) (*Cipher, *Cipher, error) {
+	if len(reply) != ReplySize || len(serverKey) != ed25519.PublicKeySize {
+		return nil, nil, ErrBadHandshake
+	}
+
+	serverPub := reply[:PublicKeySize]
+	transcript := transcript(priv.PublicKey().Bytes(), serverPub)
+	if !ed25519.Verify(serverKey, append([]byte(handshakeLabel), transcript...), reply[PublicKeySize:]) {
+		return nil, nil, ErrBadHandshake
+	}
+
+	pub, err := ecdh.X25519().NewPublicKey(serverPub)
+	if err != nil {
+		return nil, nil, ErrBadHandshake
+	}
+
+	secret, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, nil, ErrBadHandshake
+	}
+
+	rx, err := newCipher(secret, transcript, serverInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := newCipher(secret, transcript, clientInfo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return rx, tx, nil
+}
+
+func transcript(clientPub []byte, serverPub []byte) []byte {
+	return append(bytes.Clone(clientPub), serverPub...)
+}
+
+// Read the server key, the file holds the hex encoded 32 byte ed25519 seed
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, ErrBadKey
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -0,0 +1,247 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"gateway/pkg/writer"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Minimal RFC 6455 server side, the payloads of binary frames form a byte stream
+// so the agent can read the usual gateway frames on top of it
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	magicKey       = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	maxControlSize = 125
+)
+
+var (
+	ErrBadHandshake  = errors.New("bad websocket handshake")
+	ErrUnmaskedFrame = errors.New("unmasked websocket frame")
+	ErrBadFrame      = errors.New("bad websocket frame")
+)
+
+type Conn struct {
+	net.Conn
+	br *bufio.Reader
+
+	remaining uint64  // Unread payload of the current frame
+	mask      [4]byte // Mask key of the current frame
+	maskPos   int
+
+	wmu sync.Mutex
+}
+
+// Check whether the request asks for a websocket upgrade
+func IsUpgrade(req *http.Request) bool {
+	return headerContains(req.Header, "Connection", "upgrade") && headerContains(req.Header, "Upgrade", "websocket")
+}
+
+// Complete the handshake on a hijacked connection, br holds the bytes already read from conn
+func Upgrade(conn net.Conn, br *bufio.Reader, req *http.Request) (*Conn, error) {
+	if req.Method != http.MethodGet || !IsUpgrade(req) {
+		return nil, ErrBadHandshake
+	}
+
+	if req.Header.Get("Sec-Websocket-Version") != "13" {
+		return nil, fmt.Errorf("%w: unsupported version", ErrBadHandshake)
+	}
+
+	key := strings.TrimSpace(req.Header.Get("Sec-Websocket-Key"))
+	if key == "" {
+		return nil, fmt.Errorf("%w: missing key", ErrBadHandshake)
+	}
+
+	h := sha1.New()
+	h.Write([]byte(key + magicKey))
+	accept := base64.StdEncoding.EncodeToString(h.Sum(nil))
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		return nil, err
+	}
+
+	return &Conn{Conn: conn, br: br}, nil
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if uint64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+
+	n, err := c.br.Read(p)
+	c.unmask(p[:n])
+	c.remaining -= uint64(n)
+
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Read frame headers until a data frame with payload arrives, control frames are handled here
+func (c *Conn) nextFrame() error {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return err
+	}
+
+	// No extension was negotiated, the reserved bits stay clear
+	opcode := head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return ErrBadFrame
+	}
+
+	if head[1]&0x80 == 0 {
+		return ErrUnmaskedFrame
+	}
+
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return err
+		}
+		size = binary.BigEndian.Uint64(ext[:])
+		if size>>63 != 0 {
+			return ErrBadFrame
+		}
+	}
+
+	if _, err := io.ReadFull(c.br, c.mask[:]); err != nil {
+		return err
+	}
+	c.maskPos = 0
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = size
+		return nil
+	case opClose, opPing, opPong:
+		// Control frames are never fragmented
+		if size > maxControlSize || head[0]&0x80 == 0 {
+			return ErrBadFrame
+		}
+
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+
+		if opcode == opClose {
+			c.writeFrame(opClose, payload)
+			return io.EOF
+		}
+
+		if opcode == opPing {
+			return c.writeFrame(opPong, payload)
+		}
+
+		return nil
+	default:
+		return ErrBadFrame
+	}
+}
+
+func (c *Conn) unmask(p []byte) {
+	for i := range p {
+		p[i] ^= c.mask[c.maskPos&3]
+		c.maskPos++
+	}
+}
+
+func (c *Conn) writeFrame(opcode byte, payload []byte) error {
+	buf := appendFrameHeader(make([]byte, 0, len(payload)+10), opcode, len(payload))
+	buf = append(buf, payload...)
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.Conn.Write(buf)
+
+	return err
+}
+
+// Send the queued gateway frames as one binary message
+func (c *Conn) WriteBuffers(b *net.Buffers) (int64, error) {
+	length := 0
+	for _, buf := range *b {
+		length += len(buf)
+	}
+
+	vec := make(net.Buffers, 0, len(*b)+1)
+	vec = append(vec, appendFrameHeader(make([]byte, 0, 10), opBinary, length))
+	vec = append(vec, *b...)
+	*b = (*b)[len(*b):]
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	n, err := writer.WriteBuffers(c.Conn, &vec)
+
+	return n, err
+}
+
+func appendFrameHeader(buf []byte, opcode byte, length int) []byte {
+	buf = append(buf, 0x80|opcode)
+
+	switch {
+	case length <= 125:
+		buf = append(buf, byte(length))
+	case length <= 65535:
+		buf = append(buf, 126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(length))
+	default:
+		buf = append(buf, 127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(length))
+	}
+
+	return buf
+}
+
+func headerContains(header http.Header, key string, token string) bool {
+	for _, value := range header.Values(key) {
+		for _, v := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(v), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
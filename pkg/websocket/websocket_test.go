@@ -0,0 +1,154 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// Connection keeping what the server wrote
+type recordConn struct {
+	net.Conn
+	out bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	return c.out.Write(p)
+}
+
+var testMask = [4]byte{0x12, 0x34, 0x56, 0x78}
+
+// Frame as sent by a client, masked unless mask is nil
+func clientFrame(first byte, payload []byte, mask *[4]byte) []byte {
+	buf := []byte{first}
+	maskBit := byte(0)
+	if mask != nil {
+		maskBit = 0x80
+	}
+
+	switch {
+	case len(payload) <= 125:
+		buf = append(buf, maskBit|byte(len(payload)))
+	case len(payload) <= 65535:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(payload)))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(len(payload)))
+	}
+
+	if mask == nil {
+		return append(buf, payload...)
+	}
+
+	buf = append(buf, mask[:]...)
+	for i, b := range payload {
+		buf = append(buf, b^mask[i&3])
+	}
+
+	return buf
+}
+
+func concat(frames ...[]byte) []byte {
+	return bytes.Join(frames, nil)
+}
+
+func TestRead(t *testing.T) {
+	long := bytes.Repeat([]byte("0123456789"), 7000)
+
+	tests := []struct {
+		name  string
+		input []byte
+		want  []byte
+		reply []byte // Frames written by the server
+		err   error
+	}{
+		{"binary", clientFrame(0x82, []byte("hello"), &testMask), []byte("hello"), nil, io.EOF},
+		{"empty then binary", concat(clientFrame(0x82, nil, &testMask), clientFrame(0x82, []byte("x"), &testMask)), []byte("x"), nil, io.EOF},
+		{"16 bit length", clientFrame(0x82, long[:300], &testMask), long[:300], nil, io.EOF},
+		{"64 bit length", clientFrame(0x82, long, &testMask), long, nil, io.EOF},
+		{"continuation", concat(clientFrame(0x02, []byte("hel"), &testMask), clientFrame(0x80, []byte("lo"), &testMask)), []byte("hello"), nil, io.EOF},
+		{"ping between", concat(clientFrame(0x02, []byte("hel"), &testMask), clientFrame(0x89, []byte("p"), &testMask), clientFrame(0x80, []byte("lo"), &testMask)), []byte("hello"), []byte{0x8a, 1, 'p'}, io.EOF},
+		{"pong ignored", concat(clientFrame(0x8a, []byte("p"), &testMask), clientFrame(0x82, []byte("x"), &testMask)), []byte("x"), nil, io.EOF},
+		{"close", clientFrame(0x88, []byte{0x03, 0xe8}, &testMask), nil, []byte{0x88, 2, 0x03, 0xe8}, io.EOF},
+		{"unmasked", clientFrame(0x82, []byte("hello"), nil), nil, nil, ErrUnmaskedFrame},
+		{"reserved bits", clientFrame(0xc2, []byte("hello"), &testMask), nil, nil, ErrBadFrame},
+		{"unknown opcode", clientFrame(0x83, []byte("hello"), &testMask), nil, nil, ErrBadFrame},
+		{"fragmented ping", clientFrame(0x09, []byte("p"), &testMask), nil, nil, ErrBadFrame},
+		{"long ping", clientFrame(0x89, long[:126], &testMask), nil, nil, ErrBadFrame},
+		{"64 bit length overflow", []byte{0x82, 0xff, 0x80, 0, 0, 0, 0, 0, 0, 0, 1, 2, 3, 4}, nil, nil, ErrBadFrame},
+		{"truncated header", []byte{0x82}, nil, nil, io.ErrUnexpectedEOF},
+		{"truncated mask", []byte{0x82, 0x85, 1, 2}, nil, nil, io.ErrUnexpectedEOF},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := new(recordConn)
+			c := &Conn{Conn: conn, br: bufio.NewReader(bytes.NewReader(tt.input))}
+
+			// Small reads cross frame and mask boundaries
+			var got []byte
+			var err error
+			buf := make([]byte, 7)
+			for {
+				var n int
+				n, err = c.Read(buf)
+				got = append(got, buf[:n]...)
+				if err != nil {
+					break
+				}
+			}
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Read() = %v, want %v", err, tt.err)
+			}
+
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("read %q, want %q", got, tt.want)
+			}
+
+			if !bytes.Equal(conn.out.Bytes(), tt.reply) {
+				t.Fatalf("wrote %x, want %x", conn.out.Bytes(), tt.reply)
+			}
+		})
+	}
+}
+
+func TestWriteBuffers(t *testing.T) {
+	tests := []struct {
+		name   string
+		length int
+		header []byte
+	}{
+		{"7 bit", 125, []byte{0x82, 125}},
+		{"16 bit", 126, []byte{0x82, 126, 0, 126}},
+		{"16 bit largest", 65535, []byte{0x82, 126, 0xff, 0xff}},
+		{"64 bit", 65536, []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := new(recordConn)
+			c := &Conn{Conn: conn}
+
+			// Queued frames go out as one unmasked binary message
+			payload := bytes.Repeat([]byte{1}, tt.length)
+			b := net.Buffers{payload[:tt.length/2], payload[tt.length/2:]}
+			if _, err := c.WriteBuffers(&b); err != nil {
+				t.Fatal(err)
+			}
+
+			if want := append(tt.header, payload...); !bytes.Equal(conn.out.Bytes(), want) {
+				t.Fatalf("wrote header %x, want %x", conn.out.Bytes()[:len(tt.header)], tt.header)
+			}
+
+			if len(b) != 0 {
+				t.Fatalf("%d buffers left", len(b))
+			}
+		})
+	}
+}
@@ -1,74 +1,286 @@
 package writer
 
 import (
-	"encoding/binary"
+	"gateway/pkg/bufpool"
+	"gateway/pkg/codec"
+	"gateway/pkg/compress"
+	"gateway/pkg/encoding"
 	"io"
+	"net"
 	"sync"
+	"sync/atomic"
 )
 
+// Connections wrapping a socket implement it to keep vectored writes
+type BuffersWriter interface {
+	WriteBuffers(b *net.Buffers) (int64, error)
+}
+
+// Transforms a body after compression, e.g. encryption. The header is filled before Seal is called
+type Sealer interface {
+	Overhead() int
+	SealFrame(dst []byte, body []byte, header []byte) []byte
+}
+
+type compression struct {
+	threshold int
+	level     int
+}
+
+// Frames handed out by Pop, they go back to the pool in Flush
+type Batch struct {
+	frames []*[]byte
+	vec    net.Buffers
+	out    net.Buffers // Consumed by the vectored write, vec keeps its capacity
+	size   int
+}
+
+func (b *Batch) Len() int {
+	if b == nil {
+		return 0
+	}
+
+	return b.size
+}
+
+func (b *Batch) reset() {
+	for i := range b.frames {
+		bufpool.Put(b.frames[i])
+		b.frames[i] = nil
+	}
+
+	b.frames = b.frames[:0]
+	b.vec = b.vec[:0]
+	b.out = nil
+	b.size = 0
+}
+
+// Frame queue with one consumer: Pop and Flush must not be called concurrently
 type Writer struct {
-	w   io.Writer
-	b   []byte
-	err error
+	w     io.Writer
+	codec codec.FrameCodec
+	err   atomic.Pointer[error] // First write error, written by Flush and read by the producers
 	sync.Mutex
+
+	queue   *Batch // Frames waiting for Pop
+	flushed *Batch // Frames handed out by the last Pop
+
+	compression  atomic.Pointer[compression] // Set once compression was negotiated
+	fragmentSize int                         // Longer bodies are split, 0 disables fragmentation
+	crc          bool                        // The tail carries the crc of the body
+	index        uint32                      // Index of the next message, salts the crc
 }
 
-func New(wr io.Writer) *Writer {
+func New(wr io.Writer, fc codec.FrameCodec) *Writer {
 	w := &Writer{
-		w: wr,
+		w:       wr,
+		codec:   fc,
+		queue:   new(Batch),
+		flushed: new(Batch),
 	}
 
 	return w
 }
 
-func (w *Writer) Write(msgID uint16, msg []byte, seqID uint32) error {
-	if w.err != nil {
-		return w.err
+func (w *Writer) Write(msgID uint32, msg []byte, seqID uint32) error {
+	return w.WriteSealed(msgID, msg, seqID, nil)
+}
+
+// Queue a frame, the body is compressed first then sealed. Callers sealing frames
+// order their calls, the queue keeps that order
+func (w *Writer) WriteSealed(msgID uint32, msg []byte, seqID uint32, sealer Sealer) error {
+	if err := w.failed(); err != nil {
+		return err
 	}
 
-	length := len(msg)
-	buf := make([]byte, length+10)
-	copy(buf[10:], msg)
+	// Compressed bodies are kept only when smaller
+	body := msg
+	compressed := false
+	if c := w.compression.Load(); c != nil && len(msg) >= c.threshold {
+		pooled := bufpool.Get(len(msg))
+		defer bufpool.Put(pooled)
 
-	binary.LittleEndian.PutUint16(buf[:2], msgID)
-	binary.LittleEndian.PutUint32(buf[2:6], uint32(length+10))
-	binary.LittleEndian.PutUint32(buf[6:10], seqID)
+		if out, ok := compress.Deflate((*pooled)[:0], msg, c.level); ok && len(out) < len(msg) {
+			body, compressed = out, true
+		}
+	}
 
-	w.Lock()
-	defer w.Unlock()
-	w.b = append(w.b, buf...)
+	header := codec.Header{MsgID: msgID, Tail: seqID, Compressed: compressed}
+
+	// The crc index follows the queue order, the frame is built under the lock
+	if w.crc {
+		w.Lock()
+		defer w.Unlock()
+
+		header.Tail = encoding.CRC(msg, w.index)
+		w.index++
+	}
+
+	if w.fragmentSize > 0 && len(body) > w.fragmentSize {
+		return w.writeFragments(header, body, sealer)
+	}
+
+	frame, err := w.frame(header, body, sealer)
+	if err != nil {
+		return err
+	}
+
+	if !w.crc {
+		w.Lock()
+		defer w.Unlock()
+	}
+	w.queue.frames = append(w.queue.frames, frame)
+	w.queue.size += len(*frame)
 
 	return nil
 }
 
-func (w *Writer) Pop() ([]byte, error) {
-	if w.err != nil {
-		return nil, w.err
+// Split a long body into frames of fragmentSize bytes, queued together. Called with the lock held in crc mode
+func (w *Writer) writeFragments(header codec.Header, body []byte, sealer Sealer) error {
+	frames := make([]*[]byte, 0, (len(body)+w.fragmentSize-1)/w.fragmentSize)
+	for len(body) > 0 {
+		n := min(len(body), w.fragmentSize)
+		header.More = n < len(body)
+
+		frame, err := w.frame(header, body[:n], sealer)
+		if err != nil {
+			for _, frame := range frames {
+				bufpool.Put(frame)
+			}
+
+			return err
+		}
+
+		frames = append(frames, frame)
+		body = body[n:]
+	}
+
+	if !w.crc {
+		w.Lock()
+		defer w.Unlock()
+	}
+	for _, frame := range frames {
+		w.queue.frames = append(w.queue.frames, frame)
+		w.queue.size += len(*frame)
+	}
+
+	return nil
+}
+
+// Build a frame in a pooled buffer
+func (w *Writer) frame(header codec.Header, body []byte, sealer Sealer) (*[]byte, error) {
+	overhead := 0
+	if sealer != nil {
+		overhead = sealer.Overhead()
+	}
+	header.Size = uint32(len(body) + overhead)
+
+	frame := bufpool.Get(w.codec.MaxHeaderLen() + len(body) + overhead)
+	buf, err := w.codec.Append((*frame)[:0], header)
+	if err != nil {
+		bufpool.Put(frame)
+		return nil, err
+	}
+
+	n := len(buf)
+	if sealer != nil {
+		sealer.SealFrame(buf[n:n], body, buf[:n])
+	} else {
+		copy(buf[n:n+len(body)], body)
+	}
+	*frame = buf[:n+len(body)+overhead]
+
+	return frame, nil
+}
+
+// Carry the crc of every body in the tail, salted with the message index, set before the first write
+func (w *Writer) SetCRC(enabled bool) {
+	w.crc = enabled
+}
+
+// Split bodies longer than size into continuation frames, set before the first write
+func (w *Writer) SetFragmentSize(size int) {
+	w.fragmentSize = size
+}
+
+// Compress bodies of at least threshold bytes with deflate, level 0 turns compression off
+func (w *Writer) SetCompression(threshold int, level int) {
+	if level == 0 {
+		w.compression.Store(nil)
+		return
+	}
+
+	w.compression.Store(&compression{threshold: threshold, level: level})
+}
+
+// Take the queued frames without copying them
+func (w *Writer) Pop() (*Batch, error) {
+	if err := w.failed(); err != nil {
+		return nil, err
 	}
 
-	// TODO 加pool 优化
 	w.Lock()
 	defer w.Unlock()
-	tmp := make([]byte, len(w.b))
-	copy(tmp, w.b)
 
-	if cap(w.b) > 262144 {
-		w.b = nil
-	} else {
-		w.b = w.b[:0]
+	// The previous batch was flushed, it becomes the new queue
+	w.flushed.reset()
+	w.queue, w.flushed = w.flushed, w.queue
+
+	return w.flushed, nil
+}
+
+// Bytes queued and not popped yet
+func (w *Writer) Len() int {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.queue.size
+}
+
+// Send a batch with one vectored write and give its frames back to the pool
+func (w *Writer) Flush(b *Batch) error {
+	if err := w.failed(); err != nil {
+		return err
+	}
+
+	if b.Len() == 0 {
+		return nil
 	}
 
-	return tmp, nil
+	for _, frame := range b.frames {
+		b.vec = append(b.vec, *frame)
+	}
+
+	// WriteTo consumes the vector, the frames are still referenced by b.frames
+	b.out = b.vec
+	_, err := WriteBuffers(w.w, &b.out)
+
+	w.Lock()
+	b.reset()
+	w.Unlock()
+
+	// Allocated on failure only, the first error sticks
+	if err != nil {
+		failure := err
+		w.err.CompareAndSwap(nil, &failure)
+	}
+
+	return w.failed()
 }
 
-func (w *Writer) Flush(b []byte) error {
-	if w.err != nil {
-		return w.err
+func (w *Writer) failed() error {
+	if err := w.err.Load(); err != nil {
+		return *err
 	}
 
-	if _, err := w.w.Write(b); err != nil {
-		w.err = err
+	return nil
+}
+
+// Vectored write through connection wrappers, net.Buffers only uses writev on the net package types
+func WriteBuffers(w io.Writer, b *net.Buffers) (int64, error) {
+	if bw, ok := w.(BuffersWriter); ok {
+		return bw.WriteBuffers(b)
 	}
 
-	return w.err
+	return b.WriteTo(w)
 }
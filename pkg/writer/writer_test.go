@@ -0,0 +1,357 @@
+package writer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"gateway/pkg/codec"
+	"gateway/pkg/compress"
+	"gateway/pkg/encoding"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const msgHeaderLen = 10
+
+// The writer before pooling, kept as the baseline of the benchmarks
+type legacyWriter struct {
+	w   io.Writer
+	b   []byte
+	err error
+	sync.Mutex
+}
+
+func (w *legacyWriter) Write(msgID uint16, msg []byte, seqID uint32) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	length := len(msg)
+	buf := make([]byte, length+10)
+	copy(buf[10:], msg)
+
+	binary.LittleEndian.PutUint16(buf[:2], msgID)
+	binary.LittleEndian.PutUint32(buf[2:6], uint32(length+10))
+	binary.LittleEndian.PutUint32(buf[6:10], seqID)
+
+	w.Lock()
+	defer w.Unlock()
+	w.b = append(w.b, buf...)
+
+	return nil
+}
+
+func (w *legacyWriter) Pop() ([]byte, error) {
+	if w.err != nil {
+		return nil, w.err
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	tmp := make([]byte, len(w.b))
+	copy(tmp, w.b)
+
+	if cap(w.b) > 262144 {
+		w.b = nil
+	} else {
+		w.b = w.b[:0]
+	}
+
+	return tmp, nil
+}
+
+func (w *legacyWriter) Flush(b []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if _, err := w.w.Write(b); err != nil {
+		w.err = err
+	}
+
+	return w.err
+}
+
+// Frames queued between two flushes of the write loop
+const benchmarkBatch = 16
+
+func benchmarkWriter(b *testing.B, size int) {
+	w := New(io.Discard, codec.Classic{})
+	msg := make([]byte, size)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(benchmarkBatch * (size + msgHeaderLen)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkBatch; j++ {
+			if err := w.Write(1000, msg, 0); err != nil {
+				panic(err)
+			}
+		}
+
+		batch, err := w.Pop()
+		if err != nil {
+			panic(err)
+		}
+
+		if err := w.Flush(batch); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func benchmarkLegacyWriter(b *testing.B, size int) {
+	w := &legacyWriter{w: io.Discard}
+	msg := make([]byte, size)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(benchmarkBatch * (size + msgHeaderLen)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchmarkBatch; j++ {
+			if err := w.Write(1000, msg, 0); err != nil {
+				panic(err)
+			}
+		}
+
+		buf, err := w.Pop()
+		if err != nil {
+			panic(err)
+		}
+
+		if err := w.Flush(buf); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkWriter128(b *testing.B)        { benchmarkWriter(b, 128) }
+func BenchmarkLegacyWriter128(b *testing.B)  { benchmarkLegacyWriter(b, 128) }
+func BenchmarkWriter4096(b *testing.B)       { benchmarkWriter(b, 4096) }
+func BenchmarkLegacyWriter4096(b *testing.B) { benchmarkLegacyWriter(b, 4096) }
+
+type frame struct {
+	header codec.Header
+	body   string
+}
+
+// Write msgs, flush them and decode the frames sent
+func writeFrames(t *testing.T, w *Writer, fc codec.FrameCodec, out *bytes.Buffer, msgs []string) []frame {
+	t.Helper()
+
+	for _, msg := range msgs {
+		if err := w.Write(1000, []byte(msg), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	batch, err := w.Pop()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Flush(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	var frames []frame
+	data := out.Bytes()
+	for len(data) > 0 {
+		header, err := fc.Decode(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		end := header.Len + int(header.Size)
+		frames = append(frames, frame{header: header, body: string(data[header.Len:end])})
+		data = data[end:]
+	}
+
+	return frames
+}
+
+func TestWriteFragments(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		msgs   []string
+		bodies []string // Frames sent, a trailing + marks the continuation flag
+	}{
+		{"disabled", 0, []string{"hello world"}, []string{"hello world"}},
+		{"short", 16, []string{"hello"}, []string{"hello"}},
+		{"exact", 5, []string{"hello"}, []string{"hello"}},
+		{"split", 4, []string{"hello world"}, []string{"hell+", "o wo+", "rld"}},
+		{"split evenly", 4, []string{"abcdefgh"}, []string{"abcd+", "efgh"}},
+		{"in order", 4, []string{"abcdef", "xy", "123456789"}, []string{"abcd+", "ef", "xy", "1234+", "5678+", "9"}},
+	}
+
+	for _, tt := range tests {
+		for _, fc := range []codec.FrameCodec{codec.Classic{}, codec.V2{}} {
+			t.Run(tt.name+"/"+fc.Name(), func(t *testing.T) {
+				out := new(bytes.Buffer)
+				w := New(out, fc)
+				w.SetFragmentSize(tt.size)
+
+				frames := writeFrames(t, w, fc, out, tt.msgs)
+				if len(frames) != len(tt.bodies) {
+					t.Fatalf("%d frames, want %d", len(frames), len(tt.bodies))
+				}
+
+				for i, f := range frames {
+					body, more := strings.CutSuffix(tt.bodies[i], "+")
+					if f.body != body || f.header.More != more || f.header.MsgID != 1000 {
+						t.Fatalf("frame %d %+v %q, want %q more %v", i, f.header, f.body, body, more)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestWriteCompression(t *testing.T) {
+	random := make([]byte, 256)
+	rand.Read(random)
+
+	tests := []struct {
+		name       string
+		level      int
+		msg        string
+		compressed bool
+	}{
+		{"under the threshold", compress.MaxLevel, strings.Repeat("a", 63), false},
+		{"at the threshold", compress.MaxLevel, strings.Repeat("a", 64), true},
+		{"over the threshold", compress.MinLevel, strings.Repeat("ab", 1000), true},
+		{"random", compress.MaxLevel, string(random), false},
+		{"stored by best speed", compress.MinLevel, strings.Repeat("a", 64), false}, // Short inputs are not encoded at level 1
+		{"off", 0, strings.Repeat("a", 64), false},
+	}
+
+	for _, tt := range tests {
+		for _, fc := range []codec.FrameCodec{codec.Classic{}, codec.V2{}} {
+			t.Run(tt.name+"/"+fc.Name(), func(t *testing.T) {
+				out := new(bytes.Buffer)
+				w := New(out, fc)
+				w.SetCompression(64, tt.level)
+
+				frames := writeFrames(t, w, fc, out, []string{tt.msg})
+				if len(frames) != 1 || frames[0].header.Compressed != tt.compressed {
+					t.Fatalf("frames %+v, want one compressed %v", frames, tt.compressed)
+				}
+
+				body := []byte(frames[0].body)
+				if tt.compressed {
+					if len(body) >= len(tt.msg) {
+						t.Fatalf("compressed body of %d bytes, message of %d", len(body), len(tt.msg))
+					}
+
+					var err error
+					if body, err = compress.Inflate(body, len(tt.msg)); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				if string(body) != tt.msg {
+					t.Fatalf("body %q, want %q", body, tt.msg)
+				}
+			})
+		}
+	}
+}
+
+func TestWriteCRC(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		msgs []string
+		// Message index of every frame, fragments share the index and crc of their message
+		indexes []uint32
+		salted  bool // Frames 0 and 2 carry the same body at different indexes
+	}{
+		{"whole", 0, []string{"a", "b", "a"}, []uint32{0, 1, 2}, true},
+		{"fragments", 4, []string{"hello world", "xy"}, []uint32{0, 0, 0, 1}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := new(bytes.Buffer)
+			w := New(out, codec.Classic{})
+			w.SetCRC(true)
+			w.SetFragmentSize(tt.size)
+
+			frames := writeFrames(t, w, codec.Classic{}, out, tt.msgs)
+			if len(frames) != len(tt.indexes) {
+				t.Fatalf("%d frames, want %d", len(frames), len(tt.indexes))
+			}
+
+			for i, f := range frames {
+				msg := tt.msgs[tt.indexes[i]]
+				if want := encoding.CRC([]byte(msg), tt.indexes[i]); f.header.Tail != want {
+					t.Fatalf("frame %d crc %x, want %x", i, f.header.Tail, want)
+				}
+			}
+
+			if tt.salted && frames[0].header.Tail == frames[2].header.Tail {
+				t.Fatal("crc is not salted with the message index")
+			}
+		})
+	}
+}
+
+// Fails every write after the first ok ones
+type failingWriter struct {
+	ok  int
+	err error
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.ok == 0 {
+		return 0, w.err
+	}
+
+	w.ok--
+	return len(p), nil
+}
+
+func TestWriteError(t *testing.T) {
+	first := errors.New("first")
+	fw := &failingWriter{ok: 1, err: first}
+	w := New(fw, codec.Classic{})
+
+	flush := func() error {
+		if err := w.Write(1000, []byte("body"), 0); err != nil {
+			return err
+		}
+
+		batch, err := w.Pop()
+		if err != nil {
+			return err
+		}
+
+		return w.Flush(batch)
+	}
+
+	if err := flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flush(); !errors.Is(err, first) {
+		t.Fatalf("Flush() = %v, want %v", err, first)
+	}
+
+	// The first error sticks, later calls fail without writing
+	fw.err = errors.New("second")
+	if err := w.Write(1000, []byte("body"), 0); !errors.Is(err, first) {
+		t.Fatalf("Write() = %v, want %v", err, first)
+	}
+
+	if _, err := w.Pop(); !errors.Is(err, first) {
+		t.Fatalf("Pop() = %v, want %v", err, first)
+	}
+
+	if err := w.Flush(new(Batch)); !errors.Is(err, first) {
+		t.Fatalf("Flush() = %v, want %v", err, first)
+	}
+}